@@ -3,7 +3,9 @@
 //
 // Usage:
 //
-//	go run ./cmd/adduser -username padraic -password testing
+//	go run ./cmd/adduser -username padraic -password testing [-role analyst]
+//
+// Without -role, new users are viewers and existing users keep their role.
 package main
 
 import (
@@ -12,38 +14,49 @@ import (
 	"fmt"
 	"log"
 
-	"golang.org/x/crypto/bcrypt"
-
 	"github.com/padraicbc/mikeapi/config"
 	bundb "github.com/padraicbc/mikeapi/db"
+	"github.com/padraicbc/mikeapi/handlers"
 	"github.com/padraicbc/mikeapi/models"
 )
 
 func main() {
 	username := flag.String("username", "", "username (required)")
 	password := flag.String("password", "", "plain-text password (required)")
+	role := flag.String("role", "", "role: viewer, analyst or admin")
 	flag.Parse()
 
 	if *username == "" || *password == "" {
 		log.Fatal("both -username and -password are required")
 	}
+	if *role != "" && !models.ValidRole(*role) {
+		log.Fatalf("invalid -role %q: want viewer, analyst or admin", *role)
+	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(*password), bcrypt.DefaultCost)
+	cfg := config.Load()
+	policy := handlers.NewPasswordPolicy(cfg.PasswordMinLength, cfg.PasswordDenyList)
+	hash, err := handlers.HashPasswordForUser(*username, *password, policy)
 	if err != nil {
-		log.Fatal("bcrypt:", err)
+		log.Fatal("hash password:", err)
 	}
 
-	cfg := config.Load()
 	db := bundb.Setup(cfg)
 	defer db.Close()
 
 	user := &models.User{
 		Username: *username,
-		Password: string(hash),
+		Password: hash,
+		Role:     models.RoleViewer,
+	}
+
+	onConflict := "CONFLICT (username) DO UPDATE SET password = EXCLUDED.password"
+	if *role != "" {
+		user.Role = *role
+		onConflict += ", role = EXCLUDED.role"
 	}
 
 	_, err = db.NewInsert().Model(user).
-		On("CONFLICT (username) DO UPDATE SET password = EXCLUDED.password").
+		On(onConflict).
 		Exec(context.Background())
 	if err != nil {
 		log.Fatal("insert user:", err)
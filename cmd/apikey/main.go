@@ -0,0 +1,123 @@
+// cmd/apikey/main.go
+// Issues, lists and revokes API keys for machine clients such as the scraper.
+//
+// Usage:
+//
+//	go run ./cmd/apikey create -name mikerp -scopes read,ingest [-expires 8760h]
+//	go run ./cmd/apikey list
+//	go run ./cmd/apikey revoke -id 3
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/padraicbc/mikeapi/config"
+	bundb "github.com/padraicbc/mikeapi/db"
+	"github.com/padraicbc/mikeapi/handlers"
+	"github.com/padraicbc/mikeapi/models"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: apikey create -name NAME -scopes read,write,ingest [-expires DURATION]")
+	fmt.Fprintln(os.Stderr, "       apikey list")
+	fmt.Fprintln(os.Stderr, "       apikey revoke -id ID")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	ctx := context.Background()
+	cmd, args := os.Args[1], os.Args[2:]
+
+	switch cmd {
+	case "create":
+		fs := flag.NewFlagSet("create", flag.ExitOnError)
+		name := fs.String("name", "", "key name, e.g. the client it belongs to (required)")
+		scopes := fs.String("scopes", "", "comma-separated scopes: read, write, ingest (required)")
+		expires := fs.Duration("expires", 0, "lifetime, e.g. 8760h; 0 never expires")
+		_ = fs.Parse(args)
+
+		ak, key, err := handlers.NewAPIKey(*name, strings.Split(*scopes, ","), "cli", *expires)
+		if err != nil {
+			log.Fatal("create key: ", err)
+		}
+
+		db := bundb.Setup(config.Load())
+		defer db.Close()
+		if _, err := db.NewInsert().Model(ak).Exec(ctx); err != nil {
+			log.Fatal("insert key: ", err)
+		}
+
+		fmt.Printf("api key %d %q created with scopes %s\n", ak.ID, ak.Name, strings.Join(ak.Scopes, ","))
+		fmt.Printf("key (shown once, send as X-API-Key): %s\n", key)
+
+	case "list":
+		db := bundb.Setup(config.Load())
+		defer db.Close()
+
+		var keys []models.APIKey
+		if err := db.NewSelect().Model(&keys).OrderExpr("ak.id").Scan(ctx); err != nil {
+			log.Fatal("list keys: ", err)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tPREFIX\tSCOPES\tCREATED\tEXPIRES\tLAST USED\tSTATUS")
+		for _, k := range keys {
+			status := "active"
+			switch {
+			case k.RevokedAt != nil:
+				status = "revoked"
+			case k.ExpiresAt != nil && k.ExpiresAt.Before(time.Now()):
+				status = "expired"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				k.ID, k.Name, k.Prefix, strings.Join(k.Scopes, ","),
+				k.CreatedAt.Format(time.DateOnly), fmtTime(k.ExpiresAt), fmtTime(k.LastUsedAt), status)
+		}
+		_ = tw.Flush()
+
+	case "revoke":
+		fs := flag.NewFlagSet("revoke", flag.ExitOnError)
+		id := fs.Int("id", 0, "key id (required)")
+		_ = fs.Parse(args)
+		if *id <= 0 {
+			log.Fatal("-id is required")
+		}
+
+		db := bundb.Setup(config.Load())
+		defer db.Close()
+
+		res, err := db.NewUpdate().Model((*models.APIKey)(nil)).
+			Set("revoked_at = now()").
+			Where("id = ?", *id).
+			Where("revoked_at IS NULL").
+			Exec(ctx)
+		if err != nil {
+			log.Fatal("revoke key: ", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			log.Fatalf("api key %d not found or already revoked", *id)
+		}
+		fmt.Printf("api key %d revoked\n", *id)
+
+	default:
+		usage()
+	}
+}
+
+func fmtTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.DateTime)
+}
@@ -0,0 +1,4 @@
+#!/bin/bash
+
+CGO_ENABLED=0 go build -o csv
+scp csv  padraic@$MIKEDO:/home/padraic/app
@@ -0,0 +1,121 @@
+// cmd/csv/main.go
+// Imports analysts' CSV sheets into the race tables and exports tables, or
+// the joined results view, back to CSV. The audit log and revisions can be
+// exported but not imported; users, API keys and tokens are not available.
+//
+// Imports upsert each line on the table's unique key (races on course, date
+// and time; results on race and horse) and only touch the columns in the
+// file. Headers match column or JSON names; -map renames the rest, and a
+// header mapped to - is ignored. Nothing is written unless every line
+// imports, and -dry-run checks every line against the database without
+// writing anything.
+//
+// Usage:
+//
+//	go run ./cmd/csv tables
+//	go run ./cmd/csv import -dry-run -map "Horse=horse_id,Notes=-" results ratings.csv
+//	go run ./cmd/csv export -from 2024-01-01 -to 2024-12-31 results_view > 2024.csv
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/padraicbc/mikeapi/config"
+	"github.com/padraicbc/mikeapi/csvio"
+	bundb "github.com/padraicbc/mikeapi/db"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: csv tables")
+	fmt.Fprintln(os.Stderr, "       csv import [-dry-run] [-map HEADER=COLUMN,...] TABLE FILE")
+	fmt.Fprintln(os.Stderr, "       csv export [-from DATE] [-to DATE] TABLE > FILE")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	ctx := context.Background()
+	cmd, args := os.Args[1], os.Args[2:]
+
+	switch cmd {
+	case "tables":
+		for _, name := range csvio.Names() {
+			fmt.Println(name)
+		}
+
+	case "import":
+		fs := flag.NewFlagSet("import", flag.ExitOnError)
+		dryRun := fs.Bool("dry-run", false, "check every line but write nothing")
+		mapFlag := fs.String("map", "", "header renames, e.g. Horse=horse_id,Notes=- to skip Notes")
+		_ = fs.Parse(args)
+		if fs.NArg() != 2 {
+			usage()
+		}
+		mapping, err := csvio.ParseMapping(*mapFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		f, err := os.Open(fs.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+
+		db := bundb.Setup(config.Load())
+		defer db.Close()
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer tx.Rollback()
+
+		opts := csvio.ImportOptions{Table: fs.Arg(0), Mapping: mapping, DryRun: *dryRun}
+		report, err := csvio.Import(ctx, tx, f, opts, nil)
+		if err != nil {
+			log.Fatal("import: ", err)
+		}
+		for _, e := range report.Errors {
+			fmt.Fprintf(os.Stderr, "%s:%s\n", fs.Arg(1), e)
+		}
+		fmt.Printf("%s: %d rows, %d inserted, %d updated, %d unchanged, %d errors\n",
+			report.Table, report.Rows, report.Inserted, report.Updated, report.Unchanged, len(report.Errors))
+		switch {
+		case !report.OK():
+			fmt.Println("nothing imported")
+			os.Exit(1)
+		case *dryRun:
+			fmt.Println("dry run, nothing imported")
+		default:
+			if err := tx.Commit(); err != nil {
+				log.Fatal("commit: ", err)
+			}
+		}
+
+	case "export":
+		fs := flag.NewFlagSet("export", flag.ExitOnError)
+		from := fs.String("from", "", "first race date, YYYY-MM-DD")
+		to := fs.String("to", "", "last race date, YYYY-MM-DD")
+		_ = fs.Parse(args)
+		if fs.NArg() != 1 {
+			usage()
+		}
+
+		db := bundb.Setup(config.Load())
+		defer db.Close()
+		n, err := csvio.Export(ctx, db, os.Stdout, csvio.ExportOptions{Name: fs.Arg(0), From: *from, To: *to})
+		if err != nil {
+			log.Fatal("export: ", err)
+		}
+		fmt.Fprintf(os.Stderr, "%s: %d rows\n", fs.Arg(0), n)
+
+	default:
+		usage()
+	}
+}
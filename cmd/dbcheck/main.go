@@ -0,0 +1,148 @@
+// cmd/dbcheck/main.go
+// Finds rows that break the schema's relationships: results, intermediary and
+// pre-race rows pointing at missing races or horses, and results or cards whose
+// course differs from their race's. Rows can be repaired in batch or one by one,
+// after which the NOT VALID foreign keys can be validated.
+//
+// Usage:
+//
+//	go run ./cmd/dbcheck                       # report only
+//	go run ./cmd/dbcheck -repair [-validate]   # repair everything, then validate
+//	go run ./cmd/dbcheck -interactive          # confirm each row
+//	go run ./cmd/dbcheck -validate             # validate foreign keys of clean checks
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/uptrace/bun"
+
+	"github.com/padraicbc/mikeapi/config"
+	bundb "github.com/padraicbc/mikeapi/db"
+)
+
+// maxInteractive caps the rows offered one by one per check; use -repair for more.
+const maxInteractive = 500
+
+func main() {
+	repair := flag.Bool("repair", false, "repair every failing row")
+	interactive := flag.Bool("interactive", false, "ask before repairing each row")
+	validate := flag.Bool("validate", false, "validate NOT VALID foreign keys whose checks pass")
+	limit := flag.Int("limit", 10, "failing rows to show per check")
+	flag.Parse()
+
+	ctx := context.Background()
+	db := bundb.Setup(config.Load())
+	defer db.Close()
+
+	in := bufio.NewReader(os.Stdin)
+	remaining := 0
+	clean := map[string]bool{}
+
+	for _, ic := range bundb.IntegrityChecks {
+		n, err := ic.Count(ctx, db)
+		if err != nil {
+			log.Fatalf("%s: %v", ic.Name, err)
+		}
+		if n == 0 {
+			fmt.Printf("ok    %-24s\n", ic.Name)
+			markClean(clean, ic)
+			continue
+		}
+		fmt.Printf("FAIL  %-24s %d %s (repair: %s)\n", ic.Name, n, ic.Description, ic.Action())
+
+		rows, err := ic.Rows(ctx, db, *limit)
+		if err != nil {
+			log.Fatalf("%s: %v", ic.Name, err)
+		}
+		for _, r := range rows {
+			fmt.Printf("      %s=%d %s\n", ic.Key, r.Key, r.Row)
+		}
+
+		switch {
+		case ic.Manual:
+		case *interactive:
+			n -= repairInteractive(ctx, db, in, ic)
+		case *repair:
+			fixed, err := ic.Repair(ctx, db, nil)
+			if err != nil {
+				log.Fatalf("%s: repair: %v", ic.Name, err)
+			}
+			fmt.Printf("      repaired %d rows\n", fixed)
+			n -= int(fixed)
+		}
+		if n <= 0 {
+			markClean(clean, ic)
+		} else {
+			remaining += n
+		}
+	}
+
+	if *validate {
+		pending, err := bundb.UnvalidatedConstraints(ctx, db)
+		if err != nil {
+			log.Fatalf("list constraints: %v", err)
+		}
+		for _, name := range pending {
+			if !clean[name] {
+				fmt.Printf("skip  validate %s: its check still fails\n", name)
+				continue
+			}
+			if err := bundb.ValidateConstraint(ctx, db, name); err != nil {
+				log.Fatalf("validate %s: %v", name, err)
+			}
+			fmt.Printf("valid %s\n", name)
+		}
+	}
+
+	if remaining > 0 {
+		fmt.Printf("%d rows still fail\n", remaining)
+		os.Exit(1)
+	}
+}
+
+// markClean records that a check's constraints can be validated.
+func markClean(clean map[string]bool, ic bundb.IntegrityCheck) {
+	for _, c := range ic.Constraints {
+		clean[c] = true
+	}
+}
+
+// repairInteractive walks the failing rows of a check, asking for each one,
+// and returns the number repaired. At most maxInteractive rows are offered.
+func repairInteractive(ctx context.Context, db *bun.DB, in *bufio.Reader, ic bundb.IntegrityCheck) int {
+	rows, err := ic.Rows(ctx, db, maxInteractive)
+	if err != nil {
+		log.Fatalf("%s: %v", ic.Name, err)
+	}
+
+	fixed := 0
+	for _, r := range rows {
+		fmt.Printf("%s %s=%d %s\n  %s? [y]es / [n]o / [a]ll / [q]uit: ", ic.Name, ic.Key, r.Key, r.Row, ic.Action())
+		answer, _ := in.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			key := r.Key
+			n, err := ic.Repair(ctx, db, &key)
+			if err != nil {
+				log.Fatalf("%s: repair %d: %v", ic.Name, r.Key, err)
+			}
+			fixed += int(n)
+		case "a", "all":
+			n, err := ic.Repair(ctx, db, nil)
+			if err != nil {
+				log.Fatalf("%s: repair: %v", ic.Name, err)
+			}
+			return fixed + int(n)
+		case "q", "quit":
+			return fixed
+		}
+	}
+	return fixed
+}
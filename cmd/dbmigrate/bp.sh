@@ -0,0 +1,4 @@
+#!/bin/bash
+
+CGO_ENABLED=0 go build -o dbmigrate
+scp dbmigrate  padraic@$MIKEDO:/home/padraic/app
@@ -0,0 +1,141 @@
+// cmd/dbmigrate/main.go
+// Applies, reverts and creates versioned schema migrations (db/migrations).
+// The server refuses to start until every embedded migration has been applied.
+// The baseline, 0001_initial, adopts the existing database and cannot be
+// reverted: its down script fails rather than drop the racing data.
+//
+// Usage:
+//
+//	go run ./cmd/dbmigrate up [-steps N]
+//	go run ./cmd/dbmigrate down [-steps N]
+//	go run ./cmd/dbmigrate status
+//	go run ./cmd/dbmigrate create [-dir db/migrations] add_horse_sire
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/padraicbc/mikeapi/config"
+	bundb "github.com/padraicbc/mikeapi/db"
+)
+
+var nonName = regexp.MustCompile(`[^a-z0-9]+`)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: dbmigrate up [-steps N]")
+	fmt.Fprintln(os.Stderr, "       dbmigrate down [-steps N]")
+	fmt.Fprintln(os.Stderr, "       dbmigrate status")
+	fmt.Fprintln(os.Stderr, "       dbmigrate create [-dir DIR] NAME")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	ctx := context.Background()
+	cmd, args := os.Args[1], os.Args[2:]
+
+	switch cmd {
+	case "up":
+		fs := flag.NewFlagSet("up", flag.ExitOnError)
+		steps := fs.Int("steps", 0, "apply at most N migrations; 0 applies all")
+		_ = fs.Parse(args)
+
+		cfg := config.Load()
+		db := bundb.Setup(cfg)
+		defer db.Close()
+		applied, err := bundb.MigrateUp(ctx, db, *steps, cfg.AdminUsers)
+		for _, m := range applied {
+			log.Printf("applied %04d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatal("up: ", err)
+		}
+		if len(applied) == 0 {
+			log.Println("schema is up to date")
+		}
+
+	case "down":
+		fs := flag.NewFlagSet("down", flag.ExitOnError)
+		steps := fs.Int("steps", 1, "revert the N most recent migrations")
+		_ = fs.Parse(args)
+		if *steps <= 0 {
+			log.Fatal("-steps must be positive")
+		}
+
+		db := bundb.Setup(config.Load())
+		defer db.Close()
+		reverted, err := bundb.MigrateDown(ctx, db, *steps)
+		for _, m := range reverted {
+			log.Printf("reverted %04d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatal("down: ", err)
+		}
+
+	case "status":
+		db := bundb.Setup(config.Load())
+		defer db.Close()
+		states, err := bundb.MigrationStatus(ctx, db)
+		if err != nil {
+			log.Fatal("status: ", err)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, st := range states {
+			applied := "pending"
+			switch {
+			case st.Missing:
+				applied = st.AppliedAt.Format("2006-01-02 15:04") + " (no file in this binary)"
+			case st.AppliedAt != nil:
+				applied = st.AppliedAt.Format("2006-01-02 15:04")
+			}
+			fmt.Fprintf(tw, "%04d\t%s\t%s\n", st.Version, st.Name, applied)
+		}
+		_ = tw.Flush()
+
+	case "create":
+		fs := flag.NewFlagSet("create", flag.ExitOnError)
+		dir := fs.String("dir", "db/migrations", "migrations directory")
+		_ = fs.Parse(args)
+		if fs.NArg() != 1 {
+			usage()
+		}
+		name := strings.Trim(nonName.ReplaceAllString(strings.ToLower(fs.Arg(0)), "_"), "_")
+		if name == "" {
+			log.Fatal("migration name must contain letters or digits")
+		}
+
+		migs, err := bundb.LoadMigrations(os.DirFS(*dir), ".")
+		if err != nil {
+			log.Fatal("read migrations: ", err)
+		}
+		next := int64(1)
+		if len(migs) > 0 {
+			next = migs[len(migs)-1].Version + 1
+		}
+
+		for _, dirn := range []string{"up", "down"} {
+			path := filepath.Join(*dir, fmt.Sprintf("%04d_%s.%s.sql", next, name, dirn))
+			body := fmt.Sprintf("-- %04d_%s (%s)\n", next, name, dirn)
+			if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+				log.Fatal("write migration: ", err)
+			}
+			fmt.Println(path)
+		}
+
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,87 @@
+// cmd/horsestats/main.go
+// Rebuilds the aggregate columns on horses (last win, last run and winning
+// weights and claims, highest winning rating) from results, after bulk
+// migrations or hand edits have let them drift. Prints each horse whose
+// columns change.
+//
+// Usage:
+//
+//	go run ./cmd/horsestats -dry-run
+//	go run ./cmd/horsestats -horse 12345,67890
+//	go run ./cmd/horsestats -from 2024-01-01 -to 2024-03-31
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/padraicbc/mikeapi/config"
+	bundb "github.com/padraicbc/mikeapi/db"
+	"github.com/padraicbc/mikeapi/horsestats"
+)
+
+func main() {
+	horses := flag.String("horse", "", "comma-separated horse ids; default all horses")
+	from := flag.String("from", "", "only horses that ran on or after this date, YYYY-MM-DD")
+	to := flag.String("to", "", "only horses that ran on or before this date, YYYY-MM-DD")
+	dryRun := flag.Bool("dry-run", false, "report changes without writing them")
+	flag.Parse()
+
+	opts := horsestats.Options{From: *from, To: *to, DryRun: *dryRun}
+	if *horses != "" {
+		for _, s := range strings.Split(*horses, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || id <= 0 {
+				log.Fatalf("bad horse id %q", s)
+			}
+			opts.HorseIDs = append(opts.HorseIDs, id)
+		}
+	}
+
+	ctx := context.Background()
+	db := bundb.Setup(config.Load())
+	defer db.Close()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	report, err := horsestats.Recompute(ctx, tx, opts, nil)
+	if err != nil {
+		log.Fatal("recompute: ", err)
+	}
+	if !*dryRun {
+		if err := tx.Commit(); err != nil {
+			log.Fatal("commit: ", err)
+		}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HORSE ID\tHORSE\tCOLUMN\tOLD\tNEW")
+	for _, ch := range report.Changed {
+		for _, col := range ch.Columns {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", ch.HorseID, ch.Horse, col.Column, fmtInt(col.Old), fmtInt(col.New))
+		}
+	}
+	_ = tw.Flush()
+
+	verb := "updated"
+	if *dryRun {
+		verb = "would be updated (dry run)"
+	}
+	fmt.Printf("%d horses checked, %d %s\n", report.Checked, len(report.Changed), verb)
+}
+
+func fmtInt(n *int) string {
+	if n == nil {
+		return "NULL"
+	}
+	return strconv.Itoa(*n)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// checkpoint records how far a table has been copied. LastKey is the highest
+// source primary key committed; Since is the --since date the copy ran with.
+type checkpoint struct {
+	bun.BaseModel `bun:"table:migrate_checkpoints,alias:mc"`
+
+	TableName   string     `bun:"table_name,pk"`
+	LastKey     int64      `bun:"last_key,notnull"`
+	Since       *string    `bun:"since,type:date"`
+	RowsCopied  int64      `bun:"rows_copied,notnull"`
+	UpdatedAt   time.Time  `bun:"updated_at,notnull"`
+	CompletedAt *time.Time `bun:"completed_at"`
+}
+
+// loadCheckpoint returns the table's checkpoint, or nil if it has none.
+func loadCheckpoint(ctx context.Context, db bun.IDB, table string) (*checkpoint, error) {
+	cp := &checkpoint{}
+	err := db.NewSelect().Model(cp).
+		ColumnExpr("mc.table_name, mc.last_key, mc.since::text AS since, mc.rows_copied, mc.updated_at, mc.completed_at").
+		Where("mc.table_name = ?", table).
+		Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return cp, err
+}
+
+// advanceCheckpoint moves the table's checkpoint to lastKey after n more rows,
+// in the same transaction as the rows themselves.
+func advanceCheckpoint(ctx context.Context, db bun.IDB, table string, lastKey int64, since *string, n int) error {
+	_, err := db.NewRaw(`
+		INSERT INTO migrate_checkpoints (table_name, last_key, since, rows_copied, updated_at)
+		VALUES (?, ?, ?::date, ?, now())
+		ON CONFLICT (table_name) DO UPDATE SET
+			last_key = EXCLUDED.last_key,
+			since = EXCLUDED.since,
+			rows_copied = migrate_checkpoints.rows_copied + EXCLUDED.rows_copied,
+			updated_at = now(),
+			completed_at = NULL`,
+		table, lastKey, since, n,
+	).Exec(ctx)
+	return err
+}
+
+// startCheckpoint resets the table's checkpoint for a copy from the beginning.
+func startCheckpoint(ctx context.Context, db bun.IDB, table string, since *string) error {
+	_, err := db.NewRaw(`
+		INSERT INTO migrate_checkpoints (table_name, last_key, since, rows_copied, updated_at)
+		VALUES (?, 0, ?::date, 0, now())
+		ON CONFLICT (table_name) DO UPDATE SET
+			last_key = 0, since = EXCLUDED.since, rows_copied = 0, updated_at = now(), completed_at = NULL`,
+		table, since,
+	).Exec(ctx)
+	return err
+}
+
+// completeCheckpoint marks the table as fully copied up to its last key.
+func completeCheckpoint(ctx context.Context, db bun.IDB, table string) error {
+	_, err := db.NewRaw(`UPDATE migrate_checkpoints SET completed_at = now(), updated_at = now() WHERE table_name = ?`, table).
+		Exec(ctx)
+	return err
+}
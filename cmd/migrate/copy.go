@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// appendCopyRow appends one row in COPY text format: tab-separated columns,
+// \N for NULL, backslash escapes, and a trailing newline.
+func appendCopyRow(b []byte, vals []*string) []byte {
+	for i, v := range vals {
+		if i > 0 {
+			b = append(b, '\t')
+		}
+		if v == nil {
+			b = append(b, `\N`...)
+			continue
+		}
+		b = appendCopyText(b, *v)
+	}
+	return append(b, '\n')
+}
+
+var copyEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+func appendCopyText(b []byte, s string) []byte {
+	return append(b, copyEscaper.Replace(s)...)
+}
+
+// stageTable names the temporary table a page is copied into before merging.
+func stageTable(s tableSpec) string {
+	return "migrate_stage_" + s.name
+}
+
+// createStageSQL creates an unconstrained temporary copy of the spec's
+// columns, dropped when the page transaction ends.
+func createStageSQL(s tableSpec) string {
+	return fmt.Sprintf("CREATE TEMP TABLE %s ON COMMIT DROP AS SELECT %s FROM %s WITH NO DATA",
+		stageTable(s), identList(s.pgColumns()), s.name)
+}
+
+func copyStageSQL(s tableSpec) string {
+	return fmt.Sprintf("COPY %s (%s) FROM STDIN", stageTable(s), identList(s.pgColumns()))
+}
+
+// identList quotes column names, several of which (date, time, class) are keywords.
+func identList(cols []string) string {
+	return `"` + strings.Join(cols, `", "`) + `"`
+}
+
+// mergeSQL moves a staged page into the table. Existing rows are skipped, or
+// with sync overwritten when any update column differs. NULLs in columns
+// mapped with null "default" take the column default.
+func mergeSQL(s tableSpec, sync bool) string {
+	cols := s.pgColumns()
+	exprs := make([]string, len(cols))
+	for i, c := range s.cols {
+		exprs[i] = `"` + c.target + `"`
+		if c.null == "default" {
+			exprs[i] = fmt.Sprintf(`COALESCE("%s", %s)`, c.target, *c.pgDefault)
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "INSERT INTO %s AS t (%s) SELECT %s FROM %s",
+		s.name, identList(cols), strings.Join(exprs, ", "), stageTable(s))
+	if !sync {
+		b.WriteString(" ON CONFLICT DO NOTHING")
+		return b.String()
+	}
+
+	set := make([]string, len(s.updates))
+	current := make([]string, len(s.updates))
+	incoming := make([]string, len(s.updates))
+	for i, col := range s.updates {
+		set[i] = fmt.Sprintf(`"%s" = EXCLUDED."%[1]s"`, col)
+		current[i] = `t."` + col + `"`
+		incoming[i] = `EXCLUDED."` + col + `"`
+	}
+	if s.versioned {
+		set = append(set, "version = t.version + 1")
+	}
+	fmt.Fprintf(&b, ` ON CONFLICT ("%s") DO UPDATE SET %s WHERE (%s) IS DISTINCT FROM (%s)`,
+		s.pgKey, strings.Join(set, ", "), strings.Join(current, ", "), strings.Join(incoming, ", "))
+	return b.String()
+}
+
+// tableProgress counts one table's rows as pages commit.
+type tableProgress struct {
+	name    string
+	start   time.Time
+	read    atomic.Int64
+	written atomic.Int64
+	done    atomic.Bool
+}
+
+func (p *tableProgress) String() string {
+	elapsed := time.Since(p.start)
+	read := p.read.Load()
+	return fmt.Sprintf("%-15s  %d rows read, %d written in %s (%.0f rows/s)",
+		p.name, read, p.written.Load(), elapsed.Round(time.Millisecond), float64(read)/elapsed.Seconds())
+}
+
+// reportProgress logs every unfinished table each interval until ctx ends.
+func reportProgress(ctx context.Context, interval time.Duration, mu *sync.Mutex, running *[]*tableProgress) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			mu.Lock()
+			for _, p := range *running {
+				if !p.done.Load() {
+					log.Printf("%s ...", p)
+				}
+			}
+			mu.Unlock()
+		}
+	}
+}
+
+// copyLevels copies the selected tables level by level. Tables on one level run
+// in parallel; the first failure stops the load after its level finishes.
+func copyLevels(ctx context.Context, myDB *sql.DB, pgDB *bun.DB, specs []tableSpec, opts options) error {
+	var (
+		mu      sync.Mutex
+		running []*tableProgress
+	)
+	if opts.progress > 0 {
+		progCtx, stop := context.WithCancel(ctx)
+		defer stop()
+		go reportProgress(progCtx, opts.progress, &mu, &running)
+	}
+
+	for _, level := range byLevel(specs) {
+		var (
+			wg   sync.WaitGroup
+			errs = make([]error, len(level))
+		)
+		for i, s := range level {
+			p := &tableProgress{name: s.name, start: time.Now()}
+			mu.Lock()
+			running = append(running, p)
+			mu.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := copyTable(ctx, myDB, pgDB, s, opts, p); err != nil {
+					errs[i] = fmt.Errorf("migrate %s: %w", s.name, err)
+					return
+				}
+				p.done.Store(true)
+				log.Print(p)
+			}()
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// byLevel groups specs by level, lowest first, keeping their order within a level.
+func byLevel(specs []tableSpec) [][]tableSpec {
+	var levels [][]tableSpec
+	for _, s := range specs {
+		for len(levels) <= s.level {
+			levels = append(levels, nil)
+		}
+		levels[s.level] = append(levels[s.level], s)
+	}
+	out := levels[:0]
+	for _, l := range levels {
+		if len(l) > 0 {
+			out = append(out, l)
+		}
+	}
+	return out
+}
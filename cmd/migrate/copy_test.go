@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAppendCopyRow(t *testing.T) {
+	tests := []struct {
+		name string
+		vals []*string
+		want string
+	}{
+		{"plain", []*string{str("1"), str("Frankel")}, "1\tFrankel\n"},
+		{"null", []*string{str("1"), nil, str("")}, "1\t\\N\t\n"},
+		{"tab", []*string{str("a\tb")}, `a\tb` + "\n"},
+		{"newline", []*string{str("a\nb")}, `a\nb` + "\n"},
+		{"carriage return", []*string{str("a\r\nb")}, `a\r\nb` + "\n"},
+		{"backslash", []*string{str(`C:\dir`)}, `C:\\dir` + "\n"},
+		{"literal \\N is not NULL", []*string{str(`\N`)}, `\\N` + "\n"},
+		{"no columns", nil, "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(appendCopyRow(nil, tt.vals)); got != tt.want {
+				t.Errorf("appendCopyRow = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Rows append to what is already in the buffer.
+	b := appendCopyRow([]byte("x\n"), []*string{str("y")})
+	if string(b) != "x\ny\n" {
+		t.Errorf("appendCopyRow onto a buffer = %q", b)
+	}
+}
+
+func TestMergeSQL(t *testing.T) {
+	def := "0"
+	s := tableSpec{
+		name: "horses", pgKey: "horse_id", versioned: true,
+		updates: []string{"horse", "highest_win_weight"},
+		cols: []columnSpec{
+			{target: "horse_id", null: "keep"},
+			{target: "horse", null: "error"},
+			{target: "highest_win_weight", null: "default", pgDefault: &def},
+		},
+	}
+
+	insert := `INSERT INTO horses AS t ("horse_id", "horse", "highest_win_weight") ` +
+		`SELECT "horse_id", "horse", COALESCE("highest_win_weight", 0) FROM migrate_stage_horses`
+	if got, want := mergeSQL(s, false), insert+" ON CONFLICT DO NOTHING"; got != want {
+		t.Errorf("mergeSQL(false) =\n%s\nwant\n%s", got, want)
+	}
+
+	got := mergeSQL(s, true)
+	want := insert + ` ON CONFLICT ("horse_id") DO UPDATE SET "horse" = EXCLUDED."horse", ` +
+		`"highest_win_weight" = EXCLUDED."highest_win_weight", version = t.version + 1 ` +
+		`WHERE (t."horse", t."highest_win_weight") IS DISTINCT FROM (EXCLUDED."horse", EXCLUDED."highest_win_weight")`
+	if got != want {
+		t.Errorf("mergeSQL(true) =\n%s\nwant\n%s", got, want)
+	}
+
+	s.versioned = false
+	if strings.Contains(mergeSQL(s, true), "version") {
+		t.Error("an unversioned table bumps version")
+	}
+}
+
+func TestStageSQL(t *testing.T) {
+	s := tableSpec{name: "races", cols: []columnSpec{{target: "race_id"}, {target: "date"}}}
+	if got, want := createStageSQL(s), `CREATE TEMP TABLE migrate_stage_races ON COMMIT DROP AS SELECT "race_id", "date" FROM races WITH NO DATA`; got != want {
+		t.Errorf("createStageSQL = %s", got)
+	}
+	if got, want := copyStageSQL(s), `COPY migrate_stage_races ("race_id", "date") FROM STDIN`; got != want {
+		t.Errorf("copyStageSQL = %s", got)
+	}
+}
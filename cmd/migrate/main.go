@@ -1,20 +1,43 @@
 // cmd/migrate/main.go
 // Migrates data from a remote MySQL rpData database into the local PostgreSQL database.
 //
+// Tables are copied in pages ordered by primary key. Each page is streamed with
+// COPY into a temporary staging table and merged into the real one, and the
+// last key is stored in migrate_checkpoints in the same transaction, so an
+// interrupted run can continue with -resume instead of starting again. Tables
+// that do not depend on each other are copied in parallel.
+//
+// Which columns go where is described in mapping.json, embedded in the binary:
+// source and target columns, transforms such as date, and what NULL becomes.
+// Pass -mapping to copy with another file, for example after adding a column,
+// without rebuilding.
+//
+// Run repeatedly with -sync -since during a cutover to pick up changed rows.
+//
+// With -verify nothing is copied: each table is compared between MySQL and
+// Postgres by row count and by per-column checksums over primary key ranges,
+// with sample rows for ranges that differ. The JSON report goes to stdout and
+// the exit status is 1 when anything differs.
+//
 // Usage:
 //
 //	MYSQL_DSN="user:pass@tcp(host:3306)/rpData?parseTime=true" \
 //	RPPASS="pgpass" \
-//	go run ./cmd/migrate
+//	go run ./cmd/migrate [-resume] [-tables races,results] [-since 2025-01-01] [-sync]
+//	go run ./cmd/migrate -verify [-tables races] [-since 2025-01-01] > report.json
+//	go run ./cmd/migrate -mapping ./mapping.json
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"os"
 	"strings"
 	"time"
 
@@ -24,14 +47,59 @@ import (
 
 	"github.com/padraicbc/mikeapi/config"
 	bundb "github.com/padraicbc/mikeapi/db"
-	"github.com/padraicbc/mikeapi/models"
 )
 
-const batchSize = 500
+// options are the command-line switches shared by every table copy.
+type options struct {
+	resume   bool
+	since    *string
+	sync     bool
+	batch    int           // rows per page
+	progress time.Duration // interval between progress lines, 0 for none
+	replica  bool          // FK triggers can be skipped with session_replication_role
+}
 
 func main() {
+	resume := flag.Bool("resume", false, "continue each table after its last checkpointed key")
+	mappingPath := flag.String("mapping", "", "table mapping file (default: the embedded mapping.json)")
+	only := flag.String("tables", "", "comma-separated tables to copy (default all in the mapping)")
+	since := flag.String("since", "", "only copy races, cards, results and intermediary rows from this date (YYYY-MM-DD)")
+	sync := flag.Bool("sync", false, "update rows that already exist instead of skipping them")
+	batch := flag.Int("batch", 5000, "rows copied and checkpointed per page")
+	progress := flag.Duration("progress", 10*time.Second, "interval between progress lines (0 to disable)")
+	verify := flag.Bool("verify", false, "compare MySQL and Postgres instead of copying; prints a JSON report")
+	verifyRange := flag.Int64("verify-range", 10000, "primary key range checksummed at a time by -verify")
+	verifySamples := flag.Int("verify-samples", 20, "differing rows reported per table by -verify")
+	flag.Parse()
+
 	ctx := context.Background()
 
+	opts := options{resume: *resume, sync: *sync, batch: *batch, progress: *progress}
+	if opts.batch <= 0 {
+		log.Fatal("-batch must be positive")
+	}
+	if *since != "" {
+		if _, err := time.Parse(time.DateOnly, *since); err != nil {
+			log.Fatalf("-since must be YYYY-MM-DD: %v", err)
+		}
+		opts.since = since
+	}
+	m, err := loadMapping(*mappingPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	specs, err := m.compile()
+	if err != nil {
+		log.Fatal(err)
+	}
+	selected, err := selectTables(specs, *only)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *verifyRange <= 0 {
+		log.Fatal("-verify-range must be positive")
+	}
+
 	cfg := config.Load()
 
 	// --- MySQL ---
@@ -43,6 +111,7 @@ func main() {
 		log.Fatalf("open mysql: %v", err)
 	}
 	defer myDB.Close()
+	// One connection per table on the widest level.
 	myDB.SetMaxOpenConns(4)
 	if err := myDB.PingContext(ctx); err != nil {
 		log.Fatalf("ping mysql: %v", err)
@@ -54,14 +123,30 @@ func main() {
 	defer pgDB.Close()
 	log.Println("connected to PostgreSQL")
 
-	// Create tables (idempotent)
-	if err := bundb.CreateTables(ctx, pgDB); err != nil {
+	if *verify {
+		if err := bindTables(ctx, pgDB, selected); err != nil {
+			log.Fatal(err)
+		}
+		report := verifyTables(ctx, myDB, pgDB, selected, opts.since, *verifyRange, *verifySamples)
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			log.Fatalf("write report: %v", err)
+		}
+		if !report.OK {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Bring the schema up to date (idempotent)
+	if applied, err := bundb.MigrateUp(ctx, pgDB, 0, cfg.AdminUsers); err != nil {
 		if !isInsufficientPrivilege(err) {
-			log.Fatalf("create tables: %v", err)
+			log.Fatalf("schema migrations: %v", err)
 		}
-		log.Printf("create tables skipped (insufficient privilege): %v", err)
+		log.Printf("schema migrations skipped (insufficient privilege): %v", err)
 
-		missing, checkErr := missingTables(ctx, pgDB)
+		missing, checkErr := missingTables(ctx, pgDB, selected)
 		if checkErr != nil {
 			log.Fatalf("verify tables after create skip: %v", checkErr)
 		}
@@ -69,526 +154,214 @@ func main() {
 			log.Fatalf("cannot continue: missing tables and no create privilege: %s", strings.Join(missing, ", "))
 		}
 		log.Println("all required tables already exist; continuing without create privilege")
-	}
-
-	// Disable FK enforcement so we can load in bulk without strict ordering
-	if _, err := pgDB.ExecContext(ctx, "SET session_replication_role = 'replica'"); err != nil {
-		if isInsufficientPrivilege(err) {
-			log.Printf("disable FK skipped (insufficient privilege): %v", err)
-		} else {
-			log.Fatalf("disable FK: %v", err)
-		}
 	} else {
-		defer func() {
-			if _, err := pgDB.ExecContext(ctx, "SET session_replication_role = 'origin'"); err != nil {
-				log.Printf("re-enable FK: %v", err)
-			}
-		}()
-	}
-
-	steps := []struct {
-		name string
-		fn   func() (int, error)
-	}{
-		{"users", func() (int, error) { return migrateUsers(ctx, myDB, pgDB) }},
-		{"courses", func() (int, error) { return migrateCourses(ctx, myDB, pgDB) }},
-		{"horses", func() (int, error) { return migrateHorses(ctx, myDB, pgDB) }},
-		{"trainers", func() (int, error) { return migrateTrainers(ctx, myDB, pgDB) }},
-		{"races", func() (int, error) { return migrateRaces(ctx, myDB, pgDB) }},
-		{"pre_race", func() (int, error) { return migratePreRace(ctx, myDB, pgDB) }},
-		{"results", func() (int, error) { return migrateResults(ctx, myDB, pgDB) }},
-		{"intermediary", func() (int, error) { return migrateIntermediary(ctx, myDB, pgDB) }},
-	}
-
-	for _, s := range steps {
-		n, err := s.fn()
-		if err != nil {
-			log.Fatalf("migrate %s: %v", s.name, err)
+		for _, m := range applied {
+			log.Printf("applied schema migration %04d_%s", m.Version, m.Name)
 		}
-		log.Printf("%-15s  %d rows migrated", s.name, n)
 	}
 
-	resetSequences(ctx, pgDB)
-	log.Println("migration complete")
-}
-
-// --- helpers ---
-
-func nullInt(n sql.NullInt64) *int {
-	if !n.Valid {
-		return nil
+	if err := bindTables(ctx, pgDB, selected); err != nil {
+		log.Fatal(err)
 	}
-	v := int(n.Int64)
-	return &v
-}
 
-func nullStr(n sql.NullString) *string {
-	if !n.Valid {
-		return nil
+	// Disable FK enforcement so we can load in bulk without strict ordering;
+	// reportIntegrity lists anything that slipped through. The setting is
+	// applied per page transaction, so first check it is permitted.
+	opts.replica, err = canUseReplicaMode(ctx, pgDB)
+	if err != nil {
+		log.Fatalf("disable FK: %v", err)
+	}
+	if !opts.replica {
+		log.Println("disable FK skipped (insufficient privilege)")
 	}
-	return &n.String
-}
 
-func nullFloat(n sql.NullFloat64) *float64 {
-	if !n.Valid {
-		return nil
+	start := time.Now()
+	if err := copyLevels(ctx, myDB, pgDB, selected, opts); err != nil {
+		log.Fatalf("%v (rerun with -resume to continue)", err)
 	}
-	return &n.Float64
-}
+	log.Printf("tables copied in %s", time.Since(start).Round(time.Second))
 
-func fmtDate(t time.Time) string {
-	return t.Format("2006-01-02")
+	resetSequences(ctx, pgDB, selected)
+	reportIntegrity(ctx, pgDB)
+	log.Println("migration complete")
 }
 
-// bulkInsert inserts a batch, skipping rows that already exist (idempotent re-runs).
-func bulkInsert[T any](ctx context.Context, pgDB *bun.DB, rows []T) error {
-	if len(rows) == 0 {
-		return nil
+// copyTable copies one table page by page, checkpointing after each page.
+// Pages are streamed with COPY into a staging table and merged from there, on
+// one connection held for the whole table.
+func copyTable(ctx context.Context, myDB *sql.DB, pgDB *bun.DB, s tableSpec, opts options, p *tableProgress) error {
+	// Tables without a date filter are always copied in full.
+	since := opts.since
+	if s.since == "" {
+		since = nil
 	}
-	_, err := pgDB.NewInsert().Model(&rows).On("CONFLICT DO NOTHING").Exec(ctx)
-	return err
-}
-
-// --- per-table migrations ---
 
-func migrateUsers(ctx context.Context, myDB *sql.DB, pgDB *bun.DB) (int, error) {
-	rows, err := myDB.QueryContext(ctx, "SELECT id, username, password FROM users")
+	var after int64
+	cp, err := loadCheckpoint(ctx, pgDB, s.name)
 	if err != nil {
-		return 0, err
-	}
-	defer rows.Close()
-
-	var batch []models.User
-	total := 0
-	for rows.Next() {
-		var r models.User
-		if err := rows.Scan(&r.ID, &r.Username, &r.Password); err != nil {
-			return total, err
-		}
-		batch = append(batch, r)
-		if len(batch) >= batchSize {
-			if err := bulkInsert(ctx, pgDB, batch); err != nil {
-				return total, err
-			}
-			total += len(batch)
-			batch = batch[:0]
+		return err
+	}
+	switch {
+	case opts.resume && cp != nil && sameSince(cp.Since, since):
+		after = cp.LastKey
+		log.Printf("%-15s  resuming after %s %d (%d rows copied so far)", s.name, s.key, after, cp.RowsCopied)
+	case opts.resume && cp != nil:
+		log.Printf("%-15s  checkpoint was taken with a different -since; starting over", s.name)
+		fallthrough
+	default:
+		if err := startCheckpoint(ctx, pgDB, s.name, since); err != nil {
+			return err
 		}
 	}
-	if err := bulkInsert(ctx, pgDB, batch); err != nil {
-		return total, err
-	}
-	return total + len(batch), rows.Err()
-}
 
-func migrateCourses(ctx context.Context, myDB *sql.DB, pgDB *bun.DB) (int, error) {
-	rows, err := myDB.QueryContext(ctx,
-		"SELECT courseID, course, direction, isAw, code FROM courses")
+	conn, err := pgDB.Conn(ctx)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	defer rows.Close()
+	defer conn.Close()
 
-	var batch []models.Course
-	total := 0
-	for rows.Next() {
-		var r models.Course
-		if err := rows.Scan(&r.CourseID, &r.Course, &r.Direction, &r.IsAW, &r.Code); err != nil {
-			return total, err
+	merge := mergeSQL(s, opts.sync)
+	var page bytes.Buffer
+	for {
+		page.Reset()
+		n, w, last, err := copyPage(ctx, myDB, pgDB, conn, s, opts, merge, since, after, &page)
+		if err != nil {
+			return err
 		}
-		batch = append(batch, r)
-		if len(batch) >= batchSize {
-			if err := bulkInsert(ctx, pgDB, batch); err != nil {
-				return total, err
-			}
-			total += len(batch)
-			batch = batch[:0]
+		p.read.Add(int64(n))
+		p.written.Add(int64(w))
+		if n < opts.batch {
+			break
 		}
+		after = last
 	}
-	if err := bulkInsert(ctx, pgDB, batch); err != nil {
-		return total, err
-	}
-	return total + len(batch), rows.Err()
+	return completeCheckpoint(ctx, pgDB, s.name)
 }
 
-func migrateHorses(ctx context.Context, myDB *sql.DB, pgDB *bun.DB) (int, error) {
+// copyPage copies the next page of source rows after key and advances the
+// checkpoint in the same transaction. It returns the rows read from MySQL,
+// the rows inserted or updated in Postgres and the last key read.
+func copyPage(ctx context.Context, myDB *sql.DB, pgDB *bun.DB, conn bun.Conn, s tableSpec, opts options, merge string, since *string, after int64, page *bytes.Buffer) (read, written int, last int64, err error) {
+	where, args := s.key+" > ?", []interface{}{after}
+	if since != nil {
+		where += " AND " + s.since
+		args = append(args, *since)
+	}
 	rows, err := myDB.QueryContext(ctx,
-		`SELECT horseID, horse, lastWinID, highestWinWeight, lastWinWeight,
-		        lastRunWeight, lastWinClaim, lastRunClaim, highestWinOr
-		 FROM horses`)
+		fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY %s LIMIT %d", s.columns, s.source, where, s.key, opts.batch),
+		args...,
+	)
 	if err != nil {
-		return 0, err
-	}
-	defer rows.Close()
-
-	var batch []models.Horse
-	total := 0
-	for rows.Next() {
-		var (
-			horseID          int
-			horse            string
-			lastWinID        sql.NullInt64
-			highestWinWeight sql.NullInt64
-			lastWinWeight    sql.NullInt64
-			lastRunWeight    sql.NullInt64
-			lastWinClaim     sql.NullInt64
-			lastRunClaim     sql.NullInt64
-			highestWinOr     sql.NullInt64
-		)
-		if err := rows.Scan(&horseID, &horse, &lastWinID, &highestWinWeight, &lastWinWeight,
-			&lastRunWeight, &lastWinClaim, &lastRunClaim, &highestWinOr); err != nil {
-			return total, err
-		}
-		batch = append(batch, models.Horse{
-			HorseID:          horseID,
-			Horse:            horse,
-			LastWinID:        nullInt(lastWinID),
-			HighestWinWeight: nullInt(highestWinWeight),
-			LastWinWeight:    nullInt(lastWinWeight),
-			LastRunWeight:    nullInt(lastRunWeight),
-			LastWinClaim:     nullInt(lastWinClaim),
-			LastRunClaim:     nullInt(lastRunClaim),
-			HighestWinOr:     nullInt(highestWinOr),
-		})
-		if len(batch) >= batchSize {
-			if err := bulkInsert(ctx, pgDB, batch); err != nil {
-				return total, err
-			}
-			total += len(batch)
-			batch = batch[:0]
-		}
+		return 0, 0, 0, err
 	}
-	if err := bulkInsert(ctx, pgDB, batch); err != nil {
-		return total, err
+	read, last, err = s.encodePage(rows, page)
+	rows.Close()
+	if err != nil || read == 0 {
+		return 0, 0, 0, err
 	}
-	return total + len(batch), rows.Err()
-}
 
-func migrateTrainers(ctx context.Context, myDB *sql.DB, pgDB *bun.DB) (int, error) {
-	rows, err := myDB.QueryContext(ctx,
-		"SELECT trainerID, trainer, info FROM trainers")
+	tx, err := conn.BeginTx(ctx, nil)
 	if err != nil {
-		return 0, err
+		return 0, 0, 0, err
 	}
-	defer rows.Close()
-
-	var batch []models.Trainer
-	total := 0
-	for rows.Next() {
-		var (
-			trainerID int
-			trainer   string
-			info      sql.NullString
-		)
-		if err := rows.Scan(&trainerID, &trainer, &info); err != nil {
-			return total, err
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
 		}
-		batch = append(batch, models.Trainer{
-			TrainerID: trainerID,
-			Trainer:   trainer,
-			Info:      nullStr(info),
-		})
-		if len(batch) >= batchSize {
-			if err := bulkInsert(ctx, pgDB, batch); err != nil {
-				return total, err
-			}
-			total += len(batch)
-			batch = batch[:0]
+	}()
+
+	if opts.replica {
+		if _, err := tx.ExecContext(ctx, "SET LOCAL session_replication_role = 'replica'"); err != nil {
+			return 0, 0, 0, err
 		}
 	}
-	if err := bulkInsert(ctx, pgDB, batch); err != nil {
-		return total, err
+	if _, err := tx.ExecContext(ctx, createStageSQL(s)); err != nil {
+		return 0, 0, 0, err
 	}
-	return total + len(batch), rows.Err()
-}
-
-func migrateRaces(ctx context.Context, myDB *sql.DB, pgDB *bun.DB) (int, error) {
-	rows, err := myDB.QueryContext(ctx,
-		`SELECT raceID, courseID, date, time, url, class, distance, going,
-		        mr, mr2, analysed, preDone, mainComment, amended
-		 FROM races`)
-	if err != nil {
-		return 0, err
-	}
-	defer rows.Close()
-
-	var batch []models.Race
-	total := 0
-	for rows.Next() {
-		var (
-			raceID      int
-			courseID    int
-			date        time.Time
-			rtime       string
-			url         string
-			class       sql.NullString
-			distance    float64
-			going       string
-			mr          sql.NullInt64
-			mr2         sql.NullInt64
-			analysed    bool
-			preDone     bool
-			mainComment sql.NullString
-			amended     bool
-		)
-		if err := rows.Scan(&raceID, &courseID, &date, &rtime, &url, &class,
-			&distance, &going, &mr, &mr2, &analysed, &preDone, &mainComment, &amended); err != nil {
-			return total, err
-		}
-		batch = append(batch, models.Race{
-			RaceID:      raceID,
-			CourseID:    courseID,
-			Date:        fmtDate(date),
-			Time:        rtime,
-			URL:         url,
-			Class:       nullStr(class),
-			Distance:    distance,
-			Going:       going,
-			Mr:          nullInt(mr),
-			Mr2:         nullInt(mr2),
-			Analysed:    analysed,
-			PreDone:     preDone,
-			MainComment: nullStr(mainComment),
-			Amended:     amended,
-		})
-		if len(batch) >= batchSize {
-			if err := bulkInsert(ctx, pgDB, batch); err != nil {
-				return total, err
-			}
-			total += len(batch)
-			batch = batch[:0]
-		}
+	// COPY runs on the connection, inside the transaction begun on it.
+	if _, err := pgdriver.CopyFrom(ctx, conn, page, copyStageSQL(s)); err != nil {
+		return 0, 0, 0, err
 	}
-	if err := bulkInsert(ctx, pgDB, batch); err != nil {
-		return total, err
+	res, err := tx.ExecContext(ctx, merge)
+	if err != nil {
+		return 0, 0, 0, err
 	}
-	return total + len(batch), rows.Err()
-}
-
-func migratePreRace(ctx context.Context, myDB *sql.DB, pgDB *bun.DB) (int, error) {
-	rows, err := myDB.QueryContext(ctx,
-		`SELECT id, runners, course, courseID, date, time, raceID,
-		        direction, distance, class, url
-		 FROM preRace`)
+	n, err := res.RowsAffected()
 	if err != nil {
-		return 0, err
-	}
-	defer rows.Close()
-
-	var batch []models.PreRace
-	total := 0
-	for rows.Next() {
-		var (
-			id        int
-			runners   []byte
-			course    string
-			courseID  int
-			date      time.Time
-			rtime     string
-			raceID    int
-			direction string
-			distance  float64
-			class     string
-			url       string
-		)
-		if err := rows.Scan(&id, &runners, &course, &courseID, &date, &rtime,
-			&raceID, &direction, &distance, &class, &url); err != nil {
-			return total, err
-		}
-		batch = append(batch, models.PreRace{
-			ID:        id,
-			Runners:   json.RawMessage(runners),
-			Course:    course,
-			CourseID:  courseID,
-			Date:      fmtDate(date),
-			Time:      rtime,
-			RaceID:    raceID,
-			Direction: direction,
-			Distance:  distance,
-			Class:     class,
-			URL:       url,
-		})
-		if len(batch) >= batchSize {
-			if err := bulkInsert(ctx, pgDB, batch); err != nil {
-				return total, err
-			}
-			total += len(batch)
-			batch = batch[:0]
-		}
+		return 0, 0, 0, err
+	}
+	if err := advanceCheckpoint(ctx, tx, s.name, last, since, read); err != nil {
+		return 0, 0, 0, err
 	}
-	if err := bulkInsert(ctx, pgDB, batch); err != nil {
-		return total, err
+
+	if err = tx.Commit(); err != nil {
+		return 0, 0, 0, err
 	}
-	return total + len(batch), rows.Err()
+	committed = true
+	return read, int(n), last, nil
 }
 
-func migrateResults(ctx context.Context, myDB *sql.DB, pgDB *bun.DB) (int, error) {
-	rows, err := myDB.QueryContext(ctx,
-		`SELECT id, horseID, courseID, raceID, age, price, trainer, jockey, number,
-		        headgear, placed, pace, officialRat, winDist, distBehindWinner,
-		        weightCarried, cardWeight, claim, rpr, ts,
-		        mrPlusOr, mr2PlusOr, wCmr2PlusOr, wCmr1PlusOr, totRPR,
-		        tfr, tfsf, tfsfMinusOr, secT, speedPer, comment, analysed
-		 FROM results`)
+// canUseReplicaMode reports whether this role may set session_replication_role.
+func canUseReplicaMode(ctx context.Context, pgDB *bun.DB) (bool, error) {
+	tx, err := pgDB.BeginTx(ctx, nil)
 	if err != nil {
-		return 0, err
-	}
-	defer rows.Close()
-
-	var batch []models.Result
-	total := 0
-	for rows.Next() {
-		var (
-			id               int
-			horseID          int
-			courseID         int
-			raceID           int
-			age              int
-			price            string
-			trainer          string
-			jockey           string
-			number           int
-			headgear         sql.NullString
-			placed           string
-			pace             sql.NullString
-			officialRat      sql.NullInt64
-			winDist          sql.NullFloat64
-			distBehindWinner sql.NullFloat64
-			weightCarried    int
-			cardWeight       int
-			claim            sql.NullInt64
-			rpr              sql.NullInt64
-			ts               sql.NullInt64
-			mrPlusOr         sql.NullInt64
-			mr2PlusOr        sql.NullInt64
-			wCmr2PlusOr      sql.NullInt64
-			wCmr1PlusOr      sql.NullInt64
-			totRPR           sql.NullInt64
-			tfr              sql.NullString
-			tfsf             sql.NullInt64
-			tfsfMinusOr      sql.NullInt64
-			secT             sql.NullFloat64
-			speedPer         sql.NullFloat64
-			comment          sql.NullString
-			analysed         bool
-		)
-		if err := rows.Scan(
-			&id, &horseID, &courseID, &raceID, &age, &price, &trainer, &jockey, &number,
-			&headgear, &placed, &pace, &officialRat, &winDist, &distBehindWinner,
-			&weightCarried, &cardWeight, &claim, &rpr, &ts,
-			&mrPlusOr, &mr2PlusOr, &wCmr2PlusOr, &wCmr1PlusOr, &totRPR,
-			&tfr, &tfsf, &tfsfMinusOr, &secT, &speedPer, &comment, &analysed,
-		); err != nil {
-			return total, err
-		}
-		batch = append(batch, models.Result{
-			ID:               id,
-			HorseID:          horseID,
-			CourseID:         courseID,
-			RaceID:           raceID,
-			Age:              age,
-			Price:            price,
-			Trainer:          trainer,
-			Jockey:           jockey,
-			Number:           number,
-			Headgear:         nullStr(headgear),
-			Placed:           placed,
-			Pace:             nullStr(pace),
-			OfficialRat:      nullInt(officialRat),
-			WinDist:          nullFloat(winDist),
-			DistBehindWinner: nullFloat(distBehindWinner),
-			WeightCarried:    weightCarried,
-			CardWeight:       cardWeight,
-			Claim:            nullInt(claim),
-			RPR:              nullInt(rpr),
-			TS:               nullInt(ts),
-			MrPlusOr:         nullInt(mrPlusOr),
-			Mr2PlusOr:        nullInt(mr2PlusOr),
-			WCmr2PlusOr:      nullInt(wCmr2PlusOr),
-			WCmr1PlusOr:      nullInt(wCmr1PlusOr),
-			TotRPR:           nullInt(totRPR),
-			Tfr:              nullStr(tfr),
-			Tfsf:             nullInt(tfsf),
-			TfsfMinusOr:      nullInt(tfsfMinusOr),
-			SecT:             nullFloat(secT),
-			SpeedPer:         nullFloat(speedPer),
-			Comment:          nullStr(comment),
-			Analysed:         analysed,
-		})
-		if len(batch) >= batchSize {
-			if err := bulkInsert(ctx, pgDB, batch); err != nil {
-				return total, err
-			}
-			total += len(batch)
-			batch = batch[:0]
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.ExecContext(ctx, "SET LOCAL session_replication_role = 'replica'"); err != nil {
+		if isInsufficientPrivilege(err) {
+			return false, nil
 		}
+		return false, err
 	}
-	if err := bulkInsert(ctx, pgDB, batch); err != nil {
-		return total, err
+	return true, nil
+}
+
+func sameSince(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
 	}
-	return total + len(batch), rows.Err()
+	return *a == *b
 }
 
-func migrateIntermediary(ctx context.Context, myDB *sql.DB, pgDB *bun.DB) (int, error) {
-	rows, err := myDB.QueryContext(ctx,
-		"SELECT id, horseID, raceID, mrPlusOr, tfr FROM intermediary")
-	if err != nil {
-		return 0, err
-	}
-	defer rows.Close()
-
-	var batch []models.Intermediary
-	total := 0
-	for rows.Next() {
-		var (
-			id       int
-			horseID  int
-			raceID   int
-			mrPlusOr sql.NullInt64
-			tfr      sql.NullString
-		)
-		if err := rows.Scan(&id, &horseID, &raceID, &mrPlusOr, &tfr); err != nil {
-			return total, err
+// reportIntegrity logs rows that break foreign keys. Replica mode skips FK
+// checks during the load, so orphans in the source arrive unchecked.
+func reportIntegrity(ctx context.Context, pgDB *bun.DB) {
+	bad := 0
+	for _, ic := range bundb.IntegrityChecks {
+		n, err := ic.Count(ctx, pgDB)
+		if err != nil {
+			log.Printf("integrity %s: %v", ic.Name, err)
+			continue
 		}
-		batch = append(batch, models.Intermediary{
-			ID:       id,
-			HorseID:  horseID,
-			RaceID:   raceID,
-			MrPlusOr: nullInt(mrPlusOr),
-			Tfr:      nullStr(tfr),
-		})
-		if len(batch) >= batchSize {
-			if err := bulkInsert(ctx, pgDB, batch); err != nil {
-				return total, err
-			}
-			total += len(batch)
-			batch = batch[:0]
+		if n > 0 {
+			log.Printf("integrity %s: %d %s", ic.Name, n, ic.Description)
+			bad += n
 		}
 	}
-	if err := bulkInsert(ctx, pgDB, batch); err != nil {
-		return total, err
+	if bad > 0 {
+		log.Printf("%d rows break foreign keys; run dbcheck -repair -validate", bad)
 	}
-	return total + len(batch), rows.Err()
 }
 
-// resetSequences advances each PG sequence to MAX(id) so new inserts don't conflict.
-func resetSequences(ctx context.Context, pgDB *bun.DB) {
-	seqs := []struct{ seq, table, col string }{
-		{"users_id_seq", "users", "id"},
-		{"courses_course_id_seq", "courses", "course_id"},
-		{"horses_horse_id_seq", "horses", "horse_id"},
-		{"trainers_trainer_id_seq", "trainers", "trainer_id"},
-		{"races_race_id_seq", "races", "race_id"},
-		{"pre_race_id_seq", "pre_race", "id"},
-		{"results_id_seq", "results", "id"},
-		{"intermediary_id_seq", "intermediary", "id"},
-	}
-	for _, s := range seqs {
+// --- helpers ---
+
+func fmtDate(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+// resetSequences advances each table's key sequence to MAX(key) so new inserts
+// don't conflict. Keys without a sequence are left alone.
+func resetSequences(ctx context.Context, pgDB *bun.DB, specs []tableSpec) {
+	for _, s := range specs {
 		q := fmt.Sprintf(
-			"SELECT setval('%s', COALESCE((SELECT MAX(%s) FROM %s), 1))",
-			s.seq, s.col, s.table,
+			"SELECT setval(pg_get_serial_sequence('%s', '%s'), COALESCE((SELECT MAX(%[2]s) FROM %[1]s), 1))",
+			s.name, s.pgKey,
 		)
 		if _, err := pgDB.ExecContext(ctx, q); err != nil {
-			log.Printf("reset seq %s: %v", s.seq, err)
+			log.Printf("reset seq %s.%s: %v", s.name, s.pgKey, err)
 		}
 	}
 	log.Println("sequences reset")
@@ -603,26 +376,15 @@ func isInsufficientPrivilege(err error) bool {
 	return strings.Contains(strings.ToLower(err.Error()), "permission denied")
 }
 
-func missingTables(ctx context.Context, pgDB *bun.DB) ([]string, error) {
-	required := []string{
-		"users",
-		"courses",
-		"horses",
-		"trainers",
-		"races",
-		"pre_race",
-		"results",
-		"intermediary",
-	}
-
-	missing := make([]string, 0, len(required))
-	for _, table := range required {
+func missingTables(ctx context.Context, pgDB *bun.DB, specs []tableSpec) ([]string, error) {
+	missing := make([]string, 0, len(specs))
+	for _, s := range specs {
 		var reg sql.NullString
-		if err := pgDB.NewRaw(`SELECT to_regclass(?)`, "public."+table).Scan(ctx, &reg); err != nil {
+		if err := pgDB.NewRaw(`SELECT to_regclass(?)`, "public."+s.name).Scan(ctx, &reg); err != nil {
 			return nil, err
 		}
 		if !reg.Valid || reg.String == "" {
-			missing = append(missing, table)
+			missing = append(missing, s.name)
 		}
 	}
 	return missing, nil
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// defaultMapping describes how each MySQL table is copied. Pass -mapping to
+// use another file with the same layout.
+//
+//go:embed mapping.json
+var defaultMapping []byte
+
+// mapping is the layout of mapping.json.
+type mapping struct {
+	Tables []tableMapping `json:"tables"`
+}
+
+// tableMapping maps one MySQL table onto one Postgres table.
+type tableMapping struct {
+	Name   string `json:"name"`   // Postgres table, also the checkpoint key
+	Source string `json:"source"` // MySQL table
+	Key    string `json:"key"`    // MySQL integer primary key, used for keyset paging
+	PGKey  string `json:"pgKey"`  // Postgres primary key; one column must target it
+	// Level orders the load: tables on the same level do not reference each
+	// other and are copied in parallel once every lower level has finished.
+	Level     int  `json:"level"`
+	Versioned bool `json:"versioned"` // bump the version column when -sync changes a row
+	// Since and PGSince restrict rows for -since in MySQL and in Postgres, where
+	// the table is aliased t. Each takes the date as its only argument.
+	Since   string          `json:"since"`
+	PGSince string          `json:"pgSince"`
+	Columns []columnMapping `json:"columns"`
+}
+
+// columnMapping maps one MySQL column or expression onto one Postgres column.
+type columnMapping struct {
+	Source    string   `json:"source"`
+	Target    string   `json:"target"`
+	Transform []string `json:"transform"` // applied in order, see transforms
+	// Null says what a NULL becomes after transforms: "keep" (the default)
+	// writes NULL, "default" writes the column default and "error" fails the page.
+	Null string `json:"null"`
+}
+
+// transforms are the named conversions a column mapping can apply to a
+// source value before it is written.
+var transforms = map[string]func(v interface{}) (interface{}, error){
+	// date reduces a DATE or DATETIME to YYYY-MM-DD.
+	"date": func(v interface{}) (interface{}, error) {
+		switch x := v.(type) {
+		case time.Time:
+			return fmtDate(x), nil
+		case nil:
+			return nil, nil
+		}
+		s, _ := asString(v)
+		if len(s) < 10 {
+			return nil, fmt.Errorf("date: %q is not a date", s)
+		}
+		if _, err := time.Parse(time.DateOnly, s[:10]); err != nil {
+			return nil, fmt.Errorf("date: %w", err)
+		}
+		return s[:10], nil
+	},
+	// json checks the value is a JSON document; empty values become NULL.
+	"json": func(v interface{}) (interface{}, error) {
+		s, ok := asString(v)
+		if !ok || strings.TrimSpace(s) == "" {
+			return nil, nil
+		}
+		if !json.Valid([]byte(s)) {
+			return nil, errors.New("json: invalid JSON document")
+		}
+		return s, nil
+	},
+	// trim removes surrounding whitespace from text.
+	"trim": func(v interface{}) (interface{}, error) {
+		if s, ok := asString(v); ok {
+			return strings.TrimSpace(s), nil
+		}
+		return v, nil
+	},
+	// emptyNull turns empty text into NULL.
+	"emptyNull": func(v interface{}) (interface{}, error) {
+		if s, ok := asString(v); ok && s == "" {
+			return nil, nil
+		}
+		return v, nil
+	},
+	// zeroNull turns a numeric zero into NULL.
+	"zeroNull": func(v interface{}) (interface{}, error) {
+		switch x := v.(type) {
+		case int64:
+			if x == 0 {
+				return nil, nil
+			}
+		case float64:
+			if x == 0 {
+				return nil, nil
+			}
+		case []byte:
+			if f, err := strconv.ParseFloat(string(x), 64); err == nil && f == 0 {
+				return nil, nil
+			}
+		}
+		return v, nil
+	},
+}
+
+func asString(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case []byte:
+		return string(x), true
+	case string:
+		return x, true
+	}
+	return "", false
+}
+
+// loadMapping reads the mapping file at path, or the embedded one if path is empty.
+func loadMapping(path string) (*mapping, error) {
+	data := defaultMapping
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var m mapping
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("mapping: %w", err)
+	}
+	return &m, nil
+}
+
+// compile validates the mapping and turns each table into a tableSpec.
+func (m *mapping) compile() ([]tableSpec, error) {
+	if len(m.Tables) == 0 {
+		return nil, errors.New("mapping: no tables")
+	}
+	seen := map[string]bool{}
+	specs := make([]tableSpec, 0, len(m.Tables))
+	for _, t := range m.Tables {
+		if t.Name == "" || t.Source == "" || t.Key == "" || t.PGKey == "" {
+			return nil, fmt.Errorf("mapping: table %q needs name, source, key and pgKey", t.Name)
+		}
+		if seen[t.Name] {
+			return nil, fmt.Errorf("mapping: table %q listed twice", t.Name)
+		}
+		seen[t.Name] = true
+		if t.Level < 0 {
+			return nil, fmt.Errorf("mapping: table %s: level must not be negative", t.Name)
+		}
+		if (t.Since == "") != (t.PGSince == "") {
+			return nil, fmt.Errorf("mapping: table %s: since and pgSince go together", t.Name)
+		}
+
+		s := tableSpec{
+			name: t.Name, source: t.Source, key: t.Key, pgKey: t.PGKey,
+			since: t.Since, pgSince: t.PGSince,
+			versioned: t.Versioned, level: t.Level,
+			keyIndex: -1,
+		}
+		targets := map[string]bool{}
+		sources := make([]string, len(t.Columns))
+		for i, c := range t.Columns {
+			if c.Source == "" || c.Target == "" {
+				return nil, fmt.Errorf("mapping: table %s: column %d needs source and target", t.Name, i+1)
+			}
+			if targets[c.Target] {
+				return nil, fmt.Errorf("mapping: table %s: column %s mapped twice", t.Name, c.Target)
+			}
+			targets[c.Target] = true
+
+			col := columnSpec{source: c.Source, target: c.Target, null: c.Null}
+			switch c.Null {
+			case "":
+				col.null = "keep"
+			case "keep", "default", "error":
+			default:
+				return nil, fmt.Errorf("mapping: %s.%s: null must be keep, default or error", t.Name, c.Target)
+			}
+			for _, name := range c.Transform {
+				fn, ok := transforms[name]
+				if !ok {
+					return nil, fmt.Errorf("mapping: %s.%s: unknown transform %q", t.Name, c.Target, name)
+				}
+				col.transforms = append(col.transforms, fn)
+			}
+			if c.Target == t.PGKey {
+				s.keyIndex = i
+			} else {
+				s.updates = append(s.updates, c.Target)
+			}
+			s.cols = append(s.cols, col)
+			sources[i] = c.Source
+		}
+		if s.keyIndex < 0 {
+			return nil, fmt.Errorf("mapping: table %s: no column targets pgKey %s", t.Name, t.PGKey)
+		}
+		s.columns = strings.Join(sources, ", ")
+		specs = append(specs, s)
+	}
+	return specs, nil
+}
+
+// bindTables looks up each target column's type and default, so values can be
+// rendered for Postgres, and fails early on columns that do not exist.
+func bindTables(ctx context.Context, pgDB *bun.DB, specs []tableSpec) error {
+	for _, s := range specs {
+		var cols []struct {
+			Name    string  `bun:"column_name"`
+			Type    string  `bun:"data_type"`
+			Default *string `bun:"column_default"`
+		}
+		err := pgDB.NewRaw(`
+			SELECT column_name, data_type, column_default
+			FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = ?`, s.name,
+		).Scan(ctx, &cols)
+		if err != nil {
+			return fmt.Errorf("describe %s: %w", s.name, err)
+		}
+		if len(cols) == 0 {
+			return fmt.Errorf("table %s does not exist", s.name)
+		}
+
+		for i := range s.cols {
+			c := &s.cols[i]
+			found := false
+			for _, pc := range cols {
+				if pc.Name == c.target {
+					c.pgType, c.pgDefault, found = pc.Type, pc.Default, true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("mapping: %s.%s: no such column", s.name, c.target)
+			}
+			if c.null != "default" {
+				continue
+			}
+			if c.pgDefault == nil {
+				return fmt.Errorf("mapping: %s.%s: null is default but the column has none", s.name, c.target)
+			}
+			if err := pgDB.NewRaw(fmt.Sprintf("SELECT (%s)::text", *c.pgDefault)).Scan(ctx, &c.defaultText); err != nil {
+				return fmt.Errorf("evaluate default of %s.%s: %w", s.name, c.target, err)
+			}
+		}
+		if s.versioned {
+			found := false
+			for _, pc := range cols {
+				found = found || pc.Name == "version"
+			}
+			if !found {
+				return fmt.Errorf("mapping: %s is versioned but has no version column", s.name)
+			}
+		}
+	}
+	return nil
+}
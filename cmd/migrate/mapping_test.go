@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransforms(t *testing.T) {
+	tests := []struct {
+		transform string
+		in, want  interface{}
+		err       string
+	}{
+		{"date", time.Date(2024, 3, 6, 13, 30, 0, 0, time.UTC), "2024-03-06", ""},
+		{"date", []byte("2024-03-06 13:30:00"), "2024-03-06", ""},
+		{"date", "2024-03-06", "2024-03-06", ""},
+		{"date", nil, nil, ""},
+		{"date", []byte("2024-3-6"), nil, "not a date"},
+		{"date", []byte("2024-02-30 00:00"), nil, "date:"},
+
+		{"json", []byte(`{"a": 1}`), `{"a": 1}`, ""},
+		{"json", []byte("  "), nil, ""},
+		{"json", nil, nil, ""},
+		{"json", []byte(`{"a":`), nil, "invalid JSON"},
+
+		{"trim", []byte("  Frankel \t"), "Frankel", ""},
+		{"trim", int64(3), int64(3), ""},
+		{"trim", nil, nil, ""},
+
+		{"emptyNull", []byte(""), nil, ""},
+		{"emptyNull", "", nil, ""},
+		{"emptyNull", []byte(" "), []byte(" "), ""},
+		{"emptyNull", int64(0), int64(0), ""},
+
+		{"zeroNull", int64(0), nil, ""},
+		{"zeroNull", float64(0), nil, ""},
+		{"zeroNull", []byte("0.00"), nil, ""},
+		{"zeroNull", int64(7), int64(7), ""},
+		{"zeroNull", []byte("0.5"), []byte("0.5"), ""},
+		{"zeroNull", []byte("n/a"), []byte("n/a"), ""},
+	}
+	for _, tt := range tests {
+		got, err := transforms[tt.transform](tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s(%v) error = %v, want %q", tt.transform, tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s(%v): %v", tt.transform, tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s(%#v) = %#v, want %#v", tt.transform, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultMappingCompiles(t *testing.T) {
+	m, err := loadMapping("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	specs, err := m.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != len(m.Tables) {
+		t.Fatalf("compiled %d of %d tables", len(specs), len(m.Tables))
+	}
+	for _, s := range specs {
+		if s.cols[s.keyIndex].target != s.pgKey {
+			t.Errorf("%s: key column targets %s, want %s", s.name, s.cols[s.keyIndex].target, s.pgKey)
+		}
+		for _, c := range s.cols {
+			if c.null != "keep" && c.null != "default" && c.null != "error" {
+				t.Errorf("%s.%s: null mode %q", s.name, c.target, c.null)
+			}
+		}
+	}
+	// Referenced tables load on a lower level than the tables referencing them.
+	levels := map[string]int{}
+	for _, s := range specs {
+		levels[s.name] = s.level
+	}
+	for _, pair := range [][2]string{{"courses", "races"}, {"races", "pre_race"}, {"races", "results"}, {"horses", "results"}} {
+		if levels[pair[0]] >= levels[pair[1]] {
+			t.Errorf("%s (level %d) does not load before %s (level %d)", pair[0], levels[pair[0]], pair[1], levels[pair[1]])
+		}
+	}
+}
+
+func TestLoadMappingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mapping.json")
+	if err := os.WriteFile(path, []byte(`{"tables": [], "extra": 1}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadMapping(path); err == nil || !strings.Contains(err.Error(), "unknown field") {
+		t.Errorf("loadMapping accepted an unknown field: %v", err)
+	}
+	if _, err := loadMapping(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("loadMapping accepted a missing file")
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	table := func(edit func(*tableMapping)) mapping {
+		tm := tableMapping{
+			Name: "horses", Source: "horses", Key: "horseID", PGKey: "horse_id",
+			Columns: []columnMapping{
+				{Source: "horseID", Target: "horse_id"},
+				{Source: "horse", Target: "horse", Null: "error"},
+			},
+		}
+		edit(&tm)
+		return mapping{Tables: []tableMapping{tm}}
+	}
+	tests := []struct {
+		name string
+		m    mapping
+		want string
+	}{
+		{"no tables", mapping{}, "no tables"},
+		{"missing key", table(func(tm *tableMapping) { tm.Key = "" }), "needs name, source, key and pgKey"},
+		{"listed twice", mapping{Tables: append(table(func(*tableMapping) {}).Tables, table(func(*tableMapping) {}).Tables...)}, "listed twice"},
+		{"negative level", table(func(tm *tableMapping) { tm.Level = -1 }), "level must not be negative"},
+		{"since alone", table(func(tm *tableMapping) { tm.Since = "date >= ?" }), "since and pgSince go together"},
+		{"column without target", table(func(tm *tableMapping) { tm.Columns[1].Target = "" }), "column 2 needs source and target"},
+		{"target twice", table(func(tm *tableMapping) { tm.Columns[1].Target = "horse_id" }), "column horse_id mapped twice"},
+		{"bad null mode", table(func(tm *tableMapping) { tm.Columns[1].Null = "skip" }), "null must be keep, default or error"},
+		{"unknown transform", table(func(tm *tableMapping) { tm.Columns[1].Transform = []string{"upper"} }), `unknown transform "upper"`},
+		{"no key column", table(func(tm *tableMapping) { tm.PGKey = "id" }), "no column targets pgKey id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.m.compile()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("compile = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+
+	m := table(func(tm *tableMapping) { tm.Columns[1].Transform = []string{"trim", "emptyNull"} })
+	specs, err := m.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := specs[0]
+	if s.cols[0].null != "keep" || len(s.cols[1].transforms) != 2 || s.columns != "horseID, horse" ||
+		!reflect.DeepEqual(s.updates, []string{"horse"}) || s.keyIndex != 0 {
+		t.Errorf("compiled spec = %+v", s)
+	}
+}
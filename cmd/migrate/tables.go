@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// tableSpec is a table mapping compiled for the copy engine. Source rows are
+// read in pages ordered by an integer primary key so a run can stop and
+// resume from the last key copied.
+type tableSpec struct {
+	name    string // Postgres table, also the checkpoint key
+	source  string // MySQL table
+	key     string // MySQL integer primary key, used for keyset paging
+	columns string // MySQL select list, in cols order
+	// since restricts source rows for --since and takes the date as its only
+	// argument; pgSince is the same filter on the Postgres table, aliased t.
+	// Tables without one are always copied in full.
+	since   string
+	pgSince string
+	// pgKey is the Postgres primary key, the conflict target for --sync upserts;
+	// updates are the columns a --sync upsert overwrites.
+	pgKey     string
+	updates   []string
+	versioned bool // the table has a version column to bump when a row changes
+	// level orders the load: tables on the same level do not reference each
+	// other and are copied in parallel once every lower level has finished.
+	level int
+
+	cols     []columnSpec
+	keyIndex int // the column that targets pgKey
+}
+
+// columnSpec is one compiled column mapping. pgType and pgDefault are filled
+// in from information_schema by bindTables, and for null "default" columns
+// defaultText is pgDefault evaluated as text, for -verify.
+type columnSpec struct {
+	source     string
+	target     string
+	transforms []func(interface{}) (interface{}, error)
+	null       string // keep, default or error
+
+	pgType      string
+	pgDefault   *string
+	defaultText *string
+}
+
+// pgColumns are the Postgres columns the migration writes, in cols order.
+// Other columns keep their defaults.
+func (s tableSpec) pgColumns() []string {
+	out := make([]string, len(s.cols))
+	for i, c := range s.cols {
+		out[i] = c.target
+	}
+	return out
+}
+
+// scanRow reads one MySQL row and renders each column as Postgres text input,
+// nil for NULL, after the column's transforms and null handling.
+func (s tableSpec) scanRow(rows *sql.Rows) ([]*string, int64, error) {
+	vals := make([]interface{}, len(s.cols))
+	ptrs := make([]interface{}, len(s.cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		return nil, 0, err
+	}
+
+	out := make([]*string, len(s.cols))
+	for i, c := range s.cols {
+		v := vals[i]
+		for _, fn := range c.transforms {
+			var err error
+			if v, err = fn(v); err != nil {
+				return nil, 0, fmt.Errorf("%s.%s: %w", s.source, c.source, err)
+			}
+		}
+		if v == nil && c.null == "error" {
+			key := "NULL"
+			if k := render(vals[s.keyIndex], ""); k != nil {
+				key = *k
+			}
+			return nil, 0, fmt.Errorf("%s.%s is NULL where %s = %s", s.source, c.source, s.key, key)
+		}
+		out[i] = render(v, c.pgType)
+	}
+
+	key := out[s.keyIndex]
+	if key == nil {
+		return nil, 0, fmt.Errorf("%s.%s is NULL", s.source, s.key)
+	}
+	k, err := strconv.ParseInt(*key, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s.%s: %w", s.source, s.key, err)
+	}
+	return out, k, nil
+}
+
+// render formats a MySQL driver value as Postgres text input for pgType.
+func render(v interface{}, pgType string) *string {
+	var s string
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case time.Time:
+		if pgType == "date" {
+			s = fmtDate(x)
+		} else {
+			s = x.Format(time.RFC3339Nano)
+		}
+	case []byte:
+		s = string(x)
+	case string:
+		s = x
+	case bool:
+		s = strconv.FormatBool(x)
+	case int64:
+		if pgType == "boolean" {
+			s = strconv.FormatBool(x != 0)
+		} else {
+			s = strconv.FormatInt(x, 10)
+		}
+	case float32:
+		s = strconv.FormatFloat(float64(x), 'g', -1, 32)
+	case float64:
+		s = strconv.FormatFloat(x, 'g', -1, 64)
+	default:
+		s = fmt.Sprint(x)
+	}
+	if pgType == "boolean" {
+		// tinyint(1) columns read as text in the text protocol.
+		switch s {
+		case "0":
+			s = "false"
+		case "1":
+			s = "true"
+		}
+	}
+	return &s
+}
+
+// encodePage writes the scanned rows in COPY text format, one line per row
+// in pgColumns order, and reports how many were read and the last key.
+func (s tableSpec) encodePage(rows *sql.Rows, w io.Writer) (n int, last int64, err error) {
+	var line []byte
+	for rows.Next() {
+		vals, key, err := s.scanRow(rows)
+		if err != nil {
+			return 0, 0, err
+		}
+		line = appendCopyRow(line[:0], vals)
+		if _, err := w.Write(line); err != nil {
+			return 0, 0, err
+		}
+		n++
+		last = key
+	}
+	return n, last, rows.Err()
+}
+
+// readRange returns the rows with keys in [lo, hi) from both databases,
+// normalised for comparison by -verify.
+func (s tableSpec) readRange(ctx context.Context, myDB *sql.DB, pgDB *bun.DB, since *string, lo, hi int64) (src, dst []normRow, err error) {
+	where, args := fmt.Sprintf("%s >= ? AND %[1]s < ?", s.key), []interface{}{lo, hi}
+	if since != nil {
+		where += " AND " + s.since
+		args = append(args, *since)
+	}
+	rows, err := myDB.QueryContext(ctx,
+		fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY %s", s.columns, s.source, where, s.key), args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		vals, key, err := s.scanRow(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		src = append(src, s.normaliseSource(key, vals))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	where, args = fmt.Sprintf(`t."%s" >= ? AND t."%[1]s" < ?`, s.pgKey), []interface{}{lo, hi}
+	if since != nil {
+		where += " AND " + s.pgSince
+		args = append(args, *since)
+	}
+	pgRows, err := pgDB.QueryContext(ctx,
+		fmt.Sprintf(`SELECT %s FROM %s AS t WHERE %s ORDER BY t."%s"`, identList(s.pgColumns()), s.name, where, s.pgKey), args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer pgRows.Close()
+	for pgRows.Next() {
+		cells := make([]sql.NullString, len(s.cols))
+		ptrs := make([]interface{}, len(cells))
+		for i := range cells {
+			ptrs[i] = &cells[i]
+		}
+		if err := pgRows.Scan(ptrs...); err != nil {
+			return nil, nil, err
+		}
+		vals := make([]*string, len(cells))
+		for i, c := range cells {
+			if c.Valid {
+				vals[i] = &c.String
+			}
+		}
+		key, err := strconv.ParseInt(*vals[s.keyIndex], 10, 64)
+		if err != nil {
+			return nil, nil, err
+		}
+		dst = append(dst, s.normalise(key, vals))
+	}
+	return src, dst, pgRows.Err()
+}
+
+// targetStats returns the Postgres row count and key bounds.
+func (s tableSpec) targetStats(ctx context.Context, pgDB *bun.DB, since *string) (keyStats, error) {
+	var st keyStats
+	where, args := "TRUE", []interface{}{}
+	if since != nil {
+		where, args = s.pgSince, append(args, *since)
+	}
+	err := pgDB.QueryRowContext(ctx,
+		fmt.Sprintf(`SELECT count(*), COALESCE(min(t."%s"), 0), COALESCE(max(t."%[1]s"), 0) FROM %s AS t WHERE %s`, s.pgKey, s.name, where),
+		args...,
+	).Scan(&st.Count, &st.Min, &st.Max)
+	return st, err
+}
+
+// selectTables returns the specs named in a -tables list, in mapping order.
+func selectTables(specs []tableSpec, list string) ([]tableSpec, error) {
+	if list == "" {
+		return specs, nil
+	}
+	want := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		want[strings.TrimSpace(name)] = true
+	}
+	var out []tableSpec
+	for _, s := range specs {
+		if want[s.name] {
+			out = append(out, s)
+			delete(want, s.name)
+		}
+	}
+	for name := range want {
+		return nil, fmt.Errorf("unknown table %q in -tables: want %s", name, tableNames(specs))
+	}
+	return out, nil
+}
+
+func tableNames(specs []tableSpec) string {
+	names := make([]string, len(specs))
+	for i, s := range specs {
+		names[i] = s.name
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// rowsDriver serves one fixed result set for every query, so scanRow and
+// encodePage can run against *sql.Rows without MySQL.
+type rowsDriver struct{ rows [][]driver.Value }
+
+func (d *rowsDriver) Open(string) (driver.Conn, error) { return rowsConn{d}, nil }
+
+type rowsConn struct{ d *rowsDriver }
+
+func (c rowsConn) Prepare(string) (driver.Stmt, error) { return rowsStmt(c), nil }
+func (rowsConn) Close() error                          { return nil }
+func (rowsConn) Begin() (driver.Tx, error)             { return nil, errors.New("no transactions") }
+
+type rowsStmt struct{ d *rowsDriver }
+
+func (rowsStmt) Close() error                               { return nil }
+func (rowsStmt) NumInput() int                              { return -1 }
+func (rowsStmt) Exec([]driver.Value) (driver.Result, error) { return nil, errors.New("read only") }
+func (s rowsStmt) Query([]driver.Value) (driver.Rows, error) {
+	return &fixedRows{rows: s.d.rows}, nil
+}
+
+type fixedRows struct {
+	rows [][]driver.Value
+	i    int
+}
+
+func (r *fixedRows) Columns() []string {
+	cols := make([]string, len(r.rows[0]))
+	for i := range cols {
+		cols[i] = string(rune('a' + i))
+	}
+	return cols
+}
+func (r *fixedRows) Close() error { return nil }
+func (r *fixedRows) Next(dest []driver.Value) error {
+	if r.i == len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.i])
+	r.i++
+	return nil
+}
+
+// queryRows returns rows as MySQL would hand them to scanRow.
+func queryRows(t *testing.T, rows ...[]driver.Value) *sql.Rows {
+	t.Helper()
+	db := sql.OpenDB(connector{&rowsDriver{rows}})
+	t.Cleanup(func() { db.Close() })
+	rs, err := db.Query("SELECT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rs.Close() })
+	return rs
+}
+
+type connector struct{ d *rowsDriver }
+
+func (c connector) Connect(context.Context) (driver.Conn, error) { return c.d.Open("") }
+func (c connector) Driver() driver.Driver                        { return c.d }
+
+func scanSpec(t *testing.T) tableSpec {
+	t.Helper()
+	m := mapping{Tables: []tableMapping{{
+		Name: "horses", Source: "horses", Key: "horseID", PGKey: "horse_id",
+		Columns: []columnMapping{
+			{Source: "horseID", Target: "horse_id"},
+			{Source: "horse", Target: "horse", Transform: []string{"trim", "emptyNull"}, Null: "error"},
+			{Source: "weight", Target: "highest_win_weight", Transform: []string{"zeroNull"}, Null: "default"},
+			{Source: "analysed", Target: "analysed", Null: "default"},
+			{Source: "rating", Target: "rating"},
+		},
+	}}}
+	specs, err := m.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := specs[0]
+	for i, typ := range []string{"integer", "character varying", "integer", "boolean", "real"} {
+		s.cols[i].pgType = typ
+	}
+	return s
+}
+
+func TestScanRowNullModes(t *testing.T) {
+	s := scanSpec(t)
+	rows := queryRows(t,
+		[]driver.Value{int64(7), []byte(" Frankel "), int64(0), []byte("1"), nil},
+		[]driver.Value{int64(8), []byte("Dubawi"), []byte("130"), nil, float64(98.5)},
+		[]driver.Value{int64(9), []byte("  "), int64(130), int64(0), nil},
+	)
+
+	want := [][]*string{
+		// zeroNull makes the weight NULL; default leaves it for mergeSQL.
+		{str("7"), str("Frankel"), nil, str("true"), nil},
+		{str("8"), str("Dubawi"), str("130"), nil, str("98.5")},
+	}
+	for i, w := range want {
+		if !rows.Next() {
+			t.Fatalf("row %d missing", i)
+		}
+		vals, key, err := s.scanRow(rows)
+		if err != nil {
+			t.Fatalf("row %d: %v", i, err)
+		}
+		if key != int64(7+i) {
+			t.Errorf("row %d key = %d", i, key)
+		}
+		for j := range w {
+			if !sameValue(vals[j], w[j]) {
+				t.Errorf("row %d %s = %v, want %v", i, s.cols[j].target, deref(vals[j]), deref(w[j]))
+			}
+		}
+	}
+
+	// A blank name trims to empty, becomes NULL and fails the error column.
+	rows.Next()
+	_, _, err := s.scanRow(rows)
+	if err == nil || err.Error() != "horses.horse is NULL where horseID = 9" {
+		t.Errorf("scanRow = %v, want the NULL horse reported with its key", err)
+	}
+}
+
+func TestEncodePage(t *testing.T) {
+	s := scanSpec(t)
+	rows := queryRows(t,
+		[]driver.Value{int64(1), []byte("Tab\tHorse"), nil, int64(1), nil},
+		[]driver.Value{int64(5), []byte(`Back\slash`), int64(60), int64(0), float64(1)},
+	)
+	var b strings.Builder
+	n, last, err := s.encodePage(rows, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "1\tTab\\tHorse\t\\N\ttrue\t\\N\n" + "5\tBack\\\\slash\t60\tfalse\t1\n"
+	if n != 2 || last != 5 || b.String() != want {
+		t.Errorf("encodePage = %d rows, last %d:\n%q\nwant\n%q", n, last, b.String(), want)
+	}
+
+	// A transform error fails the page and names the source column.
+	s.cols[1].transforms = append(s.cols[1].transforms, transforms["json"])
+	rows = queryRows(t, []driver.Value{int64(1), []byte("not json"), nil, nil, nil})
+	if _, _, err := s.encodePage(rows, io.Discard); err == nil || !strings.Contains(err.Error(), "horses.horse: json") {
+		t.Errorf("encodePage = %v, want the json error for horses.horse", err)
+	}
+}
+
+func deref(v *string) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
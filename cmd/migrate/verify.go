@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"strconv"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// normRow is one row reduced to comparable strings, in pgColumns order.
+// A nil value is SQL NULL.
+type normRow struct {
+	key  int64
+	vals []*string
+}
+
+// keyStats are a table's row count and primary key bounds.
+type keyStats struct {
+	Count int64
+	Min   int64
+	Max   int64
+}
+
+// verifyReport is the JSON document -verify prints to stdout.
+type verifyReport struct {
+	OK     bool          `json:"ok"`
+	Since  *string       `json:"since,omitempty"`
+	Tables []tableReport `json:"tables"`
+}
+
+type tableReport struct {
+	Table         string        `json:"table"`
+	OK            bool          `json:"ok"`
+	SourceRows    int64         `json:"sourceRows"`
+	TargetRows    int64         `json:"targetRows"`
+	CountMatch    bool          `json:"countMatch"`
+	RangesChecked int           `json:"rangesChecked"`
+	Ranges        []rangeReport `json:"ranges"`  // mismatched ranges only
+	Samples       []sampleDiff  `json:"samples"` // up to -verify-samples rows
+	Error         string        `json:"error,omitempty"`
+}
+
+// rangeReport describes a primary key range [From, To) whose checksums differ.
+type rangeReport struct {
+	From       int64    `json:"from"`
+	To         int64    `json:"to"`
+	SourceRows int      `json:"sourceRows"`
+	TargetRows int      `json:"targetRows"`
+	Columns    []string `json:"columns"` // columns whose checksum differs
+}
+
+// sampleDiff is one row that is missing from Postgres, only in Postgres, or
+// different between the two.
+type sampleDiff struct {
+	Key     int64                  `json:"key"`
+	Kind    string                 `json:"kind"` // missing, extra or changed
+	Columns map[string]columnValue `json:"columns,omitempty"`
+}
+
+type columnValue struct {
+	Source *string `json:"source"`
+	Target *string `json:"target"`
+}
+
+// verifyTables compares each table in MySQL and Postgres and returns a report.
+// Rows are compared by primary key range: first by count and a checksum per
+// column, then row by row within ranges that differ to collect samples.
+func verifyTables(ctx context.Context, myDB *sql.DB, pgDB *bun.DB, specs []tableSpec, since *string, rangeSize int64, samples int) verifyReport {
+	report := verifyReport{OK: true, Since: since, Tables: []tableReport{}}
+	for _, s := range specs {
+		tr := verifyTable(ctx, myDB, pgDB, s, since, rangeSize, samples)
+		report.OK = report.OK && tr.OK
+		report.Tables = append(report.Tables, tr)
+	}
+	return report
+}
+
+func verifyTable(ctx context.Context, myDB *sql.DB, pgDB *bun.DB, s tableSpec, since *string, rangeSize int64, samples int) tableReport {
+	tr := tableReport{Table: s.name, Ranges: []rangeReport{}, Samples: []sampleDiff{}}
+	if s.since == "" {
+		since = nil
+	}
+
+	src, err := sourceStats(ctx, myDB, s, since)
+	if err != nil {
+		tr.Error = fmt.Sprintf("source stats: %v", err)
+		return tr
+	}
+	dst, err := s.targetStats(ctx, pgDB, since)
+	if err != nil {
+		tr.Error = fmt.Sprintf("target stats: %v", err)
+		return tr
+	}
+	tr.SourceRows, tr.TargetRows = src.Count, dst.Count
+	tr.CountMatch = src.Count == dst.Count
+
+	if src.Count > 0 || dst.Count > 0 {
+		lo, hi := src.Min, src.Max
+		if src.Count == 0 || (dst.Count > 0 && dst.Min < lo) {
+			lo = dst.Min
+		}
+		if src.Count == 0 || (dst.Count > 0 && dst.Max > hi) {
+			hi = dst.Max
+		}
+		cols := s.pgColumns()
+		for from := lo; from <= hi; from += rangeSize {
+			to := from + rangeSize
+			srcRows, dstRows, err := s.readRange(ctx, myDB, pgDB, since, from, to)
+			if err != nil {
+				tr.Error = fmt.Sprintf("range %d-%d: %v", from, to, err)
+				return tr
+			}
+			tr.RangesChecked++
+
+			differ := checksumDiff(cols, srcRows, dstRows)
+			if len(differ) == 0 && len(srcRows) == len(dstRows) {
+				continue
+			}
+			tr.Ranges = append(tr.Ranges, rangeReport{
+				From: from, To: to,
+				SourceRows: len(srcRows), TargetRows: len(dstRows),
+				Columns: differ,
+			})
+			if room := samples - len(tr.Samples); room > 0 {
+				tr.Samples = append(tr.Samples, rowDiffs(cols, srcRows, dstRows, room)...)
+			}
+		}
+	}
+
+	tr.OK = tr.Error == "" && tr.CountMatch && len(tr.Ranges) == 0
+	return tr
+}
+
+// sourceStats returns the MySQL row count and key bounds.
+func sourceStats(ctx context.Context, myDB *sql.DB, s tableSpec, since *string) (keyStats, error) {
+	var st keyStats
+	where, args := "1 = 1", []interface{}{}
+	if since != nil {
+		where, args = s.since, append(args, *since)
+	}
+	err := myDB.QueryRowContext(ctx,
+		fmt.Sprintf("SELECT COUNT(*), COALESCE(MIN(%s), 0), COALESCE(MAX(%[1]s), 0) FROM %s WHERE %s", s.key, s.source, where),
+		args...,
+	).Scan(&st.Count, &st.Min, &st.Max)
+	return st, err
+}
+
+// checksumDiff returns the columns whose checksums differ between two ranges.
+func checksumDiff(cols []string, src, dst []normRow) []string {
+	a, b := columnChecksums(len(cols), src), columnChecksums(len(cols), dst)
+	var differ []string
+	for i, col := range cols {
+		if a[i] != b[i] {
+			differ = append(differ, col)
+		}
+	}
+	return differ
+}
+
+// columnChecksums hashes each column over a range's rows in key order.
+func columnChecksums(n int, rows []normRow) []string {
+	hs := make([]hash.Hash, n)
+	for i := range hs {
+		hs[i] = sha256.New()
+	}
+	for _, r := range rows {
+		for i, v := range r.vals {
+			if v == nil {
+				hs[i].Write([]byte{0})
+				continue
+			}
+			hs[i].Write([]byte{1})
+			hs[i].Write([]byte(*v))
+			hs[i].Write([]byte{0})
+		}
+	}
+	sums := make([]string, n)
+	for i, h := range hs {
+		sums[i] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	return sums
+}
+
+// rowDiffs merges two key-ordered ranges and returns up to limit differing rows.
+func rowDiffs(cols []string, src, dst []normRow, limit int) []sampleDiff {
+	var out []sampleDiff
+	i, j := 0, 0
+	for len(out) < limit && (i < len(src) || j < len(dst)) {
+		switch {
+		case j == len(dst) || (i < len(src) && src[i].key < dst[j].key):
+			out = append(out, sampleDiff{Key: src[i].key, Kind: "missing"})
+			i++
+		case i == len(src) || dst[j].key < src[i].key:
+			out = append(out, sampleDiff{Key: dst[j].key, Kind: "extra"})
+			j++
+		default:
+			changed := map[string]columnValue{}
+			for c, col := range cols {
+				if !sameValue(src[i].vals[c], dst[j].vals[c]) {
+					changed[col] = columnValue{Source: src[i].vals[c], Target: dst[j].vals[c]}
+				}
+			}
+			if len(changed) > 0 {
+				out = append(out, sampleDiff{Key: src[i].key, Kind: "changed", Columns: changed})
+			}
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+func sameValue(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// normalise reduces rendered values to strings that compare equal across
+// MySQL and Postgres for the same stored value.
+func (s tableSpec) normalise(key int64, vals []*string) normRow {
+	r := normRow{key: key, vals: make([]*string, len(vals))}
+	for i, v := range vals {
+		r.vals[i] = normText(v, s.cols[i].pgType)
+	}
+	return r
+}
+
+// normaliseSource is normalise for source rows. NULLs in null "default"
+// columns become the column default first, as the copy writes them.
+func (s tableSpec) normaliseSource(key int64, vals []*string) normRow {
+	filled := make([]*string, len(vals))
+	for i, v := range vals {
+		if v == nil && s.cols[i].null == "default" {
+			v = s.cols[i].defaultText
+		}
+		filled[i] = v
+	}
+	return s.normalise(key, filled)
+}
+
+// normText normalises one value for its Postgres type. Floats are rounded to
+// six significant digits because MySQL doubles land in some real columns, and
+// JSON is re-encoded so key order and whitespace do not count as differences.
+func normText(v *string, pgType string) *string {
+	if v == nil {
+		return nil
+	}
+	s := *v
+	switch pgType {
+	case "boolean":
+		s = strconv.FormatBool(s == "t" || s == "true" || s == "1")
+	case "real", "double precision", "numeric":
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			s = strconv.FormatFloat(f, 'g', 6, 64)
+		}
+	case "json", "jsonb":
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(s), &decoded); err == nil {
+			b, _ := json.Marshal(decoded)
+			s = string(b)
+		}
+	case "timestamp with time zone", "timestamp without time zone":
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			s = t.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return &s
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func str(s string) *string { return &s }
+
+// verifySpec is a horses-like table whose weights and flag take the column
+// default for NULL.
+func verifySpec() tableSpec {
+	return tableSpec{
+		name: "horses", pgKey: "horse_id",
+		cols: []columnSpec{
+			{target: "horse_id", null: "keep", pgType: "integer"},
+			{target: "horse", null: "error", pgType: "character varying"},
+			{target: "highest_win_weight", null: "default", pgType: "integer", defaultText: str("0")},
+			{target: "analysed", null: "default", pgType: "boolean", defaultText: str("false")},
+			{target: "rating", null: "keep", pgType: "real"},
+		},
+	}
+}
+
+func TestNormaliseSourceDefaults(t *testing.T) {
+	s := verifySpec()
+	cols := s.pgColumns()
+
+	// As read from MySQL: NULL weight and flag, a double in a real column.
+	src := []normRow{s.normaliseSource(1, []*string{str("1"), str("Frankel"), nil, nil, str("98.30000001")})}
+	// As stored by the copy, with Postgres boolean text.
+	dst := []normRow{s.normalise(1, []*string{str("1"), str("Frankel"), str("0"), str("f"), str("98.3")})}
+
+	if differ := checksumDiff(cols, src, dst); len(differ) != 0 {
+		t.Errorf("checksums differ in %v", differ)
+	}
+	if diffs := rowDiffs(cols, src, dst, 10); len(diffs) != 0 {
+		t.Errorf("rowDiffs = %+v, want none", diffs)
+	}
+
+	// A NULL in a keep column is still a NULL, and differs from a value.
+	src = []normRow{s.normaliseSource(1, []*string{str("1"), str("Frankel"), nil, nil, nil})}
+	diffs := rowDiffs(cols, src, dst, 10)
+	if len(diffs) != 1 || diffs[0].Kind != "changed" || len(diffs[0].Columns) != 1 {
+		t.Fatalf("rowDiffs = %+v, want rating changed", diffs)
+	}
+	if got := diffs[0].Columns["rating"]; got.Source != nil || got.Target == nil || *got.Target != "98.3" {
+		t.Errorf("rating = %+v, want NULL and 98.3", got)
+	}
+}
+
+func TestRowDiffs(t *testing.T) {
+	s := verifySpec()
+	cols := s.pgColumns()
+	row := func(key int64, horse string) normRow {
+		return s.normalise(key, []*string{str("0"), str(horse), str("0"), str("false"), nil})
+	}
+	src := []normRow{row(1, "A"), row(2, "B"), row(4, "D")}
+	dst := []normRow{row(2, "B"), row(3, "C"), row(4, "E")}
+
+	want := []sampleDiff{
+		{Key: 1, Kind: "missing"},
+		{Key: 3, Kind: "extra"},
+		{Key: 4, Kind: "changed", Columns: map[string]columnValue{"horse": {Source: str("D"), Target: str("E")}}},
+	}
+	if got := rowDiffs(cols, src, dst, 10); !reflect.DeepEqual(got, want) {
+		t.Errorf("rowDiffs = %+v, want %+v", got, want)
+	}
+	if got := rowDiffs(cols, src, dst, 2); len(got) != 2 {
+		t.Errorf("rowDiffs with limit 2 returned %d rows", len(got))
+	}
+}
+
+func TestNormText(t *testing.T) {
+	tests := []struct {
+		in, pgType, want string
+	}{
+		{"t", "boolean", "true"},
+		{"1", "boolean", "true"},
+		{"f", "boolean", "false"},
+		{"0", "boolean", "false"},
+		{"2.5000000001", "double precision", "2.5"},
+		{"7", "real", "7"},
+		{`{"b": 1, "a": [1, 2]}`, "jsonb", `{"a":[1,2],"b":1}`},
+		{"2024-03-06T13:30:00+01:00", "timestamp with time zone", "2024-03-06T12:30:00Z"},
+		{" text ", "character varying", " text "},
+	}
+	for _, tt := range tests {
+		if got := normText(&tt.in, tt.pgType); got == nil || *got != tt.want {
+			t.Errorf("normText(%q, %s) = %v, want %q", tt.in, tt.pgType, got, tt.want)
+		}
+	}
+	if normText(nil, "integer") != nil {
+		t.Error("normText(nil) is not nil")
+	}
+}
@@ -0,0 +1,4 @@
+#!/bin/bash
+
+CGO_ENABLED=0 go build -o rpimport
+scp rpimport  padraic@$MIKEDO:/home/padraic/app
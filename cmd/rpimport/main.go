@@ -0,0 +1,211 @@
+// cmd/rpimport/main.go
+// Imports Racing Post racecard and result pages saved to disk, so ingestion
+// can be rebuilt or replayed without the scraper or network access.
+//
+// Each page is parsed into a race of an ingest document, one racecards and
+// one results document per day, and the documents are loaded with the same
+// code as the /rp/ingest endpoints: courses, races, pre_race, horses,
+// trainers and results, one transaction per document. Cards are loaded before
+// results. Pages that cannot be parsed are reported and skipped, and the exit
+// status is 1 if any page or race was not imported.
+//
+// Usage:
+//
+//	go run ./cmd/rpimport pages/2024-03-06/*.html
+//	go run ./cmd/rpimport -dry-run pages/ > documents.json
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/uptrace/bun"
+
+	"github.com/padraicbc/mikeapi/config"
+	bundb "github.com/padraicbc/mikeapi/db"
+	"github.com/padraicbc/mikeapi/ingest"
+)
+
+// document is an ingest document: a day of cards or results.
+type document struct {
+	kind  string
+	Date  string        `json:"date"`
+	Races []interface{} `json:"races"`
+}
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "print the ingest documents instead of loading them")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: rpimport [-dry-run] file.html|dir ...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	files, err := htmlFiles(flag.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	failed := false
+	var pages []*page
+	for _, name := range files {
+		p, err := parseFile(name)
+		if err != nil {
+			log.Printf("skipping %s: %v", name, err)
+			failed = true
+			continue
+		}
+		pages = append(pages, p)
+	}
+	docs := documents(pages)
+
+	if *dryRun {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		for _, d := range docs {
+			if err := enc.Encode(d); err != nil {
+				log.Fatal(err)
+			}
+		}
+	} else {
+		ctx := context.Background()
+		db := bundb.Setup(config.Load())
+		defer db.Close()
+		for _, d := range docs {
+			report, err := load(ctx, db, d)
+			if err != nil {
+				log.Fatalf("%s %s: %v", d.Date, d.kind, err)
+			}
+			if printReport(os.Stdout, d, report) {
+				failed = true
+			}
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// htmlFiles expands directories in args to the .html files under them.
+func htmlFiles(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		err := filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			// Files named on the command line are read whatever their extension.
+			if !d.IsDir() && (path == arg || strings.EqualFold(filepath.Ext(path), ".html")) {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func parseFile(name string) (*page, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parsePage(f)
+}
+
+// documents groups pages into one document per day and kind, by date with
+// cards first. A race saved twice is only sent once.
+func documents(pages []*page) []*document {
+	byKey := map[string]*document{}
+	seen := map[string]bool{}
+	for _, p := range pages {
+		var rc interface{}
+		var id int
+		if p.kind == kindRacecard {
+			rc, id = p.card, p.card.RaceID
+		} else {
+			rc, id = p.res, p.res.RaceID
+		}
+		key := p.date + " " + p.kind
+		if seen[fmt.Sprint(key, id)] {
+			continue
+		}
+		seen[fmt.Sprint(key, id)] = true
+		d, ok := byKey[key]
+		if !ok {
+			d = &document{kind: p.kind, Date: p.date}
+			byKey[key] = d
+		}
+		d.Races = append(d.Races, rc)
+	}
+
+	docs := make([]*document, 0, len(byKey))
+	for _, d := range byKey {
+		docs = append(docs, d)
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		if docs[i].Date != docs[j].Date {
+			return docs[i].Date < docs[j].Date
+		}
+		return docs[i].kind == kindRacecard && docs[j].kind != kindRacecard
+	})
+	return docs
+}
+
+// printReport writes a document's counts and each rejected race, and says
+// whether any race was rejected. A race rejected by the schema has no ID yet,
+// so races are named by their index in the document.
+func printReport(w io.Writer, d *document, report *ingest.Report) (rejected bool) {
+	fmt.Fprintf(w, "%s %-9s accepted %d rejected %d\n", d.Date, d.kind, report.Accepted, report.Rejected)
+	for _, rr := range report.Races {
+		if rr.Status != "rejected" {
+			continue
+		}
+		rejected = true
+		name := fmt.Sprintf("races[%d]", rr.Index)
+		if rr.RaceID != nil {
+			name += fmt.Sprintf(" (race %d)", *rr.RaceID)
+		}
+		fmt.Fprintf(w, "    %s: %s\n", name, strings.Join(rr.Errors, "; "))
+	}
+	return rejected
+}
+
+// load ingests one document in its own transaction.
+func load(ctx context.Context, db *bun.DB, d *document) (*ingest.Report, error) {
+	body, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	ingestFn := ingest.Results
+	if d.kind == kindRacecard {
+		ingestFn = ingest.Racecards
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	report, err := ingestFn(ctx, tx, body, nil)
+	if err != nil {
+		return nil, err
+	}
+	return report, tx.Commit()
+}
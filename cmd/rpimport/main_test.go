@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/pgdialect"
+)
+
+// txOnlyDriver accepts transactions but no statements. That is enough to
+// load a document whose races are all rejected before anything is written.
+type txOnlyDriver struct{}
+
+func (txOnlyDriver) Open(string) (driver.Conn, error) { return txOnlyConn{}, nil }
+
+type txOnlyConn struct{}
+
+func (txOnlyConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("unexpected query: " + query)
+}
+func (txOnlyConn) Close() error              { return nil }
+func (txOnlyConn) Begin() (driver.Tx, error) { return txOnlyConn{}, nil }
+func (txOnlyConn) Commit() error             { return nil }
+func (txOnlyConn) Rollback() error           { return nil }
+
+func init() {
+	sql.Register("rpimport-txonly", txOnlyDriver{})
+}
+
+// TestLoadSchemaRejects loads races the schema rejects, which have no race ID
+// in the report, and checks they are reported by index.
+func TestLoadSchemaRejects(t *testing.T) {
+	p, err := parseFile("testdata/racecard_kempton.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	noRunners := *p.card
+	noRunners.Runners = []runner{}
+	badDistance := *p.card
+	badDistance.RaceID++
+	badDistance.Distance = 0
+	pages := []*page{
+		{kind: kindRacecard, date: p.date, card: &noRunners},
+		{kind: kindRacecard, date: p.date, card: &badDistance},
+	}
+
+	docs := documents(pages)
+	if len(docs) != 1 || len(docs[0].Races) != 2 {
+		t.Fatalf("got %d documents, want one of two races", len(docs))
+	}
+
+	sqldb, err := sql.Open("rpimport-txonly", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := bun.NewDB(sqldb, pgdialect.New())
+	defer db.Close()
+
+	report, err := load(context.Background(), db, docs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Accepted != 0 || report.Rejected != 2 {
+		t.Fatalf("accepted %d rejected %d, want 0 and 2", report.Accepted, report.Rejected)
+	}
+	for _, rr := range report.Races {
+		if rr.RaceID != nil {
+			t.Errorf("races[%d] has race ID %d, want none", rr.Index, *rr.RaceID)
+		}
+	}
+
+	var out bytes.Buffer
+	if !printReport(&out, docs[0], report) {
+		t.Error("printReport did not report the rejected races")
+	}
+	for _, want := range []string{"races[0]: /races/0/runners: must have at least 1 items", "races[1]: /races/1/distance: must be at least 1"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report does not contain %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Page kinds, from the first segment of the page's canonical URL.
+const (
+	kindRacecard = "racecards"
+	kindResult   = "results"
+)
+
+// page is one saved race page, parsed into the shape of an ingest document
+// race.
+type page struct {
+	kind string
+	date string
+	card *card   // kindRacecard
+	res  *result // kindResult
+}
+
+// race is the race header shared by cards and results, as in the ingest
+// schemas.
+type race struct {
+	RaceID   int     `json:"raceID"`
+	Course   course  `json:"course"`
+	Time     string  `json:"time"`
+	URL      string  `json:"url"`
+	Distance float64 `json:"distance"`
+	Class    *string `json:"class"`
+	Going    *string `json:"going"`
+}
+
+type course struct {
+	CourseID  int    `json:"courseID"`
+	Name      string `json:"name"`
+	Direction string `json:"direction,omitempty"`
+	IsAW      bool   `json:"isAw"`
+	Code      string `json:"code"`
+}
+
+type card struct {
+	race
+	Runners []runner `json:"runners"`
+}
+
+type runner struct {
+	HorseID     int     `json:"horseID"`
+	Horse       string  `json:"horse"`
+	Number      *int    `json:"number"`
+	Draw        *int    `json:"draw"`
+	Age         *int    `json:"age"`
+	Weight      *int    `json:"weight"`
+	Claim       *int    `json:"claim"`
+	OfficialRat *int    `json:"officialRat"`
+	Jockey      *string `json:"jockey"`
+	Trainer     *string `json:"trainer"`
+	TrainerID   *int    `json:"trainerID"`
+	Headgear    *string `json:"headgear"`
+}
+
+type result struct {
+	race
+	Results []finisher `json:"results"`
+}
+
+type finisher struct {
+	HorseID          int      `json:"horseID"`
+	Horse            string   `json:"horse"`
+	Age              int      `json:"age"`
+	Price            string   `json:"price"`
+	Trainer          string   `json:"trainer"`
+	Jockey           string   `json:"jockey"`
+	Number           int      `json:"number"`
+	Headgear         *string  `json:"headgear"`
+	Placed           string   `json:"placed"`
+	OfficialRat      *int     `json:"officialRat"`
+	WinDist          *float64 `json:"winDist"`
+	DistBehindWinner *float64 `json:"distBehindWinner"`
+	WeightCarried    int      `json:"weightCarried"`
+	CardWeight       int      `json:"cardWeight"`
+	Claim            *int     `json:"claim"`
+	RPR              *int     `json:"rpr"`
+	TS               *int     `json:"ts"`
+	Comment          *string  `json:"comment"`
+}
+
+// Racing Post marks up the fields we read with data-test-selector
+// attributes; these are their values.
+const (
+	selCourseName  = "RC-courseHeader__name"
+	selTime        = "RC-courseHeader__time"
+	selDistance    = "RC-header__raceDistanceRound"
+	selClass       = "RC-header__raceClass"
+	selGoing       = "RC-headerBox__going"
+	selDescription = "RC-courseDescription"
+
+	selRunnerRow  = "RC-runnerRow"
+	selRunnerNo   = "RC-cardPage-runnerNumber-no"
+	selRunnerDraw = "RC-cardPage-runnerNumber-draw"
+	selRunnerName = "RC-cardPage-runnerName"
+	selRunnerAge  = "RC-cardPage-runnerAge"
+	selRunnerSt   = "RC-cardPage-runnerWgt-st"
+	selRunnerLb   = "RC-cardPage-runnerWgt-lb"
+	selRunnerJock = "RC-cardPage-runnerJockey-name"
+	selRunnerAllw = "RC-cardPage-runnerJockey-allowance"
+	selRunnerTrnr = "RC-cardPage-runnerTrainer-name"
+	selRunnerOR   = "RC-cardPage-runnerOr"
+	selRunnerHG   = "RC-cardPage-runnerHeadGear"
+
+	selResultRow   = "RC-resultRow"
+	selResultPos   = "RC-resultRow__pos"
+	selResultBtn   = "RC-resultRow__distBeaten"
+	selResultName  = "RC-resultRow__horseName"
+	selResultNo    = "RC-resultRow__number"
+	selResultPrice = "RC-resultRow__price"
+	selResultAge   = "RC-resultRow__age"
+	selResultSt    = "RC-resultRow__wgt-st"
+	selResultLb    = "RC-resultRow__wgt-lb"
+	selResultHG    = "RC-resultRow__headgear"
+	selResultJock  = "RC-resultRow__jockey"
+	selResultAllw  = "RC-resultRow__jockeyAllowance"
+	selResultTrnr  = "RC-resultRow__trainer"
+	selResultOR    = "RC-resultRow__or"
+	selResultTS    = "RC-resultRow__ts"
+	selResultRPR   = "RC-resultRow__rpr"
+	selResultNote  = "RC-resultRow__comment"
+)
+
+// canonicalPath matches /racecards/32/kempton-aw/2024-03-06/861234 and the
+// /results/ equivalent.
+var canonicalPath = regexp.MustCompile(`^/(racecards|results)/(\d+)/[^/]+/(\d{4}-\d{2}-\d{2})/(\d+)`)
+
+// parsePage reads a saved racecard or result page. Which one it is comes from
+// the page's canonical link, which also gives the course and race IDs and
+// the date.
+func parsePage(r io.Reader) (*page, error) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	href := ""
+	walk(doc, func(n *html.Node) bool {
+		if n.Type == html.ElementNode && n.Data == "link" && attr(n, "rel") == "canonical" {
+			href = attr(n, "href")
+			return false
+		}
+		return true
+	})
+	if href == "" {
+		return nil, fmt.Errorf("no canonical link")
+	}
+	u, err := url.Parse(href)
+	if err != nil {
+		return nil, fmt.Errorf("canonical link: %w", err)
+	}
+	m := canonicalPath.FindStringSubmatch(u.Path)
+	if m == nil {
+		return nil, fmt.Errorf("canonical link %s is not a racecard or result", href)
+	}
+
+	rc, err := parseRace(doc, href, m)
+	if err != nil {
+		return nil, err
+	}
+	p := &page{kind: m[1], date: m[3]}
+	if p.kind == kindRacecard {
+		p.card = &card{race: *rc}
+		for i, row := range findAll(doc, selRunnerRow) {
+			run, err := parseRunner(row)
+			if err != nil {
+				return nil, fmt.Errorf("runner %d: %w", i+1, err)
+			}
+			if run != nil {
+				p.card.Runners = append(p.card.Runners, *run)
+			}
+		}
+		if len(p.card.Runners) == 0 {
+			return nil, fmt.Errorf("no runners")
+		}
+		return p, nil
+	}
+
+	p.res = &result{race: *rc}
+	var behind float64
+	for i, row := range findAll(doc, selResultRow) {
+		f, err := parseFinisher(row)
+		if err != nil {
+			return nil, fmt.Errorf("result %d: %w", i+1, err)
+		}
+		// The beaten distance is to the horse in front; the winner's is
+		// blank and it is credited with the second's margin instead.
+		if f.WinDist != nil {
+			behind += *f.WinDist
+			if i == 1 && p.res.Results[0].WinDist == nil {
+				p.res.Results[0].WinDist = ptr(*f.WinDist)
+			}
+		}
+		if i == 0 || f.WinDist != nil {
+			f.DistBehindWinner = ptr(behind)
+		}
+		p.res.Results = append(p.res.Results, *f)
+	}
+	if len(p.res.Results) == 0 {
+		return nil, fmt.Errorf("no results")
+	}
+	return p, nil
+}
+
+func parseRace(doc *html.Node, href string, m []string) (*race, error) {
+	courseID, _ := strconv.Atoi(m[2])
+	raceID, _ := strconv.Atoi(m[4])
+	rc := &race{RaceID: raceID, URL: href}
+
+	name := text(find(doc, selCourseName))
+	if name == "" {
+		return nil, fmt.Errorf("no course name")
+	}
+	rc.Course = parseCourse(courseID, name, text(find(doc, selDescription)))
+
+	t, err := parseTime(text(find(doc, selTime)))
+	if err != nil {
+		return nil, err
+	}
+	rc.Time = t
+
+	if rc.Distance, err = parseDistance(text(find(doc, selDistance))); err != nil {
+		return nil, err
+	}
+	if class := strings.Trim(text(find(doc, selClass)), "()"); class != "" {
+		rc.Class = &class
+	}
+	if going := text(find(doc, selGoing)); going != "" {
+		rc.Going = &going
+	}
+	return rc, nil
+}
+
+var courseTag = regexp.MustCompile(`\(([A-Z]+)\)`)
+
+// parseCourse splits a course header such as "Dundalk (IRE) (AW)" into the
+// country code and all-weather flag; the name is kept as shown, which is how
+// the courses table holds it. Direction is only known when the page carries
+// the course description.
+func parseCourse(id int, name, description string) course {
+	c := course{CourseID: id, Name: name, Code: "GB"}
+	for _, tag := range courseTag.FindAllStringSubmatch(name, -1) {
+		if tag[1] == "AW" {
+			c.IsAW = true
+		} else {
+			c.Code = tag[1]
+		}
+	}
+	d := strings.ToLower(description)
+	switch {
+	case strings.Contains(d, "left-handed"):
+		c.Direction = "L"
+	case strings.Contains(d, "right-handed"):
+		c.Direction = "R"
+	}
+	return c
+}
+
+func parseRunner(row *html.Node) (*runner, error) {
+	no := text(find(row, selRunnerNo))
+	if strings.EqualFold(no, "NR") {
+		return nil, nil
+	}
+	run := &runner{Number: atoiPtr(no), Draw: atoiPtr(strings.Trim(text(find(row, selRunnerDraw)), "()"))}
+
+	var err error
+	if run.HorseID, run.Horse, err = profileLink(find(row, selRunnerName), "horse"); err != nil {
+		return nil, err
+	}
+	run.Age = atoiPtr(text(find(row, selRunnerAge)))
+	if w, ok := weight(row, selRunnerSt, selRunnerLb); ok {
+		run.Weight = &w
+	}
+	run.Claim = atoiPtr(strings.Trim(text(find(row, selRunnerAllw)), "()"))
+	run.OfficialRat = atoiPtr(text(find(row, selRunnerOR)))
+	run.Jockey = strPtr(text(find(row, selRunnerJock)))
+	if tn := find(row, selRunnerTrnr); tn != nil {
+		id, name, err := profileLink(tn, "trainer")
+		if err != nil {
+			return nil, err
+		}
+		run.TrainerID, run.Trainer = &id, &name
+	}
+	run.Headgear = strPtr(text(find(row, selRunnerHG)))
+	return run, nil
+}
+
+func parseFinisher(row *html.Node) (*finisher, error) {
+	f := &finisher{
+		Placed:  text(find(row, selResultPos)),
+		Price:   text(find(row, selResultPrice)),
+		Jockey:  text(find(row, selResultJock)),
+		Trainer: text(find(row, selResultTrnr)),
+	}
+	if f.Placed == "" {
+		return nil, fmt.Errorf("no position")
+	}
+
+	var err error
+	if f.HorseID, f.Horse, err = profileLink(find(row, selResultName), "horse"); err != nil {
+		return nil, err
+	}
+	if f.Number, err = strconv.Atoi(text(find(row, selResultNo))); err != nil {
+		return nil, fmt.Errorf("%s: number: %w", f.Horse, err)
+	}
+	if f.Age, err = strconv.Atoi(text(find(row, selResultAge))); err != nil {
+		return nil, fmt.Errorf("%s: age: %w", f.Horse, err)
+	}
+	w, ok := weight(row, selResultSt, selResultLb)
+	if !ok {
+		return nil, fmt.Errorf("%s: no weight", f.Horse)
+	}
+	f.CardWeight, f.WeightCarried = w, w
+	if f.Claim = atoiPtr(strings.Trim(text(find(row, selResultAllw)), "()")); f.Claim != nil {
+		f.WeightCarried -= *f.Claim
+	}
+	if btn := text(find(row, selResultBtn)); btn != "" {
+		l, err := parseLengths(btn)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Horse, err)
+		}
+		f.WinDist = &l
+	}
+	f.Headgear = strPtr(text(find(row, selResultHG)))
+	f.OfficialRat = atoiPtr(text(find(row, selResultOR)))
+	f.TS = atoiPtr(text(find(row, selResultTS)))
+	f.RPR = atoiPtr(text(find(row, selResultRPR)))
+	f.Comment = strPtr(text(resultComment(row)))
+	return f, nil
+}
+
+// resultComment finds a runner's comment, which is normally in a row of its
+// own after the runner's.
+func resultComment(row *html.Node) *html.Node {
+	if n := find(row, selResultNote); n != nil {
+		return n
+	}
+	for sib := row.NextSibling; sib != nil; sib = sib.NextSibling {
+		if sib.Type != html.ElementNode {
+			continue
+		}
+		if attr(sib, "data-test-selector") == selResultRow {
+			return nil
+		}
+		if n := find(sib, selResultNote); n != nil {
+			return n
+		}
+	}
+	return nil
+}
+
+// profileLink reads the ID and name from a /profile/<kind>/<id>/<slug> link.
+func profileLink(n *html.Node, kind string) (int, string, error) {
+	if n == nil {
+		return 0, "", fmt.Errorf("no %s link", kind)
+	}
+	name := text(n)
+	parts := strings.Split(strings.Trim(attr(n, "href"), "/"), "/")
+	for i := 0; i+2 < len(parts); i++ {
+		if parts[i] == "profile" && parts[i+1] == kind {
+			id, err := strconv.Atoi(parts[i+2])
+			if err != nil {
+				return 0, "", fmt.Errorf("%s %s: bad profile link %s", kind, name, attr(n, "href"))
+			}
+			return id, name, nil
+		}
+	}
+	return 0, "", fmt.Errorf("%s %s: no profile link", kind, name)
+}
+
+// weight reads a weight split into stones and pounds as pounds.
+func weight(row *html.Node, stSel, lbSel string) (int, bool) {
+	st, err := strconv.Atoi(text(find(row, stSel)))
+	if err != nil {
+		return 0, false
+	}
+	lb, err := strconv.Atoi(text(find(row, lbSel)))
+	if err != nil {
+		return 0, false
+	}
+	return st*14 + lb, true
+}
+
+// parseTime turns the card's 12-hour "1:30" into the 24-hour "13:30" the
+// races table uses. Racing runs from late morning into the evening, so hours
+// before 11 are afternoon.
+func parseTime(s string) (string, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hour, err1 := strconv.Atoi(h)
+	minute, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hour < 1 || hour > 12 || minute < 0 || minute > 59 {
+		return "", fmt.Errorf("bad race time %q", s)
+	}
+	if hour < 11 {
+		hour += 12
+	}
+	return fmt.Sprintf("%02d:%02d", hour, minute), nil
+}
+
+var distancePattern = regexp.MustCompile(`^(?:(\d+)m)?(?:(\d+)?(½)?f)?(?:(\d+)y)?$`)
+
+// parseDistance turns a distance such as "1m2½f" or "7f110y" into furlongs.
+func parseDistance(s string) (float64, error) {
+	m := distancePattern.FindStringSubmatch(strings.ReplaceAll(s, " ", ""))
+	if s == "" || m == nil {
+		return 0, fmt.Errorf("bad distance %q", s)
+	}
+	var f float64
+	if m[1] != "" {
+		miles, _ := strconv.Atoi(m[1])
+		f += float64(miles * 8)
+	}
+	if m[2] != "" {
+		furlongs, _ := strconv.Atoi(m[2])
+		f += float64(furlongs)
+	}
+	if m[3] != "" {
+		f += 0.5
+	}
+	if m[4] != "" {
+		yards, _ := strconv.Atoi(m[4])
+		f += float64(yards) / 220
+	}
+	return f, nil
+}
+
+// shortMargins are the beaten distances given in words, in lengths.
+var shortMargins = map[string]float64{
+	"dht": 0, "nse": 0.05, "shd": 0.1, "sht-hd": 0.1, "hd": 0.2,
+	"snk": 0.25, "nk": 0.3, "dist": 30,
+}
+
+var fractions = map[rune]float64{'¼': 0.25, '½': 0.5, '¾': 0.75}
+
+// parseLengths turns a beaten distance such as "3¼", "nk" or "12" into lengths.
+func parseLengths(s string) (float64, error) {
+	if l, ok := shortMargins[strings.ToLower(s)]; ok {
+		return l, nil
+	}
+	var l float64
+	whole := strings.TrimRightFunc(s, func(r rune) bool { return fractions[r] != 0 })
+	if whole != "" {
+		n, err := strconv.Atoi(whole)
+		if err != nil {
+			return 0, fmt.Errorf("bad beaten distance %q", s)
+		}
+		l = float64(n)
+	}
+	for _, r := range s[len(whole):] {
+		l += fractions[r]
+	}
+	return l, nil
+}
+
+// walk visits n and its descendants depth first until fn returns false.
+func walk(n *html.Node, fn func(*html.Node) bool) bool {
+	if !fn(n) {
+		return false
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if !walk(c, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// find returns the first element under n with the data-test-selector sel.
+func find(n *html.Node, sel string) *html.Node {
+	var found *html.Node
+	walk(n, func(c *html.Node) bool {
+		if c.Type == html.ElementNode && attr(c, "data-test-selector") == sel {
+			found = c
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// findAll returns every element under n with the data-test-selector sel.
+func findAll(n *html.Node, sel string) []*html.Node {
+	var out []*html.Node
+	walk(n, func(c *html.Node) bool {
+		if c.Type == html.ElementNode && attr(c, "data-test-selector") == sel {
+			out = append(out, c)
+		}
+		return true
+	})
+	return out
+}
+
+func attr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// text returns the text under n with runs of white space collapsed.
+func text(n *html.Node) string {
+	if n == nil {
+		return ""
+	}
+	var b strings.Builder
+	walk(n, func(c *html.Node) bool {
+		if c.Type == html.TextNode {
+			b.WriteString(c.Data)
+			b.WriteByte(' ')
+		}
+		return true
+	})
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+func atoiPtr(s string) *int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return nil
+	}
+	return &n
+}
+
+func strPtr(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func ptr[T any](v T) *T { return &v }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/padraicbc/mikeapi/ingest"
+)
+
+var update = flag.Bool("update", false, "rewrite the expected .json files in testdata")
+
+// TestParsePages parses each testdata/*.html page and compares the race with
+// the .json file of the same name. Run with -update after changing the parser
+// or adding a page, and check the diff.
+func TestParsePages(t *testing.T) {
+	pages, err := filepath.Glob("testdata/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) == 0 {
+		t.Fatal("no pages in testdata")
+	}
+	for _, name := range pages {
+		t.Run(filepath.Base(name), func(t *testing.T) {
+			p, err := parseFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := documents([]*page{p})[0]
+			got, err := json.MarshalIndent(d, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			golden := strings.TrimSuffix(name, ".html") + ".json"
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s differs from %s:\n%s", name, golden, got)
+			}
+
+			schema := ingest.ResultSchema()
+			if d.kind == kindRacecard {
+				schema = ingest.RacecardSchema()
+			}
+			validate(t, schema, got)
+		})
+	}
+}
+
+// validate checks a document against a published ingest schema, so the
+// importer cannot drift from what the endpoints accept.
+func validate(t *testing.T, schemaJSON, doc []byte) {
+	t.Helper()
+	s, err := ingest.CompileSchema(schemaJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	errs := s.Validate(v)
+	for i, rc := range v.(map[string]interface{})["races"].([]interface{}) {
+		errs = append(errs, s.ValidateDef("race", rc, fmt.Sprintf("/races/%d", i))...)
+	}
+	for _, e := range errs {
+		t.Errorf("schema: %s", e)
+	}
+}
+
+func TestParsePageErrors(t *testing.T) {
+	tests := []struct {
+		name, html, want string
+	}{
+		{"no canonical", `<html><head></head><body></body></html>`, "no canonical link"},
+		{"other page", `<link rel="canonical" href="https://www.racingpost.com/news/">`, "is not a racecard or result"},
+		{"no runners", `<link rel="canonical" href="https://www.racingpost.com/racecards/1/ascot/2024-06-18/1">
+			<span data-test-selector="RC-courseHeader__name">Ascot</span>
+			<span data-test-selector="RC-courseHeader__time">2:30</span>
+			<span data-test-selector="RC-header__raceDistanceRound">1m</span>`, "no runners"},
+		{"bad distance", `<link rel="canonical" href="https://www.racingpost.com/results/1/ascot/2024-06-18/1">
+			<span data-test-selector="RC-courseHeader__name">Ascot</span>
+			<span data-test-selector="RC-courseHeader__time">2:30</span>
+			<span data-test-selector="RC-header__raceDistanceRound">a mile</span>`, "bad distance"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePage(strings.NewReader(tt.html))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDistance(t *testing.T) {
+	tests := map[string]float64{
+		"5f": 5, "7½f": 7.5, "1m": 8, "1m2f": 10, "2m4½f": 20.5, "1m110y": 8.5, "3m1f": 25,
+	}
+	for in, want := range tests {
+		got, err := parseDistance(in)
+		if err != nil || got != want {
+			t.Errorf("parseDistance(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "1 mile", "m"} {
+		if _, err := parseDistance(in); err == nil {
+			t.Errorf("parseDistance(%q) succeeded", in)
+		}
+	}
+}
+
+func TestParseLengths(t *testing.T) {
+	tests := map[string]float64{
+		"nk": 0.3, "shd": 0.1, "hd": 0.2, "nse": 0.05, "dht": 0,
+		"½": 0.5, "1¾": 1.75, "3¼": 3.25, "12": 12, "dist": 30,
+	}
+	for in, want := range tests {
+		got, err := parseLengths(in)
+		if err != nil || got != want {
+			t.Errorf("parseLengths(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := parseLengths("far"); err == nil {
+		t.Error(`parseLengths("far") succeeded`)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := map[string]string{
+		"1:30": "13:30", "5:05": "17:05", "9:00": "21:00", "11:45": "11:45", "12:10": "12:10",
+	}
+	for in, want := range tests {
+		got, err := parseTime(in)
+		if err != nil || got != want {
+			t.Errorf("parseTime(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "13:30", "1.30", "1:60"} {
+		if _, err := parseTime(in); err == nil {
+			t.Errorf("parseTime(%q) succeeded", in)
+		}
+	}
+}
+
+func TestParseCourse(t *testing.T) {
+	tests := []struct {
+		name, description string
+		want              course
+	}{
+		{"Ascot", "", course{Name: "Ascot", Code: "GB"}},
+		{"Kempton (AW)", "Right-handed polytrack", course{Name: "Kempton (AW)", Code: "GB", IsAW: true, Direction: "R"}},
+		{"Dundalk (IRE) (AW)", "Left-handed", course{Name: "Dundalk (IRE) (AW)", Code: "IRE", IsAW: true, Direction: "L"}},
+	}
+	for _, tt := range tests {
+		if got := parseCourse(0, tt.name, tt.description); got != tt.want {
+			t.Errorf("parseCourse(%q) = %+v; want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -5,7 +5,9 @@ package config
 import (
 	"fmt"
 	"log"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/spf13/viper"
@@ -22,8 +24,53 @@ type Config struct {
 	DBName      string
 	DBSSLMode   string
 
-	// JWT signing secret (required in production).
+	// JWT signing secret (required in production) and the kid tokens are
+	// signed under. JWTKeys holds the active key for JWT_ALG (HS256 with
+	// JWTSecret, or EdDSA/RS256 from a PEM file) plus verify-only keys.
 	JWTSecret string
+	JWTKeyID  string
+	JWTKeys   *JWTKeySet
+
+	// Lifetimes of the access and refresh tokens issued at sign-in.
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	// Password policy: minimum length and extra deny-listed passwords
+	// loaded from PASSWORD_DENYLIST_FILE (one per line).
+	PasswordMinLength int
+	PasswordDenyList  []string
+
+	// Issuer shown by authenticator apps for TOTP two-factor enrollment.
+	TOTPIssuer string
+
+	// Sign-in throttling: failures allowed before backoff starts, the first
+	// backoff delay (doubled per further failure), and the failure count
+	// that locks a client IP or username out for SigninLockout.
+	SigninFreeAttempts int
+	SigninBackoff      time.Duration
+	SigninMaxFailures  int
+	SigninLockout      time.Duration
+
+	// Error reports: the SMTP relay to send through, or a file to append
+	// reports to instead. With neither set, reports are only logged. Reports
+	// are batched for NotifyDelay and sent at most once per NotifyInterval.
+	// The sender and recipients are RPConfig's ReportFrom and ReportTo.
+	SMTPAddr       string
+	SMTPUser       string
+	SMTPPass       string
+	NotifyFile     string
+	NotifyDelay    time.Duration
+	NotifyInterval time.Duration
+
+	// AllowUnversionedSaves lets analysis saves that do not send row versions
+	// through without the stale-write check. Temporary: it keeps clients that
+	// predate versions working and will be removed once they send them.
+	AllowUnversionedSaves bool
+
+	// AdminUsers is the comma-separated ADMIN_USERS list that granted admin
+	// access before roles were stored. dbmigrate promotes these users once,
+	// when roles are added to an existing users table.
+	AdminUsers []string
 
 	// Server
 	Debug      bool
@@ -46,6 +93,8 @@ type RPConfig struct {
 	DBName    string
 	DBSSLMode string
 
+	// Error report recipients (comma-separated) and sender, also used for
+	// mikeapi's own error reports.
 	ReportTo   string
 	ReportFrom string
 }
@@ -64,6 +113,20 @@ func Load() *Config {
 	v.SetDefault("PORT", ":9000")
 	v.SetDefault("TLS_DOMAINS", "mmrace.app,www.mmrace.app")
 	v.SetDefault("DEBUG", false)
+	v.SetDefault("JWT_ALG", AlgHS256)
+	v.SetDefault("JWT_KEY_ID", "default")
+	v.SetDefault("JWT_ACCESS_TTL", "15m")
+	v.SetDefault("JWT_REFRESH_TTL", "720h")
+	v.SetDefault("PASSWORD_MIN_LENGTH", 10)
+	v.SetDefault("TOTP_ISSUER", "mikeapi")
+	v.SetDefault("SIGNIN_FREE_ATTEMPTS", 3)
+	v.SetDefault("SIGNIN_BACKOFF", "1s")
+	v.SetDefault("SIGNIN_MAX_FAILURES", 10)
+	v.SetDefault("SIGNIN_LOCKOUT", "15m")
+	v.SetDefault("NOTIFY_DELAY", "1m")
+	v.SetDefault("NOTIFY_INTERVAL", "15m")
+	v.SetDefault("ADMIN_USERS", "admin")
+	v.SetDefault("ALLOW_UNVERSIONED_SAVES", false)
 
 	cfg := &Config{
 		DatabaseURL: v.GetString("DATABASE_URL"),
@@ -74,13 +137,59 @@ func Load() *Config {
 		DBName:      v.GetString("DB_NAME"),
 		DBSSLMode:   v.GetString("DB_SSLMODE"),
 		JWTSecret:   v.GetString("JWT_SECRET"),
-		Debug:       v.GetBool("DEBUG"),
-		Port:        v.GetString("PORT"),
-		TLSDomains:  splitTrimmed(v.GetString("TLS_DOMAINS")),
-		MySQLDSN:    v.GetString("MYSQL_DSN"),
+		JWTKeyID:    v.GetString("JWT_KEY_ID"),
+
+		AccessTokenTTL:  v.GetDuration("JWT_ACCESS_TTL"),
+		RefreshTokenTTL: v.GetDuration("JWT_REFRESH_TTL"),
+
+		PasswordMinLength: v.GetInt("PASSWORD_MIN_LENGTH"),
+
+		TOTPIssuer: v.GetString("TOTP_ISSUER"),
+
+		SigninFreeAttempts: v.GetInt("SIGNIN_FREE_ATTEMPTS"),
+		SigninBackoff:      v.GetDuration("SIGNIN_BACKOFF"),
+		SigninMaxFailures:  v.GetInt("SIGNIN_MAX_FAILURES"),
+		SigninLockout:      v.GetDuration("SIGNIN_LOCKOUT"),
+
+		SMTPAddr:       v.GetString("SMTP_ADDR"),
+		SMTPUser:       v.GetString("SMTP_USER"),
+		SMTPPass:       v.GetString("SMTP_PASS"),
+		NotifyFile:     v.GetString("NOTIFY_FILE"),
+		NotifyDelay:    v.GetDuration("NOTIFY_DELAY"),
+		NotifyInterval: v.GetDuration("NOTIFY_INTERVAL"),
+
+		AllowUnversionedSaves: v.GetBool("ALLOW_UNVERSIONED_SAVES"),
+		AdminUsers:            splitTrimmed(v.GetString("ADMIN_USERS")),
+
+		Debug:      v.GetBool("DEBUG"),
+		Port:       v.GetString("PORT"),
+		TLSDomains: splitTrimmed(v.GetString("TLS_DOMAINS")),
+		MySQLDSN:   v.GetString("MYSQL_DSN"),
 	}
 
 	cfg.validate()
+
+	keys, err := newJWTKeySet(jwtKeySettings{
+		Alg:            v.GetString("JWT_ALG"),
+		KeyID:          cfg.JWTKeyID,
+		Secret:         cfg.JWTSecret,
+		PrivateKeyFile: v.GetString("JWT_PRIVATE_KEY_FILE"),
+		VerifyKeys:     v.GetString("JWT_VERIFY_KEYS"),
+		PublicKeyFiles: v.GetString("JWT_PUBLIC_KEY_FILES"),
+	})
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	cfg.JWTKeys = keys
+
+	if path := v.GetString("PASSWORD_DENYLIST_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("config: PASSWORD_DENYLIST_FILE: %v", err)
+		}
+		cfg.PasswordDenyList = strings.Split(string(data), "\n")
+	}
+
 	return cfg
 }
 
@@ -131,7 +240,7 @@ func (c *Config) PostgresDSN() string {
 	)
 }
 
-// JWTKey returns the JWT signing key as a byte slice.
+// JWTKey returns the active JWT signing key as a byte slice.
 func (c *Config) JWTKey() []byte {
 	return []byte(c.JWTSecret)
 }
@@ -166,6 +275,21 @@ func (c *Config) validate() {
 	if c.JWTSecret == "" {
 		log.Fatal("config: JWT_SECRET must be set")
 	}
+	if strings.TrimSpace(c.JWTKeyID) == "" {
+		log.Fatal("config: JWT_KEY_ID must not be blank")
+	}
+	if c.AccessTokenTTL <= 0 || c.RefreshTokenTTL <= 0 {
+		log.Fatal("config: JWT_ACCESS_TTL and JWT_REFRESH_TTL must be positive durations")
+	}
+	if c.PasswordMinLength < 8 {
+		log.Fatal("config: PASSWORD_MIN_LENGTH must be at least 8")
+	}
+	if c.SigninMaxFailures <= c.SigninFreeAttempts || c.SigninLockout <= 0 {
+		log.Fatal("config: SIGNIN_MAX_FAILURES must exceed SIGNIN_FREE_ATTEMPTS and SIGNIN_LOCKOUT must be positive")
+	}
+	if c.NotifyDelay < 0 || c.NotifyInterval < 0 {
+		log.Fatal("config: NOTIFY_DELAY and NOTIFY_INTERVAL must not be negative")
+	}
 }
 
 func (c *RPConfig) validate() {
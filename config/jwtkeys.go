@@ -0,0 +1,244 @@
+package config
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Supported JWT signing algorithms.
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+	AlgRS256 = "RS256"
+)
+
+// JWTKey is one key in the JWT keyset, named by the token's kid header.
+// HS256 keys carry Secret; EdDSA and RS256 keys carry PublicKey, and the
+// active asymmetric key also carries PrivateKey.
+type JWTKey struct {
+	ID         string
+	Alg        string
+	Secret     []byte
+	PrivateKey crypto.Signer
+	PublicKey  crypto.PublicKey
+}
+
+// SigningKey returns the key material used to sign tokens.
+func (k *JWTKey) SigningKey() interface{} {
+	if k.Alg == AlgHS256 {
+		return k.Secret
+	}
+	return k.PrivateKey
+}
+
+// VerifyKey returns the key material used to verify tokens.
+func (k *JWTKey) VerifyKey() interface{} {
+	if k.Alg == AlgHS256 {
+		return k.Secret
+	}
+	return k.PublicKey
+}
+
+// JWTKeySet holds the active signing key plus any verify-only keys that are
+// kept during a rotation so tokens signed with an old key stay valid.
+type JWTKeySet struct {
+	Active *JWTKey
+	keys   map[string]*JWTKey
+}
+
+// Lookup returns the key with the given kid.
+func (ks *JWTKeySet) Lookup(kid string) (*JWTKey, bool) {
+	k, ok := ks.keys[kid]
+	return k, ok
+}
+
+// PublicKeys returns the asymmetric keys, ordered by kid, for publishing as a JWKS.
+func (ks *JWTKeySet) PublicKeys() []*JWTKey {
+	out := make([]*JWTKey, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		if k.Alg != AlgHS256 {
+			out = append(out, k)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// NewJWTKeySet returns a keyset that signs with active and also verifies
+// tokens signed with any of the retired keys. Load builds the keyset from the
+// JWT_* settings; this is for callers that already hold the keys.
+func NewJWTKeySet(active *JWTKey, retired ...*JWTKey) (*JWTKeySet, error) {
+	ks := &JWTKeySet{Active: active, keys: map[string]*JWTKey{active.ID: active}}
+	for _, k := range retired {
+		if err := ks.add(k); err != nil {
+			return nil, err
+		}
+	}
+	return ks, nil
+}
+
+func (ks *JWTKeySet) add(k *JWTKey) error {
+	if _, dup := ks.keys[k.ID]; dup {
+		return fmt.Errorf("duplicate JWT kid %q", k.ID)
+	}
+	ks.keys[k.ID] = k
+	return nil
+}
+
+// jwtKeySettings are the raw JWT_* settings a keyset is built from.
+type jwtKeySettings struct {
+	Alg            string // JWT_ALG
+	KeyID          string // JWT_KEY_ID
+	Secret         string // JWT_SECRET
+	PrivateKeyFile string // JWT_PRIVATE_KEY_FILE
+	VerifyKeys     string // JWT_VERIFY_KEYS, comma-separated kid:secret
+	PublicKeyFiles string // JWT_PUBLIC_KEY_FILES, comma-separated kid:path
+}
+
+// newJWTKeySet builds a keyset whose active key signs with s.Alg. HS256 uses
+// JWT_SECRET; EdDSA and RS256 load a PEM private key from JWT_PRIVATE_KEY_FILE.
+func newJWTKeySet(s jwtKeySettings) (*JWTKeySet, error) {
+	active := &JWTKey{ID: s.KeyID, Alg: s.Alg}
+	switch s.Alg {
+	case AlgHS256:
+		active.Secret = []byte(s.Secret)
+	case AlgEdDSA, AlgRS256:
+		if s.PrivateKeyFile == "" {
+			return nil, fmt.Errorf("JWT_PRIVATE_KEY_FILE is required for JWT_ALG=%s", s.Alg)
+		}
+		priv, err := loadPrivateKey(s.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if alg, err := algForPublicKey(priv.Public()); err != nil || alg != s.Alg {
+			return nil, fmt.Errorf("JWT_PRIVATE_KEY_FILE does not hold a %s key", s.Alg)
+		}
+		active.PrivateKey = priv
+		active.PublicKey = priv.Public()
+	default:
+		return nil, fmt.Errorf("unsupported JWT_ALG %q: want HS256, EdDSA or RS256", s.Alg)
+	}
+
+	ks, err := NewJWTKeySet(active)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range splitTrimmed(s.VerifyKeys) {
+		kid, secret, err := splitKeyEntry("JWT_VERIFY_KEYS", entry)
+		if err != nil {
+			return nil, err
+		}
+		if err := ks.add(&JWTKey{ID: kid, Alg: AlgHS256, Secret: []byte(secret)}); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, entry := range splitTrimmed(s.PublicKeyFiles) {
+		kid, path, err := splitKeyEntry("JWT_PUBLIC_KEY_FILES", entry)
+		if err != nil {
+			return nil, err
+		}
+		pub, err := loadPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+		alg, err := algForPublicKey(pub)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if err := ks.add(&JWTKey{ID: kid, Alg: alg, PublicKey: pub}); err != nil {
+			return nil, err
+		}
+	}
+	return ks, nil
+}
+
+func splitKeyEntry(setting, entry string) (string, string, error) {
+	kid, value, ok := strings.Cut(entry, ":")
+	kid, value = strings.TrimSpace(kid), strings.TrimSpace(value)
+	if !ok || kid == "" || value == "" {
+		return "", "", fmt.Errorf("%s entry %q must be kid:value", setting, entry)
+	}
+	return kid, value, nil
+}
+
+func algForPublicKey(pub crypto.PublicKey) (string, error) {
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		return AlgEdDSA, nil
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return "", fmt.Errorf("RSA key is %d bits, need at least 2048", k.N.BitLen())
+		}
+		return AlgRS256, nil
+	default:
+		return "", fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block found", path)
+	}
+	return block, nil
+}
+
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported private key type %T", path, key)
+	}
+	return signer, nil
+}
+
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key crypto.PublicKey
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
@@ -0,0 +1,153 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewJWTKeySetHMAC(t *testing.T) {
+	ks, err := newJWTKeySet(jwtKeySettings{
+		Alg: AlgHS256, KeyID: "2024-07", Secret: "new-secret",
+		VerifyKeys: " 2024-01:old-secret , 2023-07:older-secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks.Active.ID != "2024-07" || string(ks.Active.SigningKey().([]byte)) != "new-secret" {
+		t.Errorf("active key = %+v", ks.Active)
+	}
+	for kid, secret := range map[string]string{"2024-01": "old-secret", "2023-07": "older-secret"} {
+		k, ok := ks.Lookup(kid)
+		if !ok || k.Alg != AlgHS256 || string(k.VerifyKey().([]byte)) != secret {
+			t.Errorf("Lookup(%s) = %+v, %v", kid, k, ok)
+		}
+	}
+	if _, ok := ks.Lookup("2022-01"); ok {
+		t.Error("Lookup found a kid that was never configured")
+	}
+	if keys := ks.PublicKeys(); len(keys) != 0 {
+		t.Errorf("PublicKeys lists %d HMAC keys", len(keys))
+	}
+}
+
+func TestNewJWTKeySetErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		s    jwtKeySettings
+		want string
+	}{
+		{"unknown alg", jwtKeySettings{Alg: "HS512", KeyID: "a"}, `unsupported JWT_ALG "HS512"`},
+		{"none", jwtKeySettings{Alg: "none", KeyID: "a"}, `unsupported JWT_ALG "none"`},
+		{"verify key without kid", jwtKeySettings{Alg: AlgHS256, KeyID: "a", Secret: "x", VerifyKeys: "secret"}, "must be kid:value"},
+		{"verify key without secret", jwtKeySettings{Alg: AlgHS256, KeyID: "a", Secret: "x", VerifyKeys: "b:"}, "must be kid:value"},
+		{"verify key reusing the active kid", jwtKeySettings{Alg: AlgHS256, KeyID: "a", Secret: "x", VerifyKeys: "a:y"}, `duplicate JWT kid "a"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newJWTKeySet(tt.s)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("newJWTKeySet = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// writePEM writes one PEM block to a file in dir and returns its path.
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewJWTKeySetPEM(t *testing.T) {
+	dir := t.TempDir()
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsPriv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smallRSA, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8 := func(k interface{}) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+	pkix := func(k interface{}) []byte {
+		der, err := x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+	edKey := writePEM(t, dir, "ed.pem", "PRIVATE KEY", pkcs8(edPriv))
+	rsKey := writePEM(t, dir, "rs.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsPriv))
+	edPubFile := writePEM(t, dir, "ed.pub", "PUBLIC KEY", pkix(edPub))
+	rsPubFile := writePEM(t, dir, "rs.pub", "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&rsPriv.PublicKey))
+	smallPub := writePEM(t, dir, "small.pub", "PUBLIC KEY", pkix(&smallRSA.PublicKey))
+
+	ks, err := newJWTKeySet(jwtKeySettings{
+		Alg: AlgEdDSA, KeyID: "ed-new", PrivateKeyFile: edKey,
+		PublicKeyFiles: "rs-old:" + rsPubFile + ", ed-old:" + edPubFile,
+		VerifyKeys:     "hs-old:secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks.Active.Alg != AlgEdDSA || !edPub.Equal(ks.Active.PublicKey) {
+		t.Errorf("active key = %+v", ks.Active)
+	}
+	if k, ok := ks.Lookup("rs-old"); !ok || k.Alg != AlgRS256 || !rsPriv.PublicKey.Equal(k.PublicKey) {
+		t.Errorf("Lookup(rs-old) = %+v, %v", k, ok)
+	}
+	var kids []string
+	for _, k := range ks.PublicKeys() {
+		kids = append(kids, k.ID)
+	}
+	if got := strings.Join(kids, ","); got != "ed-new,ed-old,rs-old" {
+		t.Errorf("PublicKeys = %s, want the asymmetric keys in kid order", got)
+	}
+
+	ks, err = newJWTKeySet(jwtKeySettings{Alg: AlgRS256, KeyID: "rs", PrivateKeyFile: rsKey})
+	if err != nil || ks.Active.Alg != AlgRS256 {
+		t.Errorf("RS256 from a PKCS #1 key: %+v, %v", ks, err)
+	}
+
+	tests := []struct {
+		name string
+		s    jwtKeySettings
+		want string
+	}{
+		{"no private key file", jwtKeySettings{Alg: AlgEdDSA, KeyID: "a"}, "JWT_PRIVATE_KEY_FILE is required"},
+		{"key of the other alg", jwtKeySettings{Alg: AlgRS256, KeyID: "a", PrivateKeyFile: edKey}, "does not hold a RS256 key"},
+		{"public key as private key", jwtKeySettings{Alg: AlgEdDSA, KeyID: "a", PrivateKeyFile: edPubFile}, `unsupported PEM block "PUBLIC KEY"`},
+		{"missing file", jwtKeySettings{Alg: AlgEdDSA, KeyID: "a", PrivateKeyFile: filepath.Join(dir, "none.pem")}, "no such file"},
+		{"short RSA public key", jwtKeySettings{Alg: AlgEdDSA, KeyID: "a", PrivateKeyFile: edKey, PublicKeyFiles: "b:" + smallPub}, "1024 bits, need at least 2048"},
+		{"public key entry without path", jwtKeySettings{Alg: AlgEdDSA, KeyID: "a", PrivateKeyFile: edKey, PublicKeyFiles: "b"}, "must be kid:value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newJWTKeySet(tt.s)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("newJWTKeySet = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
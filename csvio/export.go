@@ -0,0 +1,134 @@
+package csvio
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// ExportOptions control an Export. From and To are inclusive YYYY-MM-DD
+// dates and only apply to tables and views with a date.
+type ExportOptions struct {
+	Name     string
+	From, To string
+}
+
+// Export writes a table or view as CSV with a header row of column names, in
+// key order, and returns the number of data rows. The output reads back in
+// with Import unchanged.
+func Export(ctx context.Context, db bun.IDB, w io.Writer, opts ExportOptions) (int, error) {
+	query, dateExpr, order, err := exportQuery(db, opts.Name)
+	if err != nil {
+		return 0, err
+	}
+
+	var where []string
+	var args []interface{}
+	for _, f := range []struct{ op, val string }{{">=", opts.From}, {"<=", opts.To}} {
+		if f.val == "" {
+			continue
+		}
+		if dateExpr == "" {
+			return 0, fmt.Errorf("%w: %s has no date to filter on", ErrInvalid, opts.Name)
+		}
+		if _, err := time.Parse(time.DateOnly, f.val); err != nil {
+			return 0, fmt.Errorf("%w: bad date %q: want YYYY-MM-DD", ErrInvalid, f.val)
+		}
+		where = append(where, dateExpr+" "+f.op+" ?")
+		args = append(args, f.val)
+	}
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY " + order
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(cols); err != nil {
+		return 0, err
+	}
+	vals := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	rec := make([]string, len(cols))
+	n := 0
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return n, err
+		}
+		for i, v := range vals {
+			rec[i] = formatValue(v)
+		}
+		if err := cw.Write(rec); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	cw.Flush()
+	return n, cw.Error()
+}
+
+// exportQuery returns the SELECT for a table or view without WHERE or ORDER
+// BY, the expression its date filters apply to, if any, and its order.
+func exportQuery(db bun.IDB, name string) (query, dateExpr, order string, err error) {
+	if v, ok := views[name]; ok {
+		return v.query, v.date, v.order, nil
+	}
+	t, err := Lookup(name)
+	if err != nil {
+		return "", "", "", err
+	}
+	fields := t.fields(db)
+	cols := make([]string, len(fields))
+	for i, f := range fields {
+		cols[i] = string(f.SQLName)
+		switch {
+		case f.IsPK:
+			order = string(f.SQLName)
+		case f.Name == "date":
+			dateExpr = string(f.SQLName)
+		}
+	}
+	return fmt.Sprintf("SELECT %s FROM %s", strings.Join(cols, ", "), t.Name), dateExpr, order, nil
+}
+
+// formatValue renders a driver value as Import expects to read it back.
+func formatValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(x)
+	case string:
+		return x
+	case bool:
+		return strconv.FormatBool(x)
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case time.Time:
+		return x.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,386 @@
+package csvio
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/schema"
+)
+
+// Tracker is told about each row before it is written, normally to record an
+// audit trail. A nil Tracker is allowed.
+type Tracker interface {
+	Track(ctx context.Context, table, where string, args ...interface{}) error
+}
+
+// ImportOptions control an Import.
+type ImportOptions struct {
+	Table string
+	// Mapping maps CSV headers to columns; "-" skips a header. Headers that
+	// are not mapped must match a column or JSON field name.
+	Mapping map[string]string
+	// DryRun writes every row so database constraints are checked too, but
+	// the caller rolls the transaction back.
+	DryRun bool
+}
+
+// ImportReport says what an import did, or would do in a dry run.
+type ImportReport struct {
+	Table     string     `json:"table"`
+	DryRun    bool       `json:"dryRun"`
+	Rows      int        `json:"rows"`
+	Inserted  int        `json:"inserted"`
+	Updated   int        `json:"updated"`
+	Unchanged int        `json:"unchanged"`
+	Errors    []RowError `json:"errors,omitempty"`
+}
+
+// OK reports whether every row was imported cleanly. Callers commit only
+// when it is true and the import is not a dry run.
+func (r *ImportReport) OK() bool { return len(r.Errors) == 0 }
+
+// RowError is a problem with one CSV line.
+type RowError struct {
+	Line    int    `json:"line"`
+	Column  string `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e RowError) Error() string {
+	if e.Column == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+	}
+	return fmt.Sprintf("line %d: %s: %s", e.Line, e.Column, e.Message)
+}
+
+// Import reads a CSV file with a header row and upserts each line into
+// opts.Table on the table's key. Lines that exist are updated only in the
+// columns present in the file, bumping version where the table has one;
+// new lines are inserted and need every NOT NULL column. Each line is
+// written under its own savepoint in tx so that one bad line is reported
+// without hiding the rest. A missing header row or an unknown header is
+// returned as an error wrapping ErrInvalid.
+func Import(ctx context.Context, tx bun.Tx, r io.Reader, opts ImportOptions, track Tracker) (*ImportReport, error) {
+	t, err := Lookup(opts.Table)
+	if err != nil {
+		return nil, err
+	}
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: read header: %v", ErrInvalid, err)
+	}
+	header = append([]string(nil), header...)
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff") // spreadsheet BOM
+	}
+	fields, err := t.columnsFor(tx, header, opts.Mapping)
+	if err != nil {
+		return nil, err
+	}
+	w := newRowWriter(tx, t, fields)
+
+	report := &ImportReport{Table: t.Name, DryRun: opts.DryRun}
+	seen := map[string]int{}
+	for {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var pe *csv.ParseError
+		if errors.As(err, &pe) {
+			report.Rows++
+			report.Errors = append(report.Errors, RowError{Line: pe.Line, Message: pe.Err.Error()})
+			if errors.Is(pe.Err, csv.ErrFieldCount) {
+				continue
+			}
+			break // the rest of the file cannot be read reliably
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.Rows++
+		line, _ := cr.FieldPos(0)
+
+		vals, rowErr := parseRow(fields, header, rec)
+		if rowErr != nil {
+			rowErr.Line = line
+			report.Errors = append(report.Errors, *rowErr)
+			continue
+		}
+		key := fmt.Sprint(w.keyArgs(vals)...)
+		if first, dup := seen[key]; dup {
+			report.Errors = append(report.Errors, RowError{Line: line, Message: fmt.Sprintf("same %s as line %d", strings.Join(t.Key, ", "), first)})
+			continue
+		}
+		seen[key] = line
+
+		outcome, err := w.write(ctx, vals, track)
+		if err != nil {
+			report.Errors = append(report.Errors, RowError{Line: line, Message: err.Error()})
+			continue
+		}
+		switch outcome {
+		case inserted:
+			report.Inserted++
+		case updated:
+			report.Updated++
+		default:
+			report.Unchanged++
+		}
+	}
+
+	if report.Inserted > 0 && w.pk != nil && w.pk.AutoIncrement {
+		if err := w.syncSequence(ctx); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// parseRow converts a CSV record into values for the mapped fields; skipped
+// columns are nil entries in fields and left out.
+func parseRow(fields []*schema.Field, header, rec []string) ([]interface{}, *RowError) {
+	vals := make([]interface{}, 0, len(fields))
+	for i, f := range fields {
+		if f == nil {
+			continue
+		}
+		v, err := parseValue(f, rec[i])
+		if err != nil {
+			return nil, &RowError{Column: header[i], Message: err.Error()}
+		}
+		vals = append(vals, v)
+	}
+	return vals, nil
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+
+// parseValue converts one cell to a value for f. An empty cell is NULL for
+// pointer fields and an error for other non-string fields.
+func parseValue(f *schema.Field, s string) (interface{}, error) {
+	typ := f.IndirectType
+	s = strings.TrimSpace(s)
+	if s == "" {
+		switch {
+		case f.IsPtr:
+			return nil, nil
+		case typ.Kind() == reflect.String:
+			return "", nil
+		}
+		return nil, errors.New("a value is required")
+	}
+
+	if typ == rawMessageType {
+		if !json.Valid([]byte(s)) {
+			return nil, errors.New("not valid JSON")
+		}
+		return s, nil
+	}
+	if typ == reflect.TypeOf(time.Time{}) {
+		ts, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an RFC 3339 time", s)
+		}
+		return ts, nil
+	}
+	switch typ.Kind() {
+	case reflect.String:
+		if f.UserSQLType == "date" {
+			if _, err := time.Parse(time.DateOnly, s); err != nil {
+				return nil, fmt.Errorf("%q is not a date (YYYY-MM-DD)", s)
+			}
+		}
+		return s, nil
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a whole number", s)
+		}
+		return n, nil
+	case reflect.Float32, reflect.Float64:
+		x, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", s)
+		}
+		return x, nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.ToLower(s))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not true or false", s)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("cannot import a %s column", typ)
+}
+
+type outcome int
+
+const (
+	unchanged outcome = iota
+	inserted
+	updated
+)
+
+// rowWriter upserts parsed rows into one table.
+type rowWriter struct {
+	tx        bun.Tx
+	table     *Table
+	cols      []*schema.Field // the fields present in the file, in file order
+	key       []int           // indexes into cols of the key columns
+	pk        *schema.Field
+	versioned bool
+}
+
+func newRowWriter(tx bun.Tx, t *Table, fields []*schema.Field) *rowWriter {
+	w := &rowWriter{tx: tx, table: t}
+	for _, f := range fields {
+		if f != nil {
+			w.cols = append(w.cols, f)
+		}
+	}
+	for _, k := range t.Key {
+		for i, f := range w.cols {
+			if f.Name == k {
+				w.key = append(w.key, i)
+			}
+		}
+	}
+	for _, f := range t.fields(tx) {
+		if f.IsPK {
+			w.pk = f
+		}
+		if f.Name == "version" {
+			w.versioned = true
+		}
+	}
+	return w
+}
+
+func (w *rowWriter) keyArgs(vals []interface{}) []interface{} {
+	args := make([]interface{}, len(w.key))
+	for i, k := range w.key {
+		args[i] = vals[k]
+	}
+	return args
+}
+
+func (w *rowWriter) keyWhere() string {
+	parts := make([]string, len(w.key))
+	for i, k := range w.key {
+		parts[i] = string(w.cols[k].SQLName) + " = ?"
+	}
+	return strings.Join(parts, " AND ")
+}
+
+// write upserts one row under a savepoint, rolling back to it on error.
+func (w *rowWriter) write(ctx context.Context, vals []interface{}, track Tracker) (outcome, error) {
+	for _, k := range w.key {
+		if vals[k] == nil {
+			return 0, fmt.Errorf("key column %s is empty", w.cols[k].Name)
+		}
+	}
+	if _, err := w.tx.ExecContext(ctx, "SAVEPOINT csv_row"); err != nil {
+		return 0, err
+	}
+	out, err := w.upsert(ctx, vals, track)
+	if err != nil {
+		if _, rbErr := w.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT csv_row"); rbErr != nil {
+			return 0, errors.Join(err, rbErr)
+		}
+		return 0, err
+	}
+	_, err = w.tx.ExecContext(ctx, "RELEASE SAVEPOINT csv_row")
+	return out, err
+}
+
+func (w *rowWriter) upsert(ctx context.Context, vals []interface{}, track Tracker) (outcome, error) {
+	where, keyArgs := w.keyWhere(), w.keyArgs(vals)
+	if track != nil {
+		if err := track.Track(ctx, w.table.Name, where, keyArgs...); err != nil {
+			return 0, err
+		}
+	}
+
+	// Key columns only identify the row, a primary key found through another
+	// key is not rewritten, and version is bumped rather than set.
+	var set, cols, marks []string
+	var setArgs []interface{}
+	isKey := map[int]bool{}
+	for _, k := range w.key {
+		isKey[k] = true
+	}
+	for i, f := range w.cols {
+		if isKey[i] || f.IsPK || (w.versioned && f.Name == "version") {
+			continue
+		}
+		set = append(set, string(f.SQLName)+" = ?")
+		cols = append(cols, string(f.SQLName))
+		marks = append(marks, "?")
+		setArgs = append(setArgs, vals[i])
+	}
+
+	if len(set) > 0 {
+		bump := ""
+		if w.versioned {
+			bump = ", version = version + 1"
+		}
+		args := append(append(append([]interface{}{}, setArgs...), keyArgs...), setArgs...)
+		res, err := w.tx.ExecContext(ctx, fmt.Sprintf(
+			"UPDATE %s SET %s%s WHERE %s AND (%s) IS DISTINCT FROM (%s)",
+			w.table.Name, strings.Join(set, ", "), bump, where,
+			strings.Join(cols, ", "), strings.Join(marks, ", "),
+		), args...)
+		if err != nil {
+			return 0, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			return updated, nil
+		}
+	}
+
+	var exists bool
+	if err := w.tx.NewRaw(fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE %s)", w.table.Name, where), keyArgs...).
+		Scan(ctx, &exists); err != nil {
+		return 0, err
+	}
+	if exists {
+		return unchanged, nil
+	}
+
+	names := make([]string, len(w.cols))
+	marks = make([]string, len(w.cols))
+	for i, f := range w.cols {
+		names[i], marks[i] = string(f.SQLName), "?"
+	}
+	if _, err := w.tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		w.table.Name, strings.Join(names, ", "), strings.Join(marks, ", ")), vals...); err != nil {
+		return 0, err
+	}
+	return inserted, nil
+}
+
+// syncSequence moves the primary key's sequence past rows inserted with
+// explicit keys, so later inserts that rely on it do not collide.
+func (w *rowWriter) syncSequence(ctx context.Context) error {
+	for _, f := range w.cols {
+		if f == w.pk {
+			_, err := w.tx.ExecContext(ctx, fmt.Sprintf(
+				"SELECT setval(pg_get_serial_sequence(?, ?), GREATEST((SELECT max(%s) FROM %s), 1))",
+				f.SQLName, w.table.Name), w.table.Name, f.Name)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// Package csvio imports CSV files into the race data tables and exports
+// tables, or the joined results view, back to CSV. It backs cmd/csv and the
+// /rp/admin/csv endpoints.
+//
+// Only the race data tables can be imported. The audit log and revisions can
+// be exported but never imported, so history cannot be rewritten through CSV.
+// Users, API keys and refresh tokens are left out altogether: they hold
+// password and key hashes and are managed through their own commands and
+// endpoints.
+package csvio
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/schema"
+
+	"github.com/padraicbc/mikeapi/models"
+)
+
+// ErrInvalid marks errors in what was asked for, such as an unknown table or
+// header, as opposed to database failures.
+var ErrInvalid = errors.New("csvio")
+
+// Table is a table CSV can be imported into and exported from. Imports
+// upsert on Key, one of the table's unique constraints.
+type Table struct {
+	Name  string
+	Key   []string
+	model interface{}
+}
+
+var tables = []Table{
+	{Name: "courses", Key: []string{"course"}, model: (*models.Course)(nil)},
+	{Name: "horses", Key: []string{"horse"}, model: (*models.Horse)(nil)},
+	{Name: "trainers", Key: []string{"trainer"}, model: (*models.Trainer)(nil)},
+	{Name: "races", Key: []string{"course_id", "date", "time"}, model: (*models.Race)(nil)},          // races_no_dupes
+	{Name: "pre_race", Key: []string{"race_id"}, model: (*models.PreRace)(nil)},                      // pre_race_no_dupes
+	{Name: "intermediary", Key: []string{"race_id", "horse_id"}, model: (*models.Intermediary)(nil)}, // intermediary_no_dupes
+	{Name: "results", Key: []string{"race_id", "horse_id"}, model: (*models.Result)(nil)},            // results_no_dupes
+}
+
+// views are read-only queries that can be exported like tables. date is the
+// expression -from and -to filter on: the race date, or for the history
+// tables the UTC day the row was written.
+var views = map[string]struct{ query, date, order string }{
+	"results_view": {
+		query: models.ResultsJoinSQL,
+		date:  "rc.date",
+		order: "rc.date, rc.race_id, LENGTH(r.placed), r.placed",
+	},
+	"audit_log": {
+		query: "SELECT id, username, user_hash, endpoint, table_name, race_id, result_id, before, after, created_at FROM audit_log",
+		date:  "(created_at AT TIME ZONE 'UTC')::date",
+		order: "id",
+	},
+	"revisions": {
+		query: "SELECT id, race_id, username, endpoint, snapshot, created_at FROM revisions",
+		date:  "(created_at AT TIME ZONE 'UTC')::date",
+		order: "id",
+	},
+}
+
+// Names lists the tables and views, tables first.
+func Names() []string {
+	names := make([]string, 0, len(tables)+len(views))
+	for _, t := range tables {
+		names = append(names, t.Name)
+	}
+	var vs []string
+	for name := range views {
+		vs = append(vs, name)
+	}
+	sort.Strings(vs)
+	return append(names, vs...)
+}
+
+// Lookup returns the importable table called name.
+func Lookup(name string) (*Table, error) {
+	for i := range tables {
+		if tables[i].Name == name {
+			return &tables[i], nil
+		}
+	}
+	if _, ok := views[name]; ok {
+		return nil, fmt.Errorf("%w: %s is read-only and can only be exported", ErrInvalid, name)
+	}
+	return nil, fmt.Errorf("%w: unknown table %q: want one of %s", ErrInvalid, name, strings.Join(Names(), ", "))
+}
+
+// fields are the table's columns, primary key first, from its bun model.
+func (t *Table) fields(db bun.IDB) []*schema.Field {
+	return db.Dialect().Tables().Get(reflect.TypeOf(t.model).Elem()).Fields
+}
+
+var nonAlnum = regexp.MustCompile(`[^a-z0-9]+`)
+
+// normHeader folds a header or column name so "Official Rat", "officialRat"
+// and "official_rat" all match.
+func normHeader(s string) string {
+	return nonAlnum.ReplaceAllString(strings.ToLower(s), "")
+}
+
+// columnsFor maps each CSV header to a field. mapping overrides the match by
+// column or JSON name, and maps a header to "-" to skip it; skipped headers
+// get a nil field.
+func (t *Table) columnsFor(db bun.IDB, header []string, mapping map[string]string) ([]*schema.Field, error) {
+	byName := map[string]*schema.Field{}
+	for _, f := range t.fields(db) {
+		byName[normHeader(f.Name)] = f
+		if js, _, _ := strings.Cut(f.StructField.Tag.Get("json"), ","); js != "" && js != "-" {
+			byName[normHeader(js)] = f
+		}
+	}
+
+	out := make([]*schema.Field, len(header))
+	used := map[string]string{}
+	for i, h := range header {
+		name, mapped := mapping[h]
+		if mapped && name == "-" {
+			continue
+		}
+		if !mapped {
+			name = h
+		}
+		f := byName[normHeader(name)]
+		if f == nil {
+			return nil, fmt.Errorf("%w: column %q: %s has no column %q; map it with header=column or header=- to skip it", ErrInvalid, h, t.Name, name)
+		}
+		if prev, dup := used[f.Name]; dup {
+			return nil, fmt.Errorf("%w: columns %q and %q both map to %s", ErrInvalid, prev, h, f.Name)
+		}
+		used[f.Name] = h
+		out[i] = f
+	}
+	for _, k := range t.Key {
+		if _, ok := used[k]; !ok {
+			return nil, fmt.Errorf("%w: %s imports upsert on %s; column %s is missing", ErrInvalid, t.Name, strings.Join(t.Key, ", "), k)
+		}
+	}
+	return out, nil
+}
+
+// ParseMapping reads header=column pairs separated by commas.
+func ParseMapping(s string) (map[string]string, error) {
+	m := map[string]string{}
+	if strings.TrimSpace(s) == "" {
+		return m, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		h, col, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(h) == "" || strings.TrimSpace(col) == "" {
+			return nil, fmt.Errorf("%w: bad mapping %q: want header=column", ErrInvalid, pair)
+		}
+		m[strings.TrimSpace(h)] = strings.TrimSpace(col)
+	}
+	return m, nil
+}
@@ -0,0 +1,28 @@
+package csvio
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestReadOnlyExports(t *testing.T) {
+	names := strings.Join(Names(), ",")
+	for _, name := range []string{"audit_log", "revisions", "results_view"} {
+		if !strings.Contains(","+names+",", ","+name+",") {
+			t.Errorf("Names() = %s, want %s listed", names, name)
+		}
+		_, err := Lookup(name)
+		if !errors.Is(err, ErrInvalid) || !strings.Contains(err.Error(), "can only be exported") {
+			t.Errorf("Lookup(%s) = %v, want it refused as read-only", name, err)
+		}
+	}
+	for _, name := range []string{"users", "api_keys", "refresh_tokens"} {
+		if _, err := Lookup(name); !errors.Is(err, ErrInvalid) || !strings.Contains(err.Error(), "unknown table") {
+			t.Errorf("Lookup(%s) = %v, want an unknown table", name, err)
+		}
+	}
+	if tb, err := Lookup("results"); err != nil || tb.Name != "results" {
+		t.Errorf("Lookup(results) = %v, %v", tb, err)
+	}
+}
@@ -3,7 +3,6 @@ package db
 import (
 	"context"
 	"database/sql"
-	"fmt"
 
 	"go.uber.org/zap"
 	"github.com/uptrace/bun"
@@ -12,54 +11,31 @@ import (
 	"github.com/uptrace/bun/extra/bundebug"
 
 	"github.com/padraicbc/mikeapi/config"
-	"github.com/padraicbc/mikeapi/models"
 )
 
-// Setup opens a PostgreSQL connection using the provided config.
+// Setup opens a PostgreSQL connection using the provided config, exiting if
+// the database cannot be reached.
 func Setup(cfg *config.Config) *bun.DB {
-	sqldb := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(cfg.PostgresDSN())))
-	db := bun.NewDB(sqldb, pgdialect.New())
-
-	if cfg.Debug {
-		db.AddQueryHook(bundebug.NewQueryHook(bundebug.WithVerbose(true)))
-	}
-
-	if err := db.PingContext(context.Background()); err != nil {
+	db, err := Open(context.Background(), cfg)
+	if err != nil {
 		zap.L().Fatal("failed to connect to database", zap.Error(err))
 	}
-
 	return db
 }
 
-// CreateTables creates all tables in dependency order.
-func CreateTables(ctx context.Context, db *bun.DB) error {
-	tables := []interface{}{
-		(*models.User)(nil),
-		(*models.Course)(nil),
-		(*models.Horse)(nil),
-		(*models.Race)(nil),
-		(*models.PreRace)(nil),
-		(*models.Trainer)(nil),
-		(*models.Intermediary)(nil),
-		(*models.Result)(nil),
-	}
+// Open is Setup for callers that handle the connection error themselves.
+func Open(ctx context.Context, cfg *config.Config) (*bun.DB, error) {
+	sqldb := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(cfg.PostgresDSN())))
+	db := bun.NewDB(sqldb, pgdialect.New())
 
-	for _, model := range tables {
-		if _, err := db.NewCreateTable().Model(model).IfNotExists().Exec(ctx); err != nil {
-			return fmt.Errorf("creating table for %T: %w", model, err)
-		}
+	if cfg.Debug {
+		db.AddQueryHook(bundebug.NewQueryHook(bundebug.WithVerbose(true)))
 	}
 
-	constraints := []string{
-		`DO $$ BEGIN IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'races_no_dupes') THEN ALTER TABLE races ADD CONSTRAINT races_no_dupes UNIQUE (course_id, date, time); END IF; END $$`,
-		`DO $$ BEGIN IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'intermediary_no_dupes') THEN ALTER TABLE intermediary ADD CONSTRAINT intermediary_no_dupes UNIQUE (race_id, horse_id); END IF; END $$`,
-		`DO $$ BEGIN IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'results_no_dupes') THEN ALTER TABLE results ADD CONSTRAINT results_no_dupes UNIQUE (race_id, horse_id); END IF; END $$`,
-	}
-	for _, stmt := range constraints {
-		if _, err := db.ExecContext(ctx, stmt); err != nil {
-			zap.L().Warn("constraint setup failed", zap.Error(err))
-		}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	return nil
+	return db, nil
 }
@@ -0,0 +1,194 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/uptrace/bun"
+)
+
+// IntegrityCheck finds rows of Table (aliased t) that break a relationship.
+// Repair either applies Fix as an UPDATE SET clause or, when Fix is empty,
+// deletes the rows. Manual checks are only reported.
+type IntegrityCheck struct {
+	Name        string
+	Description string
+	Table       string
+	Key         string
+	Where       string
+	Fix         string
+	Manual      bool
+	// Constraints that can be validated once no rows fail this check.
+	Constraints []string
+}
+
+// Action describes what Repair does to a failing row.
+func (ic IntegrityCheck) Action() string {
+	switch {
+	case ic.Manual:
+		return "manual"
+	case ic.Fix != "":
+		return "update " + ic.Fix
+	default:
+		return "delete"
+	}
+}
+
+// IntegrityChecks are run in order: orphans are removed before mismatches are
+// fixed so that a fix never reads from a row about to be deleted.
+var IntegrityChecks = []IntegrityCheck{
+	{
+		Name:        "races.course_id",
+		Description: "races whose course does not exist",
+		Table:       "races", Key: "race_id",
+		Where:       `NOT EXISTS (SELECT 1 FROM courses c WHERE c.course_id = t.course_id)`,
+		Manual:      true,
+		Constraints: []string{"races.races_course_fk"},
+	},
+	{
+		Name:        "results.race_id",
+		Description: "results whose race does not exist",
+		Table:       "results", Key: "id",
+		Where:       `NOT EXISTS (SELECT 1 FROM races rc WHERE rc.race_id = t.race_id)`,
+		Constraints: []string{"results.results_race_fk"},
+	},
+	{
+		Name:        "results.horse_id",
+		Description: "results whose horse does not exist",
+		Table:       "results", Key: "id",
+		Where:       `NOT EXISTS (SELECT 1 FROM horses h WHERE h.horse_id = t.horse_id)`,
+		Constraints: []string{"results.results_horse_fk"},
+	},
+	{
+		Name:        "results.course_id",
+		Description: "results whose course_id differs from their race's course_id",
+		Table:       "results", Key: "id",
+		Where:       `EXISTS (SELECT 1 FROM races rc WHERE rc.race_id = t.race_id AND rc.course_id <> t.course_id)`,
+		Fix:         `course_id = (SELECT rc.course_id FROM races rc WHERE rc.race_id = t.race_id)`,
+		Constraints: []string{"results.results_course_fk"},
+	},
+	{
+		Name:        "intermediary.race_id",
+		Description: "intermediary rows whose race does not exist",
+		Table:       "intermediary", Key: "id",
+		Where:       `NOT EXISTS (SELECT 1 FROM races rc WHERE rc.race_id = t.race_id)`,
+		Constraints: []string{"intermediary.intermediary_race_fk"},
+	},
+	{
+		Name:        "intermediary.horse_id",
+		Description: "intermediary rows whose horse does not exist",
+		Table:       "intermediary", Key: "id",
+		Where:       `NOT EXISTS (SELECT 1 FROM horses h WHERE h.horse_id = t.horse_id)`,
+		Constraints: []string{"intermediary.intermediary_horse_fk"},
+	},
+	{
+		Name:        "pre_race.race_id",
+		Description: "pre-race cards whose race does not exist",
+		Table:       "pre_race", Key: "id",
+		Where:       `NOT EXISTS (SELECT 1 FROM races rc WHERE rc.race_id = t.race_id)`,
+		Constraints: []string{"pre_race.pre_race_race_fk"},
+	},
+	{
+		Name:        "pre_race.course_id",
+		Description: "pre-race cards whose course differs from their race's course",
+		Table:       "pre_race", Key: "id",
+		Where: `EXISTS (SELECT 1 FROM races rc JOIN courses c ON c.course_id = rc.course_id
+			WHERE rc.race_id = t.race_id AND (rc.course_id <> t.course_id OR c.course <> t.course))`,
+		Fix: `course_id = (SELECT rc.course_id FROM races rc WHERE rc.race_id = t.race_id),
+			course = (SELECT c.course FROM races rc JOIN courses c ON c.course_id = rc.course_id WHERE rc.race_id = t.race_id)`,
+		Constraints: []string{"pre_race.pre_race_course_fk"},
+	},
+	{
+		Name:        "revisions.race_id",
+		Description: "revisions of races that no longer exist",
+		Table:       "revisions", Key: "id",
+		Where:       `NOT EXISTS (SELECT 1 FROM races rc WHERE rc.race_id = t.race_id)`,
+		Constraints: []string{"revisions.revisions_race_fk"},
+	},
+	{
+		Name:        "refresh_tokens.user_id",
+		Description: "refresh tokens of deleted users",
+		Table:       "refresh_tokens", Key: "id",
+		Where:       `NOT EXISTS (SELECT 1 FROM users u WHERE u.id = t.user_id)`,
+		Constraints: []string{"refresh_tokens.refresh_tokens_user_fk"},
+	},
+	{
+		Name:        "recovery_codes.user_id",
+		Description: "recovery codes of deleted users",
+		Table:       "recovery_codes", Key: "id",
+		Where:       `NOT EXISTS (SELECT 1 FROM users u WHERE u.id = t.user_id)`,
+		Constraints: []string{"recovery_codes.recovery_codes_user_fk"},
+	},
+}
+
+// Count returns the number of rows failing the check.
+func (ic IntegrityCheck) Count(ctx context.Context, db bun.IDB) (int, error) {
+	var n int
+	err := db.NewRaw(fmt.Sprintf(`SELECT count(*) FROM %s t WHERE %s`, ic.Table, ic.Where)).Scan(ctx, &n)
+	return n, err
+}
+
+// FailingRow is a row failing a check: its key and the row as JSON.
+type FailingRow struct {
+	Key int64  `bun:"key"`
+	Row string `bun:"row"`
+}
+
+// Rows returns up to limit failing rows ordered by key.
+func (ic IntegrityCheck) Rows(ctx context.Context, db bun.IDB, limit int) ([]FailingRow, error) {
+	var rows []FailingRow
+	err := db.NewRaw(fmt.Sprintf(
+		`SELECT t.%s AS key, row_to_json(t)::text AS row FROM %s t WHERE %s ORDER BY t.%[1]s LIMIT ?`,
+		ic.Key, ic.Table, ic.Where,
+	), limit).Scan(ctx, &rows)
+	return rows, err
+}
+
+// Repair fixes every failing row, or only the row with the given key when
+// key is non-nil, and returns the number of rows changed.
+func (ic IntegrityCheck) Repair(ctx context.Context, db bun.IDB, key *int64) (int64, error) {
+	if ic.Manual {
+		return 0, fmt.Errorf("%s must be repaired by hand", ic.Name)
+	}
+	where := ic.Where
+	var args []interface{}
+	if key != nil {
+		where = fmt.Sprintf("(%s) AND t.%s = ?", where, ic.Key)
+		args = append(args, *key)
+	}
+
+	var q string
+	if ic.Fix != "" {
+		q = fmt.Sprintf(`UPDATE %s AS t SET %s WHERE %s`, ic.Table, ic.Fix, where)
+	} else {
+		q = fmt.Sprintf(`DELETE FROM %s AS t WHERE %s`, ic.Table, where)
+	}
+	res, err := db.NewRaw(q, args...).Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// UnvalidatedConstraints returns the NOT VALID foreign keys as "table.constraint".
+func UnvalidatedConstraints(ctx context.Context, db bun.IDB) ([]string, error) {
+	var names []string
+	err := db.NewRaw(`
+		SELECT conrelid::regclass::text || '.' || conname
+		FROM pg_constraint
+		WHERE contype = 'f' AND NOT convalidated AND connamespace = 'public'::regnamespace
+		ORDER BY 1`).Scan(ctx, &names)
+	return names, err
+}
+
+// ValidateConstraint runs ALTER TABLE ... VALIDATE CONSTRAINT for a
+// "table.constraint" name returned by UnvalidatedConstraints.
+func ValidateConstraint(ctx context.Context, db bun.IDB, name string) error {
+	table, constraint, ok := strings.Cut(name, ".")
+	if !ok {
+		return fmt.Errorf("constraint %q must be table.constraint", name)
+	}
+	_, err := db.NewRaw(`ALTER TABLE ? VALIDATE CONSTRAINT ?`, bun.Ident(table), bun.Ident(constraint)).Exec(ctx)
+	return err
+}
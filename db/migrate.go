@@ -0,0 +1,303 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the pg_advisory_lock key held while migrations run so two
+// processes never apply the same migration concurrently.
+const migrationLockID int64 = 0x6d696b6561706931 // "mikeapi1"
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// Migration is one versioned schema change: a pair of files
+// NNNN_name.up.sql and NNNN_name.down.sql under db/migrations.
+// Each file runs in its own transaction.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationState is a migration and when it was applied, if it has been.
+// Missing is set for versions recorded in the database with no matching file.
+type MigrationState struct {
+	Migration
+	AppliedAt *time.Time
+	Missing   bool
+}
+
+// Migrations returns the migrations embedded in the binary, ordered by version.
+func Migrations() ([]Migration, error) {
+	return LoadMigrations(migrationFiles, "migrations")
+}
+
+// LoadMigrations reads and pairs the migration files in dir of fsys. Every
+// version must have both an up and a down file.
+func LoadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".sql") {
+			continue
+		}
+		m := migrationFileName.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("migration %s: name must be NNNN_name.up.sql or NNNN_name.down.sql", e.Name())
+		}
+		version, _ := strconv.ParseInt(m[1], 10, 64)
+		body, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	out := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if strings.TrimSpace(mig.Up) == "" || strings.TrimSpace(mig.Down) == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs non-empty up and down files", mig.Version, mig.Name)
+		}
+		out = append(out, *mig)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// MigrationStatus lists every known migration and whether it has been applied.
+func MigrationStatus(ctx context.Context, db bun.IDB) ([]MigrationState, error) {
+	migs, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]MigrationState, 0, len(migs))
+	for _, m := range migs {
+		st := MigrationState{Migration: m}
+		if at, ok := applied[m.Version]; ok {
+			st.AppliedAt = &at
+			delete(applied, m.Version)
+		}
+		out = append(out, st)
+	}
+	for version, at := range applied {
+		at := at
+		out = append(out, MigrationState{Migration: Migration{Version: version}, AppliedAt: &at, Missing: true})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// PendingMigrations returns the embedded migrations not yet applied, in order.
+func PendingMigrations(ctx context.Context, db bun.IDB) ([]Migration, error) {
+	states, err := MigrationStatus(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, st := range states {
+		if st.AppliedAt == nil {
+			pending = append(pending, st.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// CheckSchema returns an error naming the pending migrations, if any.
+func CheckSchema(ctx context.Context, db bun.IDB) error {
+	pending, err := PendingMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	names := make([]string, len(pending))
+	for i, m := range pending {
+		names[i] = fmt.Sprintf("%04d_%s", m.Version, m.Name)
+	}
+	return fmt.Errorf("database schema is behind: %d pending migration(s): %s; run dbmigrate up",
+		len(pending), strings.Join(names, ", "))
+}
+
+// MigrateUp applies up to steps pending migrations in version order, or all of
+// them when steps is zero, and returns the ones applied. adminUsers are the
+// usernames promoted to admin when 0001 adds roles to an existing users table;
+// they are the ADMIN_USERS that granted admin access before roles were stored.
+func MigrateUp(ctx context.Context, db *bun.DB, steps int, adminUsers []string) ([]Migration, error) {
+	admins := make([]string, len(adminUsers))
+	for i, u := range adminUsers {
+		admins[i] = strings.ToLower(strings.TrimSpace(u))
+	}
+	var done []Migration
+	err := withMigrationLock(ctx, db, func(conn bun.Conn) error {
+		pending, err := PendingMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if steps > 0 && steps < len(pending) {
+			pending = pending[:steps]
+		}
+		for _, m := range pending {
+			if err := runMigration(ctx, conn, strings.Join(admins, ","), m.Up,
+				`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.Version, m.Name,
+			); err != nil {
+				return fmt.Errorf("migration %04d_%s up: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// MigrateDown reverts the steps most recently applied migrations, newest first,
+// and returns the ones reverted. It stops at the first migration whose down
+// script fails, as the baseline's always does.
+func MigrateDown(ctx context.Context, db *bun.DB, steps int) ([]Migration, error) {
+	var done []Migration
+	err := withMigrationLock(ctx, db, func(conn bun.Conn) error {
+		states, err := MigrationStatus(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(states) - 1; i >= 0 && len(done) < steps; i-- {
+			st := states[i]
+			if st.AppliedAt == nil {
+				continue
+			}
+			if st.Missing {
+				return fmt.Errorf("migration %d is applied but this binary has no file for it", st.Version)
+			}
+			if err := runMigration(ctx, conn, "", st.Down,
+				`DELETE FROM schema_migrations WHERE version = ?`, st.Version,
+			); err != nil {
+				return fmt.Errorf("migration %04d_%s down: %w", st.Version, st.Name, err)
+			}
+			done = append(done, st.Migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// runMigration executes a migration script and its bookkeeping statement in one
+// transaction. admins is visible to the script as mikeapi.admin_users.
+func runMigration(ctx context.Context, conn bun.Conn, admins, script, record string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if _, err := tx.ExecContext(ctx, `SELECT set_config('mikeapi.admin_users', ?, true)`, admins); err != nil {
+		return err
+	}
+	// Run the script on the underlying *sql.Tx so bun does not treat '?' in
+	// the SQL (such as jsonb operators) as placeholders.
+	if _, err := tx.Tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// withMigrationLock runs fn on a single connection holding the migration
+// advisory lock, creating schema_migrations first if needed.
+func withMigrationLock(ctx context.Context, db *bun.DB, fn func(conn bun.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock(?)`, migrationLockID); err != nil {
+		return fmt.Errorf("acquire migration lock: %w", err)
+	}
+	defer func() {
+		_, _ = conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock(?)`, migrationLockID)
+	}()
+
+	if _, err := conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    bigint PRIMARY KEY,
+			name       varchar NOT NULL,
+			applied_at timestamptz NOT NULL DEFAULT current_timestamp
+		)`); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// appliedMigrations returns applied versions and when they were applied. A
+// database without schema_migrations has applied nothing.
+func appliedMigrations(ctx context.Context, db bun.IDB) (map[int64]time.Time, error) {
+	var exists bool
+	if err := db.NewRaw(`SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(ctx, &exists); err != nil {
+		return nil, err
+	}
+	applied := map[int64]time.Time{}
+	if !exists {
+		return applied, nil
+	}
+
+	var rows []struct {
+		Version   int64     `bun:"version"`
+		AppliedAt time.Time `bun:"applied_at"`
+	}
+	if err := db.NewRaw(`SELECT version, applied_at FROM schema_migrations`).Scan(ctx, &rows); err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		applied[r.Version] = r.AppliedAt
+	}
+	return applied, nil
+}
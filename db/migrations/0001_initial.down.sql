@@ -0,0 +1,10 @@
+-- 0001 is the baseline: it adopted a database that already held users and
+-- racing data, so reverting it would drop all of that. It cannot be
+-- reverted; drop the tables by hand if that is really what you want.
+
+DO $$
+BEGIN
+	RAISE EXCEPTION '0001_initial is the baseline schema and cannot be reverted'
+		USING HINT = 'Revert later migrations with a smaller -steps.';
+END
+$$;
@@ -0,0 +1,225 @@
+-- Baseline schema. Every statement is idempotent so that databases created
+-- by the old db.CreateTables can be brought under migration control.
+
+CREATE TABLE IF NOT EXISTS users (
+	id             bigserial PRIMARY KEY,
+	username       varchar NOT NULL UNIQUE,
+	password       varchar NOT NULL,
+	role           varchar NOT NULL DEFAULT 'viewer',
+	disabled       boolean NOT NULL DEFAULT false,
+	totp_secret    varchar,
+	totp_enabled   boolean NOT NULL DEFAULT false,
+	totp_last_step bigint NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS courses (
+	course_id bigserial PRIMARY KEY,
+	course    varchar NOT NULL UNIQUE,
+	direction varchar NOT NULL,
+	is_aw     boolean NOT NULL,
+	code      varchar NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS horses (
+	horse_id           bigserial PRIMARY KEY,
+	horse              varchar NOT NULL UNIQUE,
+	last_win_id        bigint,
+	highest_win_weight bigint DEFAULT 0,
+	last_win_weight    bigint DEFAULT 0,
+	last_run_weight    bigint DEFAULT 0,
+	last_win_claim     bigint DEFAULT 0,
+	last_run_claim     bigint DEFAULT 0,
+	highest_win_or     bigint DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS races (
+	race_id      bigserial PRIMARY KEY,
+	course_id    bigint NOT NULL,
+	date         date NOT NULL,
+	time         varchar NOT NULL,
+	url          varchar NOT NULL,
+	class        varchar,
+	distance     double precision NOT NULL,
+	going        varchar NOT NULL,
+	mr           bigint,
+	mr2          bigint,
+	analysed     boolean NOT NULL DEFAULT false,
+	pre_done     boolean NOT NULL DEFAULT false,
+	main_comment varchar,
+	amended      boolean NOT NULL DEFAULT false,
+	version      bigint NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS pre_race (
+	id        bigserial PRIMARY KEY,
+	runners   jsonb NOT NULL,
+	course    varchar NOT NULL,
+	course_id bigint NOT NULL,
+	date      date NOT NULL,
+	time      varchar NOT NULL,
+	race_id   bigint NOT NULL,
+	direction varchar NOT NULL,
+	distance  double precision NOT NULL,
+	class     varchar NOT NULL,
+	url       varchar NOT NULL,
+	CONSTRAINT pre_race_no_dupes UNIQUE (race_id)
+);
+
+CREATE TABLE IF NOT EXISTS trainers (
+	trainer_id bigserial PRIMARY KEY,
+	trainer    varchar NOT NULL UNIQUE,
+	info       varchar
+);
+
+CREATE TABLE IF NOT EXISTS intermediary (
+	id         bigserial PRIMARY KEY,
+	horse_id   bigint NOT NULL,
+	race_id    bigint NOT NULL,
+	mr_plus_or bigint,
+	tfr        varchar
+);
+
+CREATE TABLE IF NOT EXISTS results (
+	id                 bigserial PRIMARY KEY,
+	horse_id           bigint NOT NULL,
+	course_id          bigint NOT NULL,
+	race_id            bigint NOT NULL,
+	age                bigint NOT NULL,
+	price              varchar NOT NULL,
+	trainer            varchar NOT NULL,
+	jockey             varchar NOT NULL,
+	number             bigint NOT NULL,
+	headgear           varchar,
+	placed             varchar NOT NULL,
+	pace               varchar,
+	official_rat       bigint,
+	win_dist           double precision,
+	dist_behind_winner double precision,
+	weight_carried     bigint NOT NULL,
+	card_weight        bigint NOT NULL,
+	claim              bigint,
+	rpr                bigint,
+	ts                 bigint,
+	mr_plus_or         bigint,
+	mr2_plus_or        bigint,
+	wc_mr2_plus_or     bigint,
+	wc_mr1_plus_or     bigint,
+	tot_rpr            bigint,
+	tfr                varchar,
+	tfsf               bigint,
+	tfsf_minus_or      bigint,
+	sec_t              double precision,
+	speed_per          double precision,
+	comment            varchar,
+	analysed           boolean NOT NULL DEFAULT false,
+	version            bigint NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	id         bigserial PRIMARY KEY,
+	user_id    bigint NOT NULL,
+	session_id varchar NOT NULL,
+	token_hash varchar NOT NULL UNIQUE,
+	expires_at timestamptz NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT current_timestamp,
+	revoked_at timestamptz
+);
+
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+	jti        varchar PRIMARY KEY,
+	expires_at timestamptz NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+	id           bigserial PRIMARY KEY,
+	name         varchar NOT NULL,
+	prefix       varchar NOT NULL UNIQUE,
+	key_hash     varchar NOT NULL,
+	scopes       varchar[] NOT NULL,
+	created_by   varchar NOT NULL,
+	created_at   timestamptz NOT NULL DEFAULT current_timestamp,
+	expires_at   timestamptz,
+	last_used_at timestamptz,
+	revoked_at   timestamptz
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+	id        bigserial PRIMARY KEY,
+	user_id   bigint NOT NULL,
+	code_hash varchar NOT NULL,
+	used_at   timestamptz
+);
+
+CREATE TABLE IF NOT EXISTS role_policies (
+	role         varchar PRIMARY KEY,
+	require_totp boolean NOT NULL DEFAULT false
+);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+	id         bigserial PRIMARY KEY,
+	username   varchar NOT NULL,
+	user_hash  varchar,
+	endpoint   varchar NOT NULL,
+	table_name varchar NOT NULL,
+	race_id    bigint,
+	result_id  bigint,
+	before     jsonb,
+	after      jsonb,
+	created_at timestamptz NOT NULL DEFAULT current_timestamp
+);
+
+CREATE TABLE IF NOT EXISTS revisions (
+	id         bigserial PRIMARY KEY,
+	race_id    bigint NOT NULL,
+	username   varchar NOT NULL,
+	endpoint   varchar NOT NULL,
+	snapshot   jsonb NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT current_timestamp
+);
+
+-- Columns added to tables that existed before they were introduced.
+
+-- Existing users predate roles: keep them able to edit and promote the admins
+-- named by ADMIN_USERS, which dbmigrate passes in as mikeapi.admin_users
+-- (lower-cased and comma-separated). Refuse to leave existing users without an
+-- admin, since nobody could then reach the admin endpoints.
+DO $$
+DECLARE
+	admins text := coalesce(nullif(current_setting('mikeapi.admin_users', true), ''), 'admin');
+BEGIN
+	IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'role') THEN
+		ALTER TABLE users ADD COLUMN role varchar NOT NULL DEFAULT 'analyst';
+		UPDATE users SET role = 'admin' WHERE lower(username) = ANY (string_to_array(admins, ','));
+		ALTER TABLE users ALTER COLUMN role SET DEFAULT 'viewer';
+		IF EXISTS (SELECT 1 FROM users) AND NOT EXISTS (SELECT 1 FROM users WHERE role = 'admin') THEN
+			RAISE EXCEPTION 'none of ADMIN_USERS (%) is an existing user: set ADMIN_USERS to the current admins and rerun', admins;
+		END IF;
+	END IF;
+END $$;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled boolean NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret varchar;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled boolean NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step bigint NOT NULL DEFAULT 0;
+ALTER TABLE races ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 1;
+ALTER TABLE results ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 1;
+
+-- Uniqueness the importers and upserts rely on.
+
+DO $$ BEGIN
+	IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'races_no_dupes') THEN
+		ALTER TABLE races ADD CONSTRAINT races_no_dupes UNIQUE (course_id, date, time);
+	END IF;
+	IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'intermediary_no_dupes') THEN
+		ALTER TABLE intermediary ADD CONSTRAINT intermediary_no_dupes UNIQUE (race_id, horse_id);
+	END IF;
+	IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'results_no_dupes') THEN
+		ALTER TABLE results ADD CONSTRAINT results_no_dupes UNIQUE (race_id, horse_id);
+	END IF;
+END $$;
+
+CREATE INDEX IF NOT EXISTS recovery_codes_user_idx ON recovery_codes (user_id);
+CREATE INDEX IF NOT EXISTS refresh_tokens_session_idx ON refresh_tokens (session_id);
+CREATE INDEX IF NOT EXISTS audit_log_race_idx ON audit_log (race_id);
+CREATE INDEX IF NOT EXISTS audit_log_user_created_idx ON audit_log (username, created_at);
+CREATE INDEX IF NOT EXISTS revisions_race_idx ON revisions (race_id, id);
@@ -0,0 +1,19 @@
+DROP INDEX IF EXISTS intermediary_horse_idx;
+DROP INDEX IF EXISTS results_course_idx;
+DROP INDEX IF EXISTS results_horse_idx;
+DROP INDEX IF EXISTS races_course_idx;
+
+ALTER TABLE recovery_codes DROP CONSTRAINT IF EXISTS recovery_codes_user_fk;
+ALTER TABLE refresh_tokens DROP CONSTRAINT IF EXISTS refresh_tokens_user_fk;
+ALTER TABLE revisions DROP CONSTRAINT IF EXISTS revisions_race_fk;
+ALTER TABLE pre_race
+	DROP CONSTRAINT IF EXISTS pre_race_course_fk,
+	DROP CONSTRAINT IF EXISTS pre_race_race_fk;
+ALTER TABLE intermediary
+	DROP CONSTRAINT IF EXISTS intermediary_horse_fk,
+	DROP CONSTRAINT IF EXISTS intermediary_race_fk;
+ALTER TABLE results
+	DROP CONSTRAINT IF EXISTS results_course_fk,
+	DROP CONSTRAINT IF EXISTS results_horse_fk,
+	DROP CONSTRAINT IF EXISTS results_race_fk;
+ALTER TABLE races DROP CONSTRAINT IF EXISTS races_course_fk;
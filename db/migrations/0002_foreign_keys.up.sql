@@ -0,0 +1,37 @@
+-- Foreign keys are added NOT VALID: they are enforced for new writes at once,
+-- while existing rows are checked with `dbcheck -validate` after any orphans
+-- have been repaired.
+--
+-- Deleting a race removes everything recorded against it; courses and horses
+-- that still have races or results cannot be deleted.
+
+ALTER TABLE races
+	ADD CONSTRAINT races_course_fk FOREIGN KEY (course_id) REFERENCES courses (course_id) ON DELETE RESTRICT NOT VALID;
+
+ALTER TABLE results
+	ADD CONSTRAINT results_race_fk FOREIGN KEY (race_id) REFERENCES races (race_id) ON DELETE CASCADE NOT VALID,
+	ADD CONSTRAINT results_horse_fk FOREIGN KEY (horse_id) REFERENCES horses (horse_id) ON DELETE RESTRICT NOT VALID,
+	ADD CONSTRAINT results_course_fk FOREIGN KEY (course_id) REFERENCES courses (course_id) ON DELETE RESTRICT NOT VALID;
+
+ALTER TABLE intermediary
+	ADD CONSTRAINT intermediary_race_fk FOREIGN KEY (race_id) REFERENCES races (race_id) ON DELETE CASCADE NOT VALID,
+	ADD CONSTRAINT intermediary_horse_fk FOREIGN KEY (horse_id) REFERENCES horses (horse_id) ON DELETE CASCADE NOT VALID;
+
+ALTER TABLE pre_race
+	ADD CONSTRAINT pre_race_race_fk FOREIGN KEY (race_id) REFERENCES races (race_id) ON DELETE CASCADE NOT VALID,
+	ADD CONSTRAINT pre_race_course_fk FOREIGN KEY (course_id) REFERENCES courses (course_id) ON DELETE RESTRICT NOT VALID;
+
+ALTER TABLE revisions
+	ADD CONSTRAINT revisions_race_fk FOREIGN KEY (race_id) REFERENCES races (race_id) ON DELETE CASCADE NOT VALID;
+
+ALTER TABLE refresh_tokens
+	ADD CONSTRAINT refresh_tokens_user_fk FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE NOT VALID;
+
+ALTER TABLE recovery_codes
+	ADD CONSTRAINT recovery_codes_user_fk FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE NOT VALID;
+
+-- Postgres does not index the referencing side of a foreign key.
+CREATE INDEX IF NOT EXISTS races_course_idx ON races (course_id);
+CREATE INDEX IF NOT EXISTS results_horse_idx ON results (horse_id);
+CREATE INDEX IF NOT EXISTS results_course_idx ON results (course_id);
+CREATE INDEX IF NOT EXISTS intermediary_horse_idx ON intermediary (horse_id);
@@ -0,0 +1,10 @@
+-- Progress of cmd/migrate per table, so an interrupted copy can resume
+-- after the last primary key it committed.
+CREATE TABLE migrate_checkpoints (
+	table_name   varchar PRIMARY KEY,
+	last_key     bigint NOT NULL DEFAULT 0,
+	since        date,
+	rows_copied  bigint NOT NULL DEFAULT 0,
+	updated_at   timestamptz NOT NULL DEFAULT current_timestamp,
+	completed_at timestamptz
+);
@@ -3,10 +3,13 @@ package handlers
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 
 	"github.com/labstack/echo/v4"
+
+	"github.com/padraicbc/mikeapi/models"
 )
 
 // jsonText accepts string, number, or null JSON values and normalizes to string.
@@ -38,7 +41,7 @@ func (t *jsonText) UnmarshalJSON(data []byte) error {
 // ResultsAmended returns all races flagged as amended, grouped by race.
 func (h *Handler) ResultsAmended(c echo.Context) error {
 	var rows []resultsAnalysisRow
-	q := resultsJoinSQL + `WHERE rc.amended = true ORDER BY r.race_id, LENGTH(r.placed), r.placed`
+	q := models.ResultsJoinSQL + `WHERE rc.amended = true ORDER BY r.race_id, LENGTH(r.placed), r.placed`
 
 	if err := h.db.NewRaw(q).Scan(c.Request().Context(), &rows); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
@@ -47,25 +50,39 @@ func (h *Handler) ResultsAmended(c echo.Context) error {
 	return c.JSON(http.StatusOK, groupResultsByRace(rows))
 }
 
-// UpdateAmended corrects placed/dist-behind-winner for amended races.
+// UpdateAmended corrects placed/dist-behind-winner for amended races and
+// recomputes the runners' horse aggregates. Stale versions are rejected with
+// 409 as in ResultsAnalysis.
 func (h *Handler) UpdateAmended(c echo.Context) error {
 	raceID := c.QueryParam("raceID")
 	if raceID == "" {
 		return echo.NewHTTPError(http.StatusBadRequest, "missing raceID param")
 	}
 	comment := c.QueryParam("comment")
+	raceVersion, err := h.versionParam(c)
+	if err != nil {
+		return err
+	}
 
 	type rowUpdate struct {
 		ID         string `json:"id"`
 		Placed     jsonText `json:"placed,omitempty"`
 		DistBehind jsonText `json:"distBehindWinner"`
 		Comment    jsonText `json:"comment"`
+		Version    *int     `json:"version"`
 	}
 
 	var fields []rowUpdate
 	if err := c.Bind(&fields); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
+	for _, ru := range fields {
+		if ru.Version == nil {
+			if err := h.requireVersion("version of result " + ru.ID); err != nil {
+				return err
+			}
+		}
+	}
 
 	ctx := c.Request().Context()
 	tx, err := h.db.BeginTx(ctx, nil)
@@ -78,25 +95,58 @@ func (h *Handler) UpdateAmended(c echo.Context) error {
 			_ = tx.Rollback()
 		}
 	}()
+	actor := auditActorFrom(c)
+	if err := saveRevision(ctx, tx, actor, raceID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	audit := actor.begin(tx)
 
 	for _, ru := range fields {
-		_, err = tx.ExecContext(ctx,
-			`UPDATE results SET placed = ?, dist_behind_winner = NULLIF(?,'')::numeric, comment = NULLIF(?,'') WHERE id = ?`,
-			string(ru.Placed), string(ru.DistBehind), string(ru.Comment), ru.ID,
+		if err := audit.track(ctx, "results", "id = ?", ru.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		res, err := tx.ExecContext(ctx,
+			`UPDATE results SET placed = ?, dist_behind_winner = NULLIF(?,'')::numeric, comment = NULLIF(?,''),
+			version = version + 1 WHERE id = ? AND version = COALESCE(?::integer, version)`,
+			string(ru.Placed), string(ru.DistBehind), string(ru.Comment), ru.ID, ru.Version,
 		)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
+		if err := missedRow(ctx, tx, res, "results", "id", ru.ID); err != nil {
+			if errors.Is(err, errStale) {
+				_ = tx.Rollback()
+				return h.resultsConflict(ctx, raceID)
+			}
+			return err
+		}
 	}
 
-	_, err = tx.ExecContext(ctx,
-		`UPDATE races SET amended = false, main_comment = NULLIF(?,'') WHERE race_id = ?`,
-		comment, raceID,
+	if err := audit.track(ctx, "races", "race_id = ?", raceID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	res, err := tx.ExecContext(ctx,
+		`UPDATE races SET amended = false, main_comment = NULLIF(?,''), version = version + 1
+		WHERE race_id = ? AND version = COALESCE(?::integer, version)`,
+		comment, raceID, raceVersion,
 	)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
+	if err := missedRow(ctx, tx, res, "races", "race_id", raceID); err != nil {
+		if errors.Is(err, errStale) {
+			_ = tx.Rollback()
+			return h.resultsConflict(ctx, raceID)
+		}
+		return err
+	}
+	if err := recomputeRaceHorses(ctx, tx, audit, raceID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
 
+	if err := audit.record(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
 	if err = tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
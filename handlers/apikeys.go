@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	mw "github.com/padraicbc/mikeapi/middleware"
+	"github.com/padraicbc/mikeapi/models"
+)
+
+// apiKeyPrefix marks mikeapi keys so they are easy to spot in configs and logs.
+const apiKeyPrefix = "mk_"
+
+type createAPIKeyRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+// NewAPIKey validates the name and scopes and generates a key of the form
+// mk_<prefix>_<secret>. It returns the model to insert and the plain-text key,
+// which is never stored and must be handed to the client once. A zero ttl never expires.
+func NewAPIKey(name string, scopes []string, createdBy string, ttl time.Duration) (*models.APIKey, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, "", errors.New("name is required")
+	}
+	if len(scopes) == 0 {
+		return nil, "", errors.New("at least one scope is required")
+	}
+	seen := map[string]bool{}
+	clean := make([]string, 0, len(scopes))
+	for _, s := range scopes {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if !models.ValidScope(s) {
+			return nil, "", fmt.Errorf("unknown scope %q: want read, write or ingest", s)
+		}
+		if !seen[s] {
+			seen[s] = true
+			clean = append(clean, s)
+		}
+	}
+
+	prefix, err := randomToken(6)
+	if err != nil {
+		return nil, "", err
+	}
+	prefix = strings.NewReplacer("-", "x", "_", "y").Replace(prefix)
+	secret, err := randomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	key := apiKeyPrefix + prefix + "_" + secret
+
+	ak := &models.APIKey{
+		Name:      name,
+		Prefix:    prefix,
+		KeyHash:   hashToken(key),
+		Scopes:    clean,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now(),
+	}
+	if ttl > 0 {
+		expires := ak.CreatedAt.Add(ttl)
+		ak.ExpiresAt = &expires
+	}
+	return ak, key, nil
+}
+
+// LookupAPIKey resolves a raw X-API-Key value for the APIKey middleware.
+// Unknown, revoked and expired keys resolve to nil.
+func (h *Handler) LookupAPIKey(ctx context.Context, key string) (*mw.APIKeyPrincipal, error) {
+	rest, ok := strings.CutPrefix(key, apiKeyPrefix)
+	if !ok {
+		return nil, nil
+	}
+	prefix, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, nil
+	}
+
+	ak := &models.APIKey{}
+	err := h.db.NewSelect().Model(ak).
+		Where("prefix = ?", prefix).
+		Where("revoked_at IS NULL").
+		Where("expires_at IS NULL OR expires_at > now()").
+		Scan(ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(ak.KeyHash), []byte(hashToken(key))) != 1 {
+		return nil, nil
+	}
+
+	// Record usage at most once a minute to avoid a write per request.
+	if _, err := h.db.NewUpdate().Model(ak).
+		Set("last_used_at = now()").
+		WherePK().
+		Where("last_used_at IS NULL OR last_used_at < now() - interval '1 minute'").
+		Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	return &mw.APIKeyPrincipal{ID: ak.ID, Name: ak.Name, Scopes: ak.Scopes}, nil
+}
+
+// ListAPIKeys returns every API key, newest first. Hashes are never included.
+func (h *Handler) ListAPIKeys(c echo.Context) error {
+	var keys []models.APIKey
+	if err := h.db.NewSelect().Model(&keys).OrderExpr("ak.id DESC").Scan(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if keys == nil {
+		keys = []models.APIKey{}
+	}
+	return c.JSON(http.StatusOK, keys)
+}
+
+// CreateAPIKey issues a new API key. The plain-text key is only returned here.
+func (h *Handler) CreateAPIKey(c echo.Context) error {
+	var req createAPIKeyRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if req.ExpiresInDays < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "expires_in_days must not be negative")
+	}
+
+	requester, _ := c.Get("username").(string)
+	ak, key, err := NewAPIKey(req.Name, req.Scopes, requester, time.Duration(req.ExpiresInDays)*24*time.Hour)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	ctx := c.Request().Context()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+	audit := auditActorFrom(c).begin(tx)
+
+	if _, err := tx.NewInsert().Model(ak).Exec(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	audit.trackNew("api_keys", "id = ?", ak.ID)
+
+	if err := audit.record(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err = tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed = true
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"api_key": ak,
+		"key":     key,
+	})
+}
+
+// RevokeAPIKey permanently disables an API key.
+func (h *Handler) RevokeAPIKey(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid api key id")
+	}
+
+	ctx := c.Request().Context()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+	audit := auditActorFrom(c).begin(tx)
+	if err := audit.track(ctx, "api_keys", "id = ?", id); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	res, err := tx.NewUpdate().Model((*models.APIKey)(nil)).
+		Set("revoked_at = now()").
+		Where("id = ?", id).
+		Where("revoked_at IS NULL").
+		Exec(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "api key not found or already revoked")
+	}
+
+	if err := audit.record(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err = tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed = true
+
+	return c.NoContent(http.StatusNoContent)
+}
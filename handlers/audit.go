@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/uptrace/bun"
+
+	"github.com/padraicbc/mikeapi/models"
+)
+
+const (
+	defaultAuditLimit = 200
+	maxAuditLimit     = 1000
+)
+
+// auditActor identifies who made a change and through which endpoint.
+type auditActor struct {
+	Username string
+	UserHash string
+	Endpoint string
+}
+
+func auditActorFrom(c echo.Context) auditActor {
+	username, _ := c.Get("username").(string)
+	userHash, _ := c.Get("user_hash").(string)
+	return auditActor{
+		Username: username,
+		UserHash: userHash,
+		Endpoint: c.Request().Method + " " + c.Path(),
+	}
+}
+
+// auditTrail collects the rows a handler touches inside one transaction.
+// Rows are snapshotted with track before they change; record snapshots them
+// again and writes an audit_log row for each one that actually changed.
+type auditTrail struct {
+	actor   auditActor
+	db      bun.IDB
+	pending []trackedRow
+}
+
+type trackedRow struct {
+	table  string
+	where  string
+	args   []interface{}
+	before json.RawMessage
+	always bool
+}
+
+// auditColumns lists the columns snapshotted for tables holding credentials,
+// so password and key hashes and TOTP secrets never reach audit_log. Other
+// tables are snapshotted whole.
+var auditColumns = map[string][]string{
+	"users":    {"id", "username", "role", "disabled", "totp_enabled"},
+	"api_keys": {"id", "name", "prefix", "scopes", "created_by", "created_at", "expires_at", "last_used_at", "revoked_at"},
+}
+
+// begin starts an audit trail for changes made through db, normally a bun.Tx.
+func (a auditActor) begin(db bun.IDB) *auditTrail {
+	return &auditTrail{actor: a, db: db}
+}
+
+// track snapshots the row of table matching where before it is changed.
+// where must identify at most one row.
+func (t *auditTrail) track(ctx context.Context, table, where string, args ...interface{}) error {
+	before, err := rowSnapshot(ctx, t.db, table, where, args)
+	if err != nil {
+		return err
+	}
+	t.pending = append(t.pending, trackedRow{table: table, where: where, args: args, before: before})
+	return nil
+}
+
+// trackSecret is track for a change to a column left out of the snapshot,
+// such as a password: the row is recorded even though its snapshot is the same.
+func (t *auditTrail) trackSecret(ctx context.Context, table, where string, args ...interface{}) error {
+	if err := t.track(ctx, table, where, args...); err != nil {
+		return err
+	}
+	t.pending[len(t.pending)-1].always = true
+	return nil
+}
+
+// trackNew registers a row that did not exist before the change.
+func (t *auditTrail) trackNew(table, where string, args ...interface{}) {
+	t.pending = append(t.pending, trackedRow{table: table, where: where, args: args})
+}
+
+// auditTracker feeds rows written by the ingest, csvio and horsestats
+// packages into an audit trail.
+type auditTracker struct {
+	trail *auditTrail
+}
+
+func (t auditTracker) Track(ctx context.Context, table, where string, args ...interface{}) error {
+	return t.trail.track(ctx, table, where, args...)
+}
+
+// record writes the audit rows. Call it after the changes and before committing
+// so the audit entries are committed or rolled back together with the data.
+func (t *auditTrail) record(ctx context.Context) error {
+	entries := make([]models.AuditLog, 0, len(t.pending))
+	for _, row := range t.pending {
+		after, err := rowSnapshot(ctx, t.db, row.table, row.where, row.args)
+		if err != nil {
+			return err
+		}
+		if !row.always && string(row.before) == string(after) {
+			continue
+		}
+		entry := models.AuditLog{
+			Username:  t.actor.Username,
+			UserHash:  t.actor.UserHash,
+			Endpoint:  t.actor.Endpoint,
+			TableName: row.table,
+			Before:    row.before,
+			After:     after,
+		}
+		entry.RaceID, entry.ResultID = snapshotIDs(row.table, row.before, after)
+		entries = append(entries, entry)
+	}
+	t.pending = nil
+
+	if len(entries) == 0 {
+		return nil
+	}
+	_, err := t.db.NewInsert().Model(&entries).Exec(ctx)
+	return err
+}
+
+// rowSnapshot returns the matching row as JSON, or nil when there is none.
+// Only the auditColumns of a table are included when it has any.
+func rowSnapshot(ctx context.Context, db bun.IDB, table, where string, args []interface{}) (json.RawMessage, error) {
+	row := db.NewSelect().TableExpr("?", bun.Ident(table)).Where(where, args...).Limit(1)
+	if cols, ok := auditColumns[table]; ok {
+		row = row.Column(cols...)
+	} else {
+		row = row.ColumnExpr("*")
+	}
+	var snap json.RawMessage
+	err := db.NewSelect().
+		TableExpr("(?) AS t", row).
+		ColumnExpr("row_to_json(t)").
+		Scan(ctx, &snap)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return snap, err
+}
+
+// snapshotIDs pulls the race and result IDs out of a row snapshot.
+func snapshotIDs(table string, before, after json.RawMessage) (raceID, resultID *int) {
+	snap := after
+	if snap == nil {
+		snap = before
+	}
+	var ids struct {
+		ID     *int `json:"id"`
+		RaceID *int `json:"race_id"`
+	}
+	if err := json.Unmarshal(snap, &ids); err != nil {
+		return nil, nil
+	}
+	if table == "results" {
+		resultID = ids.ID
+	}
+	return ids.RaceID, resultID
+}
+
+// AuditLog returns audit entries, newest first, filtered by the optional
+// user, raceID and from/to (inclusive YYYY-MM-DD dates) params.
+func (h *Handler) AuditLog(c echo.Context) error {
+	prm := c.QueryParams()
+
+	limit := defaultAuditLimit
+	if l := prm.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid limit param")
+		}
+		limit = min(n, maxAuditLimit)
+	}
+
+	var entries []models.AuditLog
+	q := h.db.NewSelect().Model(&entries).OrderExpr("al.id DESC").Limit(limit)
+
+	if user := prm.Get("user"); user != "" {
+		q = q.Where("al.username = ?", user)
+	}
+	if raceID := prm.Get("raceID"); raceID != "" {
+		id, err := strconv.Atoi(raceID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid raceID param")
+		}
+		q = q.Where("al.race_id = ?", id)
+	}
+	if from := prm.Get("from"); from != "" {
+		d, err := time.Parse(time.DateOnly, from)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "from must be YYYY-MM-DD")
+		}
+		q = q.Where("al.created_at >= ?", d)
+	}
+	if to := prm.Get("to"); to != "" {
+		d, err := time.Parse(time.DateOnly, to)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "to must be YYYY-MM-DD")
+		}
+		q = q.Where("al.created_at < ?", d.AddDate(0, 0, 1))
+	}
+
+	if err := q.Scan(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if entries == nil {
+		entries = []models.AuditLog{}
+	}
+	return c.JSON(http.StatusOK, entries)
+}
@@ -1,17 +1,19 @@
 package handlers
 
 import (
+	"database/sql"
 	"errors"
+	"math"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
 	"golang.org/x/crypto/bcrypt"
 
-	mw "github.com/padraicbc/mikeapi/middleware"
 	"github.com/padraicbc/mikeapi/models"
 )
 
@@ -20,39 +22,6 @@ type credentials struct {
 	Password string `json:"password"`
 }
 
-// HashPasswordForUser validates username/password input and returns a bcrypt hash for storage.
-func HashPasswordForUser(username, password string) (string, error) {
-	if strings.TrimSpace(username) == "" {
-		return "", errors.New("username is required")
-	}
-	if strings.TrimSpace(password) == "" {
-		return "", errors.New("password is required")
-	}
-
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return "", err
-	}
-
-	return string(hashedPassword), nil
-}
-
-func isAdminUser(username string) bool {
-	adminUsers := strings.TrimSpace(os.Getenv("ADMIN_USERS"))
-	if adminUsers == "" {
-		adminUsers = "admin"
-	}
-
-	normalizedUsername := strings.ToLower(strings.TrimSpace(username))
-	for _, admin := range strings.Split(adminUsers, ",") {
-		if normalizedUsername == strings.ToLower(strings.TrimSpace(admin)) {
-			return true
-		}
-	}
-
-	return false
-}
-
 // PasswordHash returns a bcrypt hash from username/password input for manual user registration.
 // Access is limited to authenticated admin users.
 func (h *Handler) PasswordHash(c echo.Context) error {
@@ -62,16 +31,18 @@ func (h *Handler) PasswordHash(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "unauthorized")
 	}
 
-	exists, err := h.db.NewSelect().Model((*models.User)(nil)).
+	// Check the stored role rather than the token so a demotion takes effect immediately.
+	admin := &models.User{}
+	err := h.db.NewSelect().Model(admin).
 		Where("username = ?", requester).
-		Exists(c.Request().Context())
+		Scan(c.Request().Context())
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "unauthorized")
+		}
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
-	if !exists {
-		return echo.NewHTTPError(http.StatusUnauthorized, "unauthorized")
-	}
-	if !isAdminUser(requester) {
+	if !models.RoleAtLeast(admin.Role, models.RoleAdmin) {
 		return echo.NewHTTPError(http.StatusForbidden, "admin access required")
 	}
 
@@ -80,7 +51,7 @@ func (h *Handler) PasswordHash(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	hash, err := HashPasswordForUser(creds.Username, creds.Password)
+	hash, err := HashPasswordForUser(creds.Username, creds.Password, h.PasswordPolicy)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
@@ -91,7 +62,73 @@ func (h *Handler) PasswordHash(c echo.Context) error {
 	})
 }
 
-// Signin validates credentials and returns a JWT token valid for 30 days.
+// errSigninFailed is the single response for every rejected sign-in so that
+// callers cannot tell unknown usernames, wrong passwords and disabled accounts apart.
+var errSigninFailed = echo.NewHTTPError(http.StatusUnauthorized, "incorrect username or password")
+
+// dummyPasswordHash is compared against when the username is unknown so that
+// the response takes as long as a real password check.
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("mikeapi-no-such-user"), bcrypt.DefaultCost)
+	return hash
+})
+
+// checkCredentials verifies a username/password pair, applying per-IP and
+// per-username backoff and lockout. Failures always return errSigninFailed
+// or a 429 while the caller is throttled.
+func (h *Handler) checkCredentials(c echo.Context, username, password string) (*models.User, error) {
+	now := time.Now()
+	ipKey := "ip:" + c.RealIP()
+	userKey := "user:" + strings.ToLower(username)
+
+	wait := max(h.signinThrottle.retryAfter(ipKey, now), h.signinThrottle.retryAfter(userKey, now))
+	if wait > 0 {
+		c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return nil, echo.NewHTTPError(http.StatusTooManyRequests, "too many sign-in attempts, try again later")
+	}
+
+	user := &models.User{}
+	err := h.db.NewSelect().Model(user).
+		Where("username = ?", username).
+		Scan(c.Request().Context())
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		h.recordSigninFailure(c, username, ipKey, userKey, now)
+		return nil, errSigninFailed
+	case err != nil:
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		h.recordSigninFailure(c, username, ipKey, userKey, now)
+		return nil, errSigninFailed
+	}
+	h.signinThrottle.reset(userKey)
+
+	if user.Disabled {
+		return nil, errSigninFailed
+	}
+	return user, nil
+}
+
+func (h *Handler) recordSigninFailure(c echo.Context, username, ipKey, userKey string, now time.Time) {
+	for _, key := range []string{ipKey, userKey} {
+		if locked, failures := h.signinThrottle.fail(key, now); locked {
+			zap.L().Warn("sign-in lockout",
+				zap.String("key", key),
+				zap.String("ip", c.RealIP()),
+				zap.String("username", username),
+				zap.Int("failures", failures),
+				zap.Duration("lockout", h.signinThrottle.lockout),
+			)
+		}
+	}
+}
+
+// Signin validates credentials and returns a short-lived access token together
+// with a refresh token that starts a new session. Users with two-factor
+// authentication get an mfa_token instead, to be completed at SigninTOTP.
 func (h *Handler) Signin(c echo.Context) error {
 	var creds credentials
 	if err := c.Bind(&creds); err != nil {
@@ -99,32 +136,26 @@ func (h *Handler) Signin(c echo.Context) error {
 	}
 	creds.Username = strings.TrimSpace(creds.Username)
 
-	user := &models.User{}
-	err := h.db.NewSelect().Model(user).
-		Where("username = ?", creds.Username).
-		Scan(c.Request().Context())
+	user, err := h.checkCredentials(c, creds.Username, creds.Password)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "incorrect username or password")
+		return err
 	}
-
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(creds.Password)); err != nil {
-		return echo.NewHTTPError(http.StatusUnauthorized, "unauthorized")
+	if user.TOTPEnabled {
+		challenge, err := h.newMFAChallenge(user)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, challenge)
 	}
 
-	expiresAt := time.Now().AddDate(0, 0, 30)
-	claims := &mw.Claims{
-		Username: creds.Username,
-		UserHash: mw.UserHashFromUsername(creds.Username, h.JWTKey),
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expiresAt),
-		},
+	sessionID, err := randomToken(16)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(h.JWTKey)
+	pair, err := h.issueTokens(c.Request().Context(), h.db, user, sessionID)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{"token": tokenString})
+	return c.JSON(http.StatusOK, pair)
 }
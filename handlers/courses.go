@@ -92,12 +92,34 @@ func (h *Handler) CreateCourse(c echo.Context) error {
 		Code:      req.Code,
 	}
 
-	if _, err := h.db.NewInsert().Model(course).Exec(c.Request().Context()); err != nil {
+	ctx := c.Request().Context()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+	audit := auditActorFrom(c).begin(tx)
+
+	if _, err := tx.NewInsert().Model(course).Exec(ctx); err != nil {
 		if strings.Contains(strings.ToLower(err.Error()), "duplicate key value") {
 			return echo.NewHTTPError(http.StatusConflict, "course already exists")
 		}
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
+	audit.trackNew("courses", "course_id = ?", course.CourseID)
+
+	if err := audit.record(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err = tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed = true
 
 	return c.JSON(http.StatusCreated, courseData{
 		CourseID:  course.CourseID,
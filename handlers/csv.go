@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/padraicbc/mikeapi/csvio"
+)
+
+// maxCSVBytes caps an uploaded CSV file; analysts' sheets are far smaller.
+const maxCSVBytes = 20 << 20
+
+// csvError maps csvio errors to 400 for bad requests and 500 otherwise.
+func csvError(err error) error {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, csvio.ErrInvalid):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.As(err, &tooLarge):
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "file is too large")
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+}
+
+// CSVTables lists the tables and views that can be exported; all but the
+// views, audit_log and revisions can be imported.
+func (h *Handler) CSVTables(c echo.Context) error {
+	return c.JSON(http.StatusOK, csvio.Names())
+}
+
+// ExportCSV downloads a table or view as CSV. ?from and ?to (YYYY-MM-DD)
+// limit tables with a date.
+func (h *Handler) ExportCSV(c echo.Context) error {
+	name := c.Param("table")
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	res.Header().Set(echo.HeaderContentDisposition,
+		fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("%s-%s.csv", name, time.Now().Format("20060102"))))
+
+	_, err := csvio.Export(c.Request().Context(), h.db, res, csvio.ExportOptions{
+		Name: name,
+		From: c.QueryParam("from"),
+		To:   c.QueryParam("to"),
+	})
+	if err != nil {
+		if res.Committed {
+			// Rows have gone out with a 200; all that can be done is cut it short.
+			c.Logger().Errorf("export %s: %v", name, err)
+			return nil
+		}
+		res.Header().Del(echo.HeaderContentDisposition)
+		return csvError(err)
+	}
+	return nil
+}
+
+// ImportCSV upserts the CSV request body into a table on its unique key.
+// ?map=Header=column,... renames headers and ?dryRun=true checks every row
+// against the database without keeping anything. The whole file is committed
+// only if every row imports; otherwise nothing is and the report, with an
+// error per bad line, comes back with 422.
+func (h *Handler) ImportCSV(c echo.Context) error {
+	mapping, err := csvio.ParseMapping(c.QueryParam("map"))
+	if err != nil {
+		return csvError(err)
+	}
+	opts := csvio.ImportOptions{
+		Table:   c.Param("table"),
+		Mapping: mapping,
+		DryRun:  c.QueryParam("dryRun") == "true",
+	}
+	body := http.MaxBytesReader(c.Response(), c.Request().Body, maxCSVBytes)
+
+	ctx := c.Request().Context()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+	audit := auditActorFrom(c).begin(tx)
+
+	report, err := csvio.Import(ctx, tx, body, opts, auditTracker{audit})
+	if err != nil {
+		return csvError(err)
+	}
+	if !report.OK() {
+		return c.JSON(http.StatusUnprocessableEntity, report)
+	}
+	if opts.DryRun {
+		return c.JSON(http.StatusOK, report)
+	}
+	if err := audit.record(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed = true
+
+	return c.JSON(http.StatusOK, report)
+}
@@ -1,14 +1,51 @@
 package handlers
 
-import "github.com/uptrace/bun"
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+
+	"github.com/padraicbc/mikeapi/config"
+	"github.com/padraicbc/mikeapi/notify"
+)
 
 // Handler holds shared dependencies used by all route handlers.
 type Handler struct {
-	db     *bun.DB
-	JWTKey []byte
+	db      *bun.DB
+	JWTKey  []byte
+	JWTKeys *config.JWTKeySet
+
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	TOTPIssuer      string
+	PasswordPolicy  *PasswordPolicy
+
+	// AllowUnversionedSaves lets analysis saves without row versions skip
+	// the stale-write check instead of failing with 428. Temporary, until
+	// every client sends versions.
+	AllowUnversionedSaves bool
+
+	// Notifier receives failures worth mailing; nil only logs them.
+	Notifier *notify.Notifier
+
+	signinThrottle *loginThrottle
 }
 
-// New creates a Handler with the given database connection and JWT signing key.
-func New(db *bun.DB, jwtKey []byte) *Handler {
-	return &Handler{db: db, JWTKey: jwtKey}
+// New creates a Handler with the given database connection, application
+// config and error notifier, which may be nil.
+func New(db *bun.DB, cfg *config.Config, n *notify.Notifier) *Handler {
+	return &Handler{
+		db:                    db,
+		JWTKey:                cfg.JWTKey(),
+		JWTKeys:               cfg.JWTKeys,
+		AccessTokenTTL:        cfg.AccessTokenTTL,
+		RefreshTokenTTL:       cfg.RefreshTokenTTL,
+		TOTPIssuer:            cfg.TOTPIssuer,
+		PasswordPolicy:        NewPasswordPolicy(cfg.PasswordMinLength, cfg.PasswordDenyList),
+		AllowUnversionedSaves: cfg.AllowUnversionedSaves,
+		Notifier:              n,
+		signinThrottle: newLoginThrottle(
+			cfg.SigninFreeAttempts, cfg.SigninBackoff, cfg.SigninMaxFailures, cfg.SigninLockout,
+		),
+	}
 }
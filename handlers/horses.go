@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/padraicbc/mikeapi/models"
+)
+
+// careerSQL summarises a horse's results once overall and once per value of
+// each breakdown in a single pass. Distances are banded in furlongs, and a
+// place is a finish in the first three.
+const careerSQL = `
+SELECT
+	CASE
+		WHEN GROUPING(going) = 0 THEN 'going'
+		WHEN GROUPING(band) = 0 THEN 'distance'
+		WHEN GROUPING(course) = 0 THEN 'course'
+		WHEN GROUPING(direction) = 0 THEN 'direction'
+		WHEN GROUPING(surface) = 0 THEN 'surface'
+		WHEN GROUPING(class) = 0 THEN 'class'
+		ELSE 'career'
+	END AS dimension,
+	COALESCE(going, band, course, direction, surface, class, '') AS value,
+	count(*) AS runs,
+	count(*) FILTER (WHERE placed = '1') AS wins,
+	count(*) FILTER (WHERE placed IN ('1', '2', '3')) AS places,
+	round(avg(mr2_plus_or), 1)::float8 AS avg_mr2_plus_or,
+	round(avg(tfsf), 1)::float8 AS avg_tfsf
+FROM (
+	SELECT r.placed, r.mr2_plus_or, r.tfsf, rc.going, c.course, c.direction,
+		CASE
+			WHEN rc.distance < 7 THEN '5-6.5f'
+			WHEN rc.distance < 9 THEN '7-8.5f'
+			WHEN rc.distance < 12 THEN '9-11.5f'
+			WHEN rc.distance < 16 THEN '12-15.5f'
+			ELSE '16f+'
+		END AS band,
+		CASE WHEN c.is_aw THEN 'aw' ELSE 'turf' END AS surface,
+		COALESCE(rc.class, 'none') AS class
+	FROM results r
+	JOIN races rc ON rc.race_id = r.race_id
+	JOIN courses c ON c.course_id = rc.course_id
+	WHERE r.horse_id = ?
+) x
+GROUP BY GROUPING SETS ((), (going), (band), (course), (direction), (surface), (class))
+ORDER BY dimension, runs DESC, value`
+
+type careerRow struct {
+	Dimension string `bun:"dimension" json:"-"`
+	Value     string `bun:"value" json:"value"`
+	careerStats
+}
+
+type careerStats struct {
+	Runs         int      `bun:"runs" json:"runs"`
+	Wins         int      `bun:"wins" json:"wins"`
+	Places       int      `bun:"places" json:"places"`
+	AvgMr2PlusOr *float64 `bun:"avg_mr2_plus_or" json:"avgMr2PlusOr"`
+	AvgTfsf      *float64 `bun:"avg_tfsf" json:"avgTfsf"`
+}
+
+type careerBreakdowns struct {
+	Going     []careerRow `json:"going"`
+	Distance  []careerRow `json:"distance"`
+	Course    []careerRow `json:"course"`
+	Direction []careerRow `json:"direction"`
+	Surface   []careerRow `json:"surface"`
+	Class     []careerRow `json:"class"`
+}
+
+type horseProfile struct {
+	Horse      *models.Horse    `json:"horse"`
+	Career     careerStats      `json:"career"`
+	Breakdowns careerBreakdowns `json:"breakdowns"`
+}
+
+// GetHorse returns a horse with its career record overall and broken down by
+// going, distance band, course, direction, surface (aw or turf) and class,
+// most runs first.
+func (h *Handler) GetHorse(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid horse id")
+	}
+	ctx := c.Request().Context()
+
+	horse := &models.Horse{}
+	if err := h.db.NewSelect().Model(horse).Where("h.horse_id = ?", id).Scan(ctx); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "horse not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	var rows []careerRow
+	if err := h.db.NewRaw(careerSQL, id).Scan(ctx, &rows); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	profile := horseProfile{
+		Horse: horse,
+		Breakdowns: careerBreakdowns{
+			Going: []careerRow{}, Distance: []careerRow{}, Course: []careerRow{},
+			Direction: []careerRow{}, Surface: []careerRow{}, Class: []careerRow{},
+		},
+	}
+	b := &profile.Breakdowns
+	for _, row := range rows {
+		switch row.Dimension {
+		case "career":
+			profile.Career = row.careerStats
+		case "going":
+			b.Going = append(b.Going, row)
+		case "distance":
+			b.Distance = append(b.Distance, row)
+		case "course":
+			b.Course = append(b.Course, row)
+		case "direction":
+			b.Direction = append(b.Direction, row)
+		case "surface":
+			b.Surface = append(b.Surface, row)
+		case "class":
+			b.Class = append(b.Class, row)
+		}
+	}
+
+	return c.JSON(http.StatusOK, profile)
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/uptrace/bun"
+
+	"github.com/padraicbc/mikeapi/horsestats"
+)
+
+// recomputeRaceHorses rebuilds the aggregates of a race's runners after its
+// placings change, since a new winner moves their last win and best weights.
+func recomputeRaceHorses(ctx context.Context, tx bun.Tx, audit *auditTrail, raceID interface{}) error {
+	var horseIDs []int
+	if err := tx.NewRaw(`SELECT horse_id FROM results WHERE race_id = ?`, raceID).Scan(ctx, &horseIDs); err != nil {
+		return err
+	}
+	if len(horseIDs) == 0 {
+		return nil // no HorseIDs would mean every horse
+	}
+	_, err := horsestats.Recompute(ctx, tx, horsestats.Options{HorseIDs: horseIDs}, auditTracker{audit})
+	return err
+}
+
+// RecomputeHorseStats rebuilds the horse aggregates from results and reports
+// each horse whose columns changed. ?horseID (comma-separated) and ?from/?to
+// race dates narrow the horses; with neither every horse is checked.
+// ?dryRun=true reports without writing.
+func (h *Handler) RecomputeHorseStats(c echo.Context) error {
+	opts := horsestats.Options{
+		From:   c.QueryParam("from"),
+		To:     c.QueryParam("to"),
+		DryRun: c.QueryParam("dryRun") == "true",
+	}
+	if ids := c.QueryParam("horseID"); ids != "" {
+		for _, s := range strings.Split(ids, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || id <= 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid horseID")
+			}
+			opts.HorseIDs = append(opts.HorseIDs, id)
+		}
+	}
+
+	ctx := c.Request().Context()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+	audit := auditActorFrom(c).begin(tx)
+
+	report, err := horsestats.Recompute(ctx, tx, opts, auditTracker{audit})
+	if err != nil {
+		if errors.Is(err, horsestats.ErrInvalid) {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if opts.DryRun {
+		return c.JSON(http.StatusOK, report)
+	}
+	if err := audit.record(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed = true
+
+	return c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/uptrace/bun"
+
+	"github.com/padraicbc/mikeapi/ingest"
+)
+
+// maxIngestBytes caps an ingest document; a full day of cards is well under it.
+const maxIngestBytes = 10 << 20
+
+// readIngestBody reads a request body up to maxIngestBytes.
+func readIngestBody(c echo.Context) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxIngestBytes+1))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if len(body) > maxIngestBytes {
+		return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge, "document is too large")
+	}
+	return body, nil
+}
+
+// ingestError maps a whole-document rejection to 400 with every schema error.
+func ingestError(err error) error {
+	var invalid *ingest.InvalidError
+	if errors.As(err, &invalid) {
+		return echo.NewHTTPError(http.StatusBadRequest, map[string]interface{}{
+			"message": "document does not match the schema",
+			"errors":  invalid.Errors,
+		})
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+}
+
+// ingestDocument runs load on the request body in one transaction with an
+// audit trail and returns its per-race report.
+func (h *Handler) ingestDocument(c echo.Context, load func(context.Context, bun.Tx, []byte, ingest.Tracker) (*ingest.Report, error)) error {
+	body, err := readIngestBody(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+	audit := auditActorFrom(c).begin(tx)
+
+	report, err := load(ctx, tx, body, auditTracker{audit})
+	if err != nil {
+		return ingestError(err)
+	}
+	if err := audit.record(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed = true
+
+	return c.JSON(http.StatusOK, report)
+}
+
+// IngestRacecards upserts a day's race cards in one transaction and returns a
+// per-race accept or reject report. Rejected races are left as they were.
+func (h *Handler) IngestRacecards(c echo.Context) error {
+	return h.ingestDocument(c, ingest.Racecards)
+}
+
+// IngestResults upserts a day's results, with their horses, and keeps the
+// horse aggregates up to date. The report is as for IngestRacecards.
+func (h *Handler) IngestResults(c echo.Context) error {
+	return h.ingestDocument(c, ingest.Results)
+}
+
+// RacecardSchema publishes the JSON schema IngestRacecards validates against.
+func (h *Handler) RacecardSchema(c echo.Context) error {
+	return c.Blob(http.StatusOK, "application/schema+json", ingest.RacecardSchema())
+}
+
+// ResultSchema publishes the JSON schema IngestResults validates against.
+func (h *Handler) ResultSchema(c echo.Context) error {
+	return c.Blob(http.StatusOK, "application/schema+json", ingest.ResultSchema())
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/padraicbc/mikeapi/config"
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+func b64url(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+// toJWK converts an asymmetric keyset entry into its public JWK form.
+func toJWK(k *config.JWTKey) (jwk, bool) {
+	out := jwk{Kid: k.ID, Alg: k.Alg, Use: "sig"}
+	switch pub := k.PublicKey.(type) {
+	case ed25519.PublicKey:
+		out.Kty, out.Crv, out.X = "OKP", "Ed25519", b64url(pub)
+	case *rsa.PublicKey:
+		out.Kty = "RSA"
+		out.N = b64url(pub.N.Bytes())
+		out.E = b64url(big.NewInt(int64(pub.E)).Bytes())
+	default:
+		return jwk{}, false
+	}
+	return out, true
+}
+
+// JWKS publishes the public halves of the asymmetric token keys so other
+// services can verify tokens without holding a signing secret. HMAC keys are never listed.
+func (h *Handler) JWKS(c echo.Context) error {
+	set := jwkSet{Keys: []jwk{}}
+	for _, k := range h.JWTKeys.PublicKeys() {
+		if j, ok := toJWK(k); ok {
+			set.Keys = append(set.Keys, j)
+		}
+	}
+
+	c.Response().Header().Set("Cache-Control", "public, max-age=300")
+	return c.JSON(http.StatusOK, set)
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/padraicbc/mikeapi/config"
+)
+
+func TestJWKS(t *testing.T) {
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsPriv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := config.NewJWTKeySet(
+		&config.JWTKey{ID: "ed1", Alg: config.AlgEdDSA, PrivateKey: edPriv, PublicKey: edPub},
+		&config.JWTKey{ID: "hs1", Alg: config.AlgHS256, Secret: []byte("never published")},
+		&config.JWTKey{ID: "rs1", Alg: config.AlgRS256, PublicKey: &rsPriv.PublicKey},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil), rec)
+	if err := (&Handler{JWTKeys: ks}).JWKS(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "public, max-age=300" {
+		t.Errorf("status %d, Cache-Control %q", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+
+	var set jwkSet
+	if err := json.Unmarshal(rec.Body.Bytes(), &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 2 {
+		t.Fatalf("keys = %+v, want ed1 and rs1 only", set.Keys)
+	}
+	decode := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	ed := set.Keys[0]
+	if ed.Kid != "ed1" || ed.Kty != "OKP" || ed.Crv != "Ed25519" || ed.Alg != "EdDSA" || ed.Use != "sig" {
+		t.Errorf("Ed25519 JWK = %+v", ed)
+	}
+	if !edPub.Equal(ed25519.PublicKey(decode(ed.X))) {
+		t.Error("Ed25519 x does not round-trip to the public key")
+	}
+
+	rs := set.Keys[1]
+	if rs.Kid != "rs1" || rs.Kty != "RSA" || rs.Alg != "RS256" || rs.Use != "sig" || rs.X != "" {
+		t.Errorf("RSA JWK = %+v", rs)
+	}
+	got := &rsa.PublicKey{N: new(big.Int).SetBytes(decode(rs.N)), E: int(new(big.Int).SetBytes(decode(rs.E)).Int64())}
+	if !rsPriv.PublicKey.Equal(got) {
+		t.Error("RSA n and e do not round-trip to the public key")
+	}
+	if rs.E != "AQAB" {
+		t.Errorf("e = %s, want AQAB", rs.E)
+	}
+}
+
+func TestJWKSHMACOnly(t *testing.T) {
+	ks, err := config.NewJWTKeySet(&config.JWTKey{ID: "hs1", Alg: config.AlgHS256, Secret: []byte("x")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil), rec)
+	if err := (&Handler{JWTKeys: ks}).JWKS(c); err != nil {
+		t.Fatal(err)
+	}
+	// An empty set, not null, so clients can range over it.
+	if body := rec.Body.String(); body != "{\"keys\":[]}\n" {
+		t.Errorf("body = %q", body)
+	}
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/padraicbc/mikeapi/models"
+)
+
+//go:embed common-passwords.txt
+var commonPasswords string
+
+// bcrypt ignores everything past 72 bytes, so longer passwords are refused
+// rather than silently truncated.
+const maxPasswordBytes = 72
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// PasswordPolicy holds the rules every new password must satisfy.
+type PasswordPolicy struct {
+	MinLength int
+	denied    map[string]struct{}
+}
+
+// NewPasswordPolicy returns a policy with the given minimum length that refuses
+// the built-in common passwords plus any extra deny-listed ones.
+func NewPasswordPolicy(minLength int, extraDenied []string) *PasswordPolicy {
+	p := &PasswordPolicy{MinLength: minLength, denied: map[string]struct{}{}}
+
+	sc := bufio.NewScanner(strings.NewReader(commonPasswords))
+	for sc.Scan() {
+		p.deny(sc.Text())
+	}
+	for _, pw := range extraDenied {
+		p.deny(pw)
+	}
+	return p
+}
+
+func (p *PasswordPolicy) deny(pw string) {
+	pw = strings.ToLower(strings.TrimSpace(pw))
+	if pw != "" && !strings.HasPrefix(pw, "#") {
+		p.denied[pw] = struct{}{}
+	}
+}
+
+// Check returns an error describing the first rule the password breaks.
+func (p *PasswordPolicy) Check(username, password string) error {
+	if n := utf8.RuneCountInString(password); n < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters", p.MinLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("password must be at most %d bytes", maxPasswordBytes)
+	}
+	lower := strings.ToLower(password)
+	if _, ok := p.denied[lower]; ok {
+		return errors.New("password is too common")
+	}
+	if lower == strings.ToLower(strings.TrimSpace(username)) {
+		return errors.New("password must not match the username")
+	}
+	return nil
+}
+
+// ChangePassword lets signed-in users change their own password. It requires
+// the current password and ends every other session of the user.
+func (h *Handler) ChangePassword(c echo.Context) error {
+	var req changePasswordRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	ctx := c.Request().Context()
+	self, err := currentUser(ctx, h.db, c)
+	if err != nil {
+		return err
+	}
+	// Reuse the sign-in check so guessing the current password is throttled too.
+	if _, err := h.checkCredentials(c, self.Username, req.CurrentPassword); err != nil {
+		if err == errSigninFailed {
+			return echo.NewHTTPError(http.StatusUnauthorized, "current password is incorrect")
+		}
+		return err
+	}
+	if req.NewPassword == req.CurrentPassword {
+		return echo.NewHTTPError(http.StatusBadRequest, "new password must differ from the current one")
+	}
+
+	hash, err := HashPasswordForUser(self.Username, req.NewPassword, h.PasswordPolicy)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+
+	audit := auditActorFrom(c).begin(tx)
+	if err := audit.trackSecret(ctx, "users", "id = ?", self.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if _, err := tx.NewUpdate().Model((*models.User)(nil)).
+		Set("password = ?", hash).
+		Where("id = ?", self.ID).
+		Exec(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	sessionID, _ := c.Get("session_id").(string)
+	if err := revokeUserSessions(ctx, tx, self.ID, sessionID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := audit.record(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err = tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed = true
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// HashPasswordForUser validates username/password input and returns a bcrypt hash for storage.
+// A nil policy only requires the password to be non-blank.
+func HashPasswordForUser(username, password string, policy *PasswordPolicy) (string, error) {
+	if strings.TrimSpace(username) == "" {
+		return "", errors.New("username is required")
+	}
+	if strings.TrimSpace(password) == "" {
+		return "", errors.New("password is required")
+	}
+	if policy != nil {
+		if err := policy.Check(username, password); err != nil {
+			return "", err
+		}
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hashedPassword), nil
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	p := NewPasswordPolicy(10, []string{" Paddock-Gate-7 ", "# not a password", ""})
+	tests := []struct {
+		name, username, password, want string // want is an error substring, "" for none
+	}{
+		{"ok", "ann", "correct horse battery", ""},
+		{"too short", "ann", "short", "at least 10 characters"},
+		{"length counts runes", "ann", "ééééééééé", "at least 10 characters"},
+		{"multibyte ok", "ann", "éééééééééé", ""},
+		{"too long", "ann", strings.Repeat("a", 73), "at most 72 bytes"},
+		{"72 bytes ok", "ann", strings.Repeat("ab", 36), ""},
+		{"common", "ann", "password1234", "too common"},
+		{"common any case", "ann", "PassWord1234", "too common"},
+		{"extra denied, trimmed and folded", "ann", "paddock-gate-7", "too common"},
+		{"comment lines are not denied", "ann", "# not a password", ""},
+		{"username", "Frankel-Fan-1", "frankel-fan-1", "must not match the username"},
+		{"username trimmed", " frankel-fan-1 ", "Frankel-Fan-1", "must not match the username"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Check(tt.username, tt.password)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("Check = %v, want nil", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("Check = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashPasswordForUser(t *testing.T) {
+	p := NewPasswordPolicy(10, nil)
+
+	hash, err := HashPasswordForUser("ann", "correct horse battery", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte("correct horse battery")); err != nil {
+		t.Errorf("hash does not match the password: %v", err)
+	}
+
+	for _, tt := range []struct{ username, password, want string }{
+		{" ", "correct horse battery", "username is required"},
+		{"ann", "   ", "password is required"},
+		{"ann", "short", "at least 10 characters"},
+	} {
+		if _, err := HashPasswordForUser(tt.username, tt.password, p); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("HashPasswordForUser(%q, %q) = %v, want %q", tt.username, tt.password, err, tt.want)
+		}
+	}
+
+	// Without a policy only blank passwords are refused.
+	if _, err := HashPasswordForUser("ann", "x", nil); err != nil {
+		t.Errorf("nil policy refused a short password: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -22,6 +23,7 @@ type postRaceRow struct {
 	SpeedPer      *float64 `bun:"speed_per"`
 	Comment       *string  `bun:"comment"`
 	Tfr           *string  `bun:"tfr"`
+	Version       int      `bun:"version"`
 	// races table (alias rc)
 	Date        string  `bun:"date"`
 	Time        string  `bun:"time"`
@@ -33,6 +35,7 @@ type postRaceRow struct {
 	Mr          *int    `bun:"mr"`
 	Mr2         *int    `bun:"mr2"`
 	MainComment *string `bun:"main_comment"`
+	RaceVersion int     `bun:"race_version"`
 	// courses table (alias c)
 	Course    string `bun:"course"`
 	CourseID  int    `bun:"course_id"`
@@ -53,6 +56,7 @@ type postRaceRunner struct {
 	SpeedPer      *float64 `json:"speedPer,omitempty"`
 	Comment       *string  `json:"comment,omitempty"`
 	Tfr           *string  `json:"tfr,omitempty"`
+	Version       int      `json:"version"`
 }
 
 type postRaceRace struct {
@@ -71,14 +75,15 @@ type postRaceRace struct {
 	CourseID    int              `json:"courseID,omitempty"`
 	Direction   string           `json:"direction,omitempty"`
 	IsAW        bool             `json:"isAw,omitempty"`
+	Version     int              `json:"version"`
 }
 
 const postRaceJoinSQL = `
 SELECT
 	r.id, r.placed, r.official_rat, r.weight_carried, h.horse,
-	r.mr_plus_or, r.mr2_plus_or, r.tfsf, r.sec_t, r.speed_per, r.comment, r.tfr,
+	r.mr_plus_or, r.mr2_plus_or, r.tfsf, r.sec_t, r.speed_per, r.comment, r.tfr, r.version,
 	rc.date::text AS date, rc.time, rc.class, rc.distance, rc.going, rc.url,
-	rc.race_id, rc.mr, rc.mr2, rc.main_comment,
+	rc.race_id, rc.mr, rc.mr2, rc.main_comment, rc.version AS race_version,
 	c.course, c.course_id, c.direction, c.is_aw
 FROM results r
 INNER JOIN courses c  ON r.course_id = c.course_id
@@ -111,6 +116,10 @@ func (h *Handler) SaveToResPostRace(c echo.Context) error {
 	if mr2 == "" || raceID == "" || isPartial == "" {
 		return echo.NewHTTPError(http.StatusBadRequest, "missing mr2, raceID, or isPartial param")
 	}
+	raceVersion, err := h.versionParam(c)
+	if err != nil {
+		return err
+	}
 
 	type rowUpdate struct {
 		ID          string `json:"id"`
@@ -124,12 +133,20 @@ func (h *Handler) SaveToResPostRace(c echo.Context) error {
 		SpeedPer    string `json:"speedPer"`
 		TfsfMinusOr string `json:"tfsfMinusOr"`
 		Tfr         string `json:"tfr"`
+		Version     *int   `json:"version"`
 	}
 
 	var fields []rowUpdate
 	if err := c.Bind(&fields); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
+	for _, ru := range fields {
+		if ru.Version == nil {
+			if err := h.requireVersion("version of result " + ru.ID); err != nil {
+				return err
+			}
+		}
+	}
 
 	ctx := c.Request().Context()
 	tx, err := h.db.BeginTx(ctx, nil)
@@ -142,9 +159,17 @@ func (h *Handler) SaveToResPostRace(c echo.Context) error {
 			_ = tx.Rollback()
 		}
 	}()
+	actor := auditActorFrom(c)
+	if err := saveRevision(ctx, tx, actor, raceID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	audit := actor.begin(tx)
 
 	for _, ru := range fields {
-		_, err = tx.ExecContext(ctx,
+		if err := audit.track(ctx, "results", "id = ?", ru.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		res, err := tx.ExecContext(ctx,
 			`UPDATE results SET
 				tfsf          = NULLIF(?,'')::integer,
 				sec_t         = NULLIF(?,'')::numeric,
@@ -156,25 +181,47 @@ func (h *Handler) SaveToResPostRace(c echo.Context) error {
 				wc_mr1_plus_or = NULLIF(?,'')::integer,
 				tfsf_minus_or = NULLIF(?,'')::integer,
 				tfr           = NULLIF(?,''),
-				analysed      = true
-			WHERE id = ?`,
+				analysed      = true,
+				version       = version + 1
+			WHERE id = ? AND version = COALESCE(?::integer, version)`,
 			ru.Tfsf, ru.SecT, ru.SpeedPer, ru.Comment,
 			ru.Mr2PlusOr, ru.MrPlusOr, ru.WCmr2PlusOr, ru.WCmrPlusOr,
-			ru.TfsfMinusOr, ru.Tfr, ru.ID,
+			ru.TfsfMinusOr, ru.Tfr, ru.ID, ru.Version,
 		)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
+		if err := missedRow(ctx, tx, res, "results", "id", ru.ID); err != nil {
+			if errors.Is(err, errStale) {
+				_ = tx.Rollback()
+				return h.postRaceConflict(ctx, raceID)
+			}
+			return err
+		}
 	}
 
-	_, err = tx.ExecContext(ctx,
-		`UPDATE races SET mr2 = NULLIF(?,'')::integer, main_comment = NULLIF(?,'') WHERE race_id = ?`,
-		mr2, comm, raceID,
+	if err := audit.track(ctx, "races", "race_id = ?", raceID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	res, err := tx.ExecContext(ctx,
+		`UPDATE races SET mr2 = NULLIF(?,'')::integer, main_comment = NULLIF(?,''), version = version + 1
+		WHERE race_id = ? AND version = COALESCE(?::integer, version)`,
+		mr2, comm, raceID, raceVersion,
 	)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
+	if err := missedRow(ctx, tx, res, "races", "race_id", raceID); err != nil {
+		if errors.Is(err, errStale) {
+			_ = tx.Rollback()
+			return h.postRaceConflict(ctx, raceID)
+		}
+		return err
+	}
 
+	if err := audit.record(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
 	if err = tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
@@ -202,6 +249,7 @@ func groupPostRaceByRace(rows []postRaceRow) []postRaceRace {
 			SpeedPer:      row.SpeedPer,
 			Comment:       row.Comment,
 			Tfr:           row.Tfr,
+			Version:       row.Version,
 		}
 
 		if _, ok := races[key]; !ok {
@@ -221,6 +269,7 @@ func groupPostRaceByRace(rows []postRaceRow) []postRaceRace {
 				CourseID:    row.CourseID,
 				Direction:   row.Direction,
 				IsAW:        row.IsAW,
+				Version:     row.RaceVersion,
 				Runners:     []postRaceRunner{},
 			}
 		}
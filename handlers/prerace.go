@@ -11,6 +11,8 @@ import (
 
 	"github.com/labstack/echo/v4"
 	"github.com/uptrace/bun"
+
+	"github.com/padraicbc/mikeapi/notify"
 )
 
 type preRaceSaveJSON struct {
@@ -106,7 +108,7 @@ func (h *Handler) SaveToIntermediary(c echo.Context) error {
 	ctx := c.Request().Context()
 	var lastErr error
 	for attempt := 0; attempt < 5; attempt++ {
-		lastErr = doInterInsert(ctx, h.db, pre, mr, raceID)
+		lastErr = doInterInsert(ctx, h.db, auditActorFrom(c), pre, mr, raceID)
 		if lastErr == nil {
 			break
 		}
@@ -114,13 +116,14 @@ func (h *Handler) SaveToIntermediary(c echo.Context) error {
 		time.Sleep(100 * time.Millisecond)
 	}
 	if lastErr != nil {
+		h.Notifier.Notify(notify.KindRetry, "SaveToIntermediary race %s failed after 5 attempts: %v", raceID, lastErr)
 		return echo.NewHTTPError(http.StatusInternalServerError, lastErr.Error())
 	}
 
 	return c.NoContent(http.StatusAccepted)
 }
 
-func doInterInsert(ctx context.Context, db *bun.DB, pre []interMed, mr, raceID string) error {
+func doInterInsert(ctx context.Context, db *bun.DB, actor auditActor, pre []interMed, mr, raceID string) error {
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
@@ -131,8 +134,12 @@ func doInterInsert(ctx context.Context, db *bun.DB, pre []interMed, mr, raceID s
 			_ = tx.Rollback()
 		}
 	}()
+	audit := actor.begin(tx)
 
 	for _, im := range pre {
+		if err := audit.track(ctx, "intermediary", "race_id = ? AND horse_id = ?", im.RaceID, im.HorseID); err != nil {
+			return err
+		}
 		tfr := nullableString(im.Tfr)
 		mrPlusOr := nullableString(im.MrPlusOr)
 		_, err := tx.ExecContext(ctx,
@@ -147,14 +154,20 @@ func doInterInsert(ctx context.Context, db *bun.DB, pre []interMed, mr, raceID s
 		}
 	}
 
+	if err := audit.track(ctx, "races", "race_id = ?", raceID); err != nil {
+		return err
+	}
 	_, err = tx.ExecContext(ctx,
-		`UPDATE races SET pre_done = true, mr = NULLIF(?,'')::integer WHERE race_id = ?`,
+		`UPDATE races SET pre_done = true, mr = NULLIF(?,'')::integer, version = version + 1 WHERE race_id = ?`,
 		mr, raceID,
 	)
 	if err != nil {
 		return err
 	}
 
+	if err := audit.record(ctx); err != nil {
+		return err
+	}
 	if err = tx.Commit(); err != nil {
 		return err
 	}
@@ -184,6 +197,7 @@ func (h *Handler) UpdatePreRace(c echo.Context) error {
 	}
 
 	ctx := c.Request().Context()
+	actor := auditActorFrom(c)
 	var lastErr error
 	for attempt := range 5 {
 		lastErr = func() error {
@@ -197,17 +211,27 @@ func (h *Handler) UpdatePreRace(c echo.Context) error {
 					_ = tx.Rollback()
 				}
 			}()
+			audit := actor.begin(tx)
 
+			if err := audit.track(ctx, "pre_race", "race_id = ?", raceID); err != nil {
+				return err
+			}
 			if _, err = tx.ExecContext(ctx,
 				`UPDATE pre_race SET runners = ?::jsonb WHERE race_id = ?`, payload, raceID,
 			); err != nil {
 				return err
 			}
+			if err := audit.track(ctx, "races", "race_id = ?", raceID); err != nil {
+				return err
+			}
 			if _, err = tx.ExecContext(ctx,
-				`UPDATE races SET mr = NULLIF(?,'')::integer WHERE race_id = ?`, mr, raceID,
+				`UPDATE races SET mr = NULLIF(?,'')::integer, version = version + 1 WHERE race_id = ?`, mr, raceID,
 			); err != nil {
 				return err
 			}
+			if err := audit.record(ctx); err != nil {
+				return err
+			}
 			if err = tx.Commit(); err != nil {
 				return err
 			}
@@ -222,6 +246,7 @@ func (h *Handler) UpdatePreRace(c echo.Context) error {
 		time.Sleep(100 * time.Millisecond)
 	}
 	if lastErr != nil {
+		h.Notifier.Notify(notify.KindRetry, "UpdatePreRace race %s failed after 5 attempts: %v", raceID, lastErr)
 		return echo.NewHTTPError(http.StatusInternalServerError, lastErr.Error())
 	}
 
@@ -1,10 +1,13 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
 	"github.com/labstack/echo/v4"
+
+	"github.com/padraicbc/mikeapi/models"
 )
 
 // resultsAnalysisRow is a flat scan target for the results join query.
@@ -22,6 +25,7 @@ type resultsAnalysisRow struct {
 	SpeedPer         *float64 `bun:"speed_per"`
 	Comment          *string  `bun:"comment"`
 	DistBehindWinner *float64 `bun:"dist_behind_winner"`
+	Version          int      `bun:"version"`
 	// races table (alias rc)
 	Date        string  `bun:"date"`
 	Time        string  `bun:"time"`
@@ -33,6 +37,7 @@ type resultsAnalysisRow struct {
 	Mr          *int    `bun:"mr"`
 	Mr2         *int    `bun:"mr2"`
 	MainComment *string `bun:"main_comment"`
+	RaceVersion int     `bun:"race_version"`
 	// courses table (alias c)
 	Course    string `bun:"course"`
 	CourseID  int    `bun:"course_id"`
@@ -53,6 +58,7 @@ type resultsAnalysisRunner struct {
 	SpeedPer         *float64 `json:"speedPer,omitempty"`
 	Comment          *string  `json:"comment,omitempty"`
 	DistBehindWinner *float64 `json:"distBehindWinner,omitempty"`
+	Version          int      `json:"version"`
 }
 
 type resultsAnalysisRace struct {
@@ -71,21 +77,9 @@ type resultsAnalysisRace struct {
 	CourseID    int                     `json:"courseID,omitempty"`
 	Direction   string                  `json:"direction,omitempty"`
 	IsAW        bool                    `json:"isAw,omitempty"`
+	Version     int                     `json:"version"`
 }
 
-const resultsJoinSQL = `
-SELECT
-	r.id, r.placed, r.official_rat, r.weight_carried, h.horse,
-	r.mr_plus_or, r.mr2_plus_or, r.tfsf, r.sec_t, r.speed_per, r.comment, r.dist_behind_winner,
-	rc.date::text AS date, rc.time, rc.class, rc.distance, rc.going, rc.url,
-	rc.race_id, rc.mr, rc.mr2, rc.main_comment,
-	c.course, c.course_id, c.direction, c.is_aw
-FROM results r
-INNER JOIN courses c  ON r.course_id  = c.course_id
-INNER JOIN horses  h  ON r.horse_id   = h.horse_id
-INNER JOIN races   rc ON r.race_id    = rc.race_id
-`
-
 // Results returns all race results for a given date, grouped by race.
 func (h *Handler) Results(c echo.Context) error {
 	date := c.QueryParam("date")
@@ -94,7 +88,7 @@ func (h *Handler) Results(c echo.Context) error {
 	}
 
 	var rows []resultsAnalysisRow
-	q := resultsJoinSQL + `WHERE rc.date = ? AND NOT rc.amended ORDER BY r.race_id, LENGTH(r.placed), r.placed`
+	q := models.ResultsJoinSQL + `WHERE rc.date = ? AND NOT rc.amended ORDER BY r.race_id, LENGTH(r.placed), r.placed`
 
 	if err := h.db.NewRaw(q, date).Scan(c.Request().Context(), &rows); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
@@ -104,6 +98,9 @@ func (h *Handler) Results(c echo.Context) error {
 }
 
 // ResultsAnalysis updates result rows with analysis fields after a race.
+// Rows and the race are only written if their version still matches; a stale
+// write is rejected with 409 and the race as currently stored, a save without
+// versions with 428 and an unknown race or row with 404.
 func (h *Handler) ResultsAnalysis(c echo.Context) error {
 	prm := c.QueryParams()
 	mr, mr2, raceID, comm := prm.Get("mr"), prm.Get("mr2"), prm.Get("raceID"), prm.Get("comment")
@@ -111,6 +108,10 @@ func (h *Handler) ResultsAnalysis(c echo.Context) error {
 	if mr == "" || mr2 == "" || raceID == "" {
 		return echo.NewHTTPError(http.StatusBadRequest, "missing mr, mr2, or raceID param")
 	}
+	raceVersion, err := h.versionParam(c)
+	if err != nil {
+		return err
+	}
 
 	type rowUpdate struct {
 		ID          string `json:"id"`
@@ -125,12 +126,20 @@ func (h *Handler) ResultsAnalysis(c echo.Context) error {
 		TfsfMinusOr string `json:"tfsfMinusOr"`
 		DistBehind  string `json:"distBehindWinner"`
 		Placed      string `json:"placed,omitempty"`
+		Version     *int   `json:"version"`
 	}
 
 	var fields []rowUpdate
 	if err := c.Bind(&fields); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
+	for _, ru := range fields {
+		if ru.Version == nil {
+			if err := h.requireVersion("version of result " + ru.ID); err != nil {
+				return err
+			}
+		}
+	}
 
 	ctx := c.Request().Context()
 	tx, err := h.db.BeginTx(ctx, nil)
@@ -143,31 +152,61 @@ func (h *Handler) ResultsAnalysis(c echo.Context) error {
 			_ = tx.Rollback()
 		}
 	}()
+	actor := auditActorFrom(c)
+	if err := saveRevision(ctx, tx, actor, raceID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	audit := actor.begin(tx)
 
 	for _, ru := range fields {
-		_, err = tx.ExecContext(ctx,
+		if err := audit.track(ctx, "results", "id = ?", ru.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		res, err := tx.ExecContext(ctx,
 			`UPDATE results SET tfsf = NULLIF(?,'')::integer, sec_t = NULLIF(?,'')::numeric,
 			speed_per = NULLIF(?,'')::numeric, comment = NULLIF(?,''),
 			mr2_plus_or = NULLIF(?,'')::integer, mr_plus_or = NULLIF(?,'')::integer,
 			wc_mr2_plus_or = NULLIF(?,'')::integer, wc_mr1_plus_or = NULLIF(?,'')::integer,
-			analysed = true, tfsf_minus_or = NULLIF(?,'')::integer WHERE id = ?`,
+			analysed = true, tfsf_minus_or = NULLIF(?,'')::integer, version = version + 1
+			WHERE id = ? AND version = COALESCE(?::integer, version)`,
 			ru.Tfsf, ru.SecT, ru.SpeedPer, ru.Comment,
 			ru.Mr2PlusOr, ru.MrPlusOr, ru.WCmr2PlusOr, ru.WCmrPlusOr,
-			ru.TfsfMinusOr, ru.ID,
+			ru.TfsfMinusOr, ru.ID, ru.Version,
 		)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
+		if err := missedRow(ctx, tx, res, "results", "id", ru.ID); err != nil {
+			if errors.Is(err, errStale) {
+				_ = tx.Rollback()
+				return h.resultsConflict(ctx, raceID)
+			}
+			return err
+		}
 	}
 
-	_, err = tx.ExecContext(ctx,
-		`UPDATE races SET mr = NULLIF(?,'')::integer, mr2 = NULLIF(?,'')::integer, main_comment = NULLIF(?,'') WHERE race_id = ?`,
-		mr, mr2, comm, raceID,
+	if err := audit.track(ctx, "races", "race_id = ?", raceID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	res, err := tx.ExecContext(ctx,
+		`UPDATE races SET mr = NULLIF(?,'')::integer, mr2 = NULLIF(?,'')::integer, main_comment = NULLIF(?,''),
+		version = version + 1 WHERE race_id = ? AND version = COALESCE(?::integer, version)`,
+		mr, mr2, comm, raceID, raceVersion,
 	)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
+	if err := missedRow(ctx, tx, res, "races", "race_id", raceID); err != nil {
+		if errors.Is(err, errStale) {
+			_ = tx.Rollback()
+			return h.resultsConflict(ctx, raceID)
+		}
+		return err
+	}
 
+	if err := audit.record(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
 	if err = tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
@@ -196,6 +235,7 @@ func groupResultsByRace(rows []resultsAnalysisRow) []resultsAnalysisRace {
 			SpeedPer:         row.SpeedPer,
 			Comment:          row.Comment,
 			DistBehindWinner: row.DistBehindWinner,
+			Version:          row.Version,
 		}
 
 		if _, ok := races[key]; !ok {
@@ -215,6 +255,7 @@ func groupResultsByRace(rows []resultsAnalysisRow) []resultsAnalysisRace {
 				CourseID:    row.CourseID,
 				Direction:   row.Direction,
 				IsAW:        row.IsAW,
+				Version:     row.RaceVersion,
 				Runners:     []resultsAnalysisRunner{},
 			}
 		}
@@ -0,0 +1,316 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/uptrace/bun"
+
+	"github.com/padraicbc/mikeapi/models"
+)
+
+// Columns the analysis saves write, and therefore the ones a restore puts back.
+// Identity columns such as course, date and horse are never restored.
+var (
+	revisionRaceColumns   = []string{"mr", "mr2", "main_comment", "amended"}
+	revisionResultColumns = []string{
+		"placed", "dist_behind_winner", "comment", "tfsf", "sec_t", "speed_per",
+		"mr_plus_or", "mr2_plus_or", "wc_mr1_plus_or", "wc_mr2_plus_or",
+		"tfsf_minus_or", "tfr", "analysed",
+	}
+)
+
+// revisionSnapshotSQL selects a race row (alias rc) and its results as one
+// JSON document in the models.Revision snapshot layout.
+const revisionSnapshotSQL = `jsonb_build_object(
+	'race', to_jsonb(rc),
+	'results', COALESCE((SELECT jsonb_agg(to_jsonb(r) ORDER BY r.id) FROM results r WHERE r.race_id = rc.race_id), '[]'::jsonb))`
+
+type revisionSnapshot struct {
+	Race    map[string]json.RawMessage   `json:"race"`
+	Results []map[string]json.RawMessage `json:"results"`
+}
+
+type fieldChange struct {
+	From json.RawMessage `json:"from"`
+	To   json.RawMessage `json:"to"`
+}
+
+type resultChange struct {
+	ID      int                    `json:"id"`
+	Status  string                 `json:"status"` // changed, added or removed
+	Changes map[string]fieldChange `json:"changes,omitempty"`
+}
+
+type revisionDiff struct {
+	RaceID  int                    `json:"raceID"`
+	From    int                    `json:"from"`
+	To      *int                   `json:"to"` // null when diffing against the current rows
+	Race    map[string]fieldChange `json:"race"`
+	Results []resultChange         `json:"results"`
+}
+
+// saveRevision snapshots a race and its results before they are overwritten.
+// It does nothing if the race does not exist.
+func saveRevision(ctx context.Context, db bun.IDB, actor auditActor, raceID string) error {
+	_, err := db.NewRaw(`
+		INSERT INTO revisions (race_id, username, endpoint, snapshot)
+		SELECT rc.race_id, ?, ?, `+revisionSnapshotSQL+`
+		FROM races rc WHERE rc.race_id = ?`,
+		actor.Username, actor.Endpoint, raceID,
+	).Exec(ctx)
+	return err
+}
+
+// ListRevisions returns the revisions of a race, newest first, without snapshots.
+func (h *Handler) ListRevisions(c echo.Context) error {
+	raceID, err := strconv.Atoi(c.QueryParam("raceID"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing or invalid raceID param")
+	}
+
+	var revs []models.Revision
+	err = h.db.NewSelect().Model(&revs).
+		Column("rv.id", "rv.race_id", "rv.username", "rv.endpoint", "rv.created_at").
+		Where("rv.race_id = ?", raceID).
+		OrderExpr("rv.id DESC").
+		Scan(c.Request().Context())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if revs == nil {
+		revs = []models.Revision{}
+	}
+	return c.JSON(http.StatusOK, revs)
+}
+
+// DiffRevisions compares revision from with revision to, or with the current
+// rows when to is omitted. Only columns that differ are returned.
+func (h *Handler) DiffRevisions(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	fromID, err := strconv.Atoi(c.QueryParam("from"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing or invalid from param")
+	}
+	from, err := h.loadRevision(ctx, h.db, fromID)
+	if err != nil {
+		return err
+	}
+
+	diff := revisionDiff{RaceID: from.RaceID, From: from.ID}
+	var toSnap json.RawMessage
+	if t := c.QueryParam("to"); t != "" {
+		toID, err := strconv.Atoi(t)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid to param")
+		}
+		to, err := h.loadRevision(ctx, h.db, toID)
+		if err != nil {
+			return err
+		}
+		if to.RaceID != from.RaceID {
+			return echo.NewHTTPError(http.StatusBadRequest, "revisions belong to different races")
+		}
+		diff.To = &to.ID
+		toSnap = to.Snapshot
+	} else {
+		err := h.db.NewRaw(`SELECT `+revisionSnapshotSQL+` FROM races rc WHERE rc.race_id = ?`, from.RaceID).
+			Scan(ctx, &toSnap)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "race no longer exists")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	var a, b revisionSnapshot
+	if err := json.Unmarshal(from.Snapshot, &a); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := json.Unmarshal(toSnap, &b); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	diff.Race = diffColumns(a.Race, b.Race)
+	diff.Results = diffResults(a.Results, b.Results)
+
+	return c.JSON(http.StatusOK, diff)
+}
+
+// RestoreRevision writes the analysis columns of a revision back onto the race
+// and its results in one transaction, recomputing the runners' horse
+// aggregates as placings may change. The state being replaced is saved as a
+// new revision first, so a restore can itself be undone.
+func (h *Handler) RestoreRevision(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid revision id")
+	}
+
+	ctx := c.Request().Context()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+
+	rev, err := h.loadRevision(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	var snap struct {
+		Race    json.RawMessage `json:"race"`
+		Results json.RawMessage `json:"results"`
+	}
+	if err := json.Unmarshal(rev.Snapshot, &snap); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	var resultIDs []struct {
+		ID int `json:"id"`
+	}
+	if err := json.Unmarshal(snap.Results, &resultIDs); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	actor := auditActorFrom(c)
+	raceID := strconv.Itoa(rev.RaceID)
+	if err := saveRevision(ctx, tx, actor, raceID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	audit := actor.begin(tx)
+	if err := audit.track(ctx, "races", "race_id = ?", rev.RaceID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	for _, r := range resultIDs {
+		if err := audit.track(ctx, "results", "id = ?", r.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE races SET `+restoreSetList(revisionRaceColumns)+`, version = races.version + 1
+		FROM jsonb_populate_record(NULL::races, ?::jsonb) s
+		WHERE races.race_id = s.race_id`,
+		string(snap.Race),
+	)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "race no longer exists")
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE results SET `+restoreSetList(revisionResultColumns)+`, version = results.version + 1
+		FROM jsonb_populate_recordset(NULL::results, ?::jsonb) s
+		WHERE results.id = s.id AND results.race_id = s.race_id`,
+		string(snap.Results),
+	); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := recomputeRaceHorses(ctx, tx, audit, rev.RaceID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := audit.record(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err = tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed = true
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+func (h *Handler) loadRevision(ctx context.Context, db bun.IDB, id int) (*models.Revision, error) {
+	rev := &models.Revision{}
+	err := db.NewSelect().Model(rev).Where("rv.id = ?", id).Scan(ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "revision not found")
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return rev, nil
+}
+
+// restoreSetList builds "col = s.col, ..." for an UPDATE ... FROM populated record s.
+func restoreSetList(cols []string) string {
+	set := make([]string, len(cols))
+	for i, col := range cols {
+		set[i] = col + " = s." + col
+	}
+	return strings.Join(set, ", ")
+}
+
+// diffColumns returns the columns whose values differ between two row snapshots.
+func diffColumns(a, b map[string]json.RawMessage) map[string]fieldChange {
+	out := map[string]fieldChange{}
+	for col, av := range a {
+		if bv := b[col]; !bytes.Equal(av, bv) {
+			out[col] = fieldChange{From: nullJSON(av), To: nullJSON(bv)}
+		}
+	}
+	for col, bv := range b {
+		if _, ok := a[col]; !ok {
+			out[col] = fieldChange{From: nullJSON(nil), To: nullJSON(bv)}
+		}
+	}
+	return out
+}
+
+// diffResults pairs result rows by id and reports changed, added and removed rows.
+func diffResults(a, b []map[string]json.RawMessage) []resultChange {
+	byID := func(rows []map[string]json.RawMessage) map[int]map[string]json.RawMessage {
+		m := make(map[int]map[string]json.RawMessage, len(rows))
+		for _, row := range rows {
+			var id int
+			if json.Unmarshal(row["id"], &id) == nil {
+				m[id] = row
+			}
+		}
+		return m
+	}
+	am, bm := byID(a), byID(b)
+
+	out := []resultChange{}
+	for id, arow := range am {
+		brow, ok := bm[id]
+		if !ok {
+			out = append(out, resultChange{ID: id, Status: "removed"})
+			continue
+		}
+		if changes := diffColumns(arow, brow); len(changes) > 0 {
+			out = append(out, resultChange{ID: id, Status: "changed", Changes: changes})
+		}
+	}
+	for id := range bm {
+		if _, ok := am[id]; !ok {
+			out = append(out, resultChange{ID: id, Status: "added"})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+func nullJSON(v json.RawMessage) json.RawMessage {
+	if v == nil {
+		return json.RawMessage("null")
+	}
+	return v
+}
@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/uptrace/bun"
+	"go.uber.org/zap"
+
+	mw "github.com/padraicbc/mikeapi/middleware"
+	"github.com/padraicbc/mikeapi/models"
+)
+
+type tokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresAt    int64  `json:"expires_at"`
+	// MFAEnrollmentRequired is set when the user's role requires 2FA they have
+	// not enrolled in; the token then only carries the viewer role.
+	MFAEnrollmentRequired bool `json:"mfa_enrollment_required,omitempty"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// randomToken returns n random bytes encoded as unpadded base64url.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hex SHA-256 of a high-entropy token for storage and lookup.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens stores a new refresh token for the session and signs a matching access token.
+// Users whose role requires 2FA but who have not enrolled are issued the viewer role.
+func (h *Handler) issueTokens(ctx context.Context, db bun.IDB, user *models.User, sessionID string) (*tokenPair, error) {
+	role := user.Role
+	needsEnrollment := false
+	if !user.TOTPEnabled {
+		required, err := roleRequiresTOTP(ctx, db, user.Role)
+		if err != nil {
+			return nil, err
+		}
+		if required {
+			role, needsEnrollment = models.RoleViewer, true
+		}
+	}
+
+	refresh, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	jti, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	rt := &models.RefreshToken{
+		UserID:    user.ID,
+		SessionID: sessionID,
+		TokenHash: hashToken(refresh),
+		ExpiresAt: now.Add(h.RefreshTokenTTL),
+		CreatedAt: now,
+	}
+	if _, err := db.NewInsert().Model(rt).Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	expiresAt := now.Add(h.AccessTokenTTL)
+	claims := &mw.Claims{
+		Username:  user.Username,
+		UserHash:  mw.UserHashFromUsername(user.Username, h.JWTKey),
+		Role:      role,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	tokenString, err := mw.Sign(h.JWTKeys, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenPair{
+		Token:                 tokenString,
+		RefreshToken:          refresh,
+		ExpiresAt:             expiresAt.Unix(),
+		MFAEnrollmentRequired: needsEnrollment,
+	}, nil
+}
+
+// revokeSession revokes every outstanding refresh token in the session.
+func revokeSession(ctx context.Context, db bun.IDB, sessionID string) error {
+	_, err := db.NewUpdate().Model((*models.RefreshToken)(nil)).
+		Set("revoked_at = now()").
+		Where("session_id = ?", sessionID).
+		Where("revoked_at IS NULL").
+		Exec(ctx)
+	return err
+}
+
+// IsTokenRevoked reports whether the access token's jti was revoked or its session has ended.
+func (h *Handler) IsTokenRevoked(ctx context.Context, claims *mw.Claims) (bool, error) {
+	var revoked bool
+	err := h.db.NewRaw(`
+		SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = ?)
+		    OR NOT EXISTS (SELECT 1 FROM refresh_tokens WHERE session_id = ? AND revoked_at IS NULL)`,
+		claims.ID, claims.SessionID,
+	).Scan(ctx, &revoked)
+	return revoked, err
+}
+
+// Refresh exchanges a refresh token for a new access/refresh pair.
+// Each refresh token is single use; presenting a used token revokes its whole session.
+func (h *Handler) Refresh(c echo.Context) error {
+	var req refreshRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	req.RefreshToken = strings.TrimSpace(req.RefreshToken)
+	if req.RefreshToken == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "refresh_token is required")
+	}
+
+	ctx := c.Request().Context()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+
+	rt := &models.RefreshToken{}
+	err = tx.NewSelect().Model(rt).
+		Where("token_hash = ?", hashToken(req.RefreshToken)).
+		For("UPDATE").
+		Scan(ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid refresh token")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if rt.RevokedAt != nil {
+		// A rotated token was replayed: assume it leaked and end the session.
+		if err := revokeSession(ctx, tx, rt.SessionID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		if err = tx.Commit(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		committed = true
+		zap.L().Warn("refresh token reuse detected",
+			zap.Int("user_id", rt.UserID), zap.String("session_id", rt.SessionID))
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid refresh token")
+	}
+	if time.Now().After(rt.ExpiresAt) {
+		return echo.NewHTTPError(http.StatusUnauthorized, "refresh token expired")
+	}
+
+	user := &models.User{}
+	if err := tx.NewSelect().Model(user).Where("id = ?", rt.UserID).Scan(ctx); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid refresh token")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if user.Disabled {
+		return echo.NewHTTPError(http.StatusUnauthorized, "account disabled")
+	}
+
+	if _, err := tx.NewUpdate().Model(rt).Set("revoked_at = now()").WherePK().Exec(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	pair, err := h.issueTokens(ctx, tx, user, rt.SessionID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err = tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed = true
+
+	return c.JSON(http.StatusOK, pair)
+}
+
+// Signout revokes the caller's access token and every refresh token in its session.
+func (h *Handler) Signout(c echo.Context) error {
+	claims, ok := c.Get("claims").(*mw.Claims)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "unauthorized")
+	}
+
+	ctx := c.Request().Context()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if err := revokeSession(ctx, tx, claims.SessionID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	expiresAt := time.Now().Add(h.AccessTokenTTL)
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+	revoked := &models.RevokedToken{JTI: claims.ID, ExpiresAt: expiresAt}
+	if _, err := tx.NewInsert().Model(revoked).On("CONFLICT DO NOTHING").Exec(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	// Expired entries can never match a valid token, so prune them here.
+	if _, err := tx.NewDelete().Model((*models.RevokedToken)(nil)).
+		Where("expires_at < now()").
+		Exec(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err = tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed = true
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/uptrace/bun"
+
+	"github.com/padraicbc/mikeapi/config"
+	bundb "github.com/padraicbc/mikeapi/db"
+	mw "github.com/padraicbc/mikeapi/middleware"
+	"github.com/padraicbc/mikeapi/models"
+)
+
+// testDB returns the database at TEST_DATABASE_URL, migrated to the current
+// schema. Handlers commit their own transactions, so tests clean up the rows
+// they create. The test is skipped when the variable is not set.
+func testDB(t *testing.T) *bun.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	db, err := bundb.Open(ctx, &config.Config{DatabaseURL: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := bundb.MigrateUp(ctx, db, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// sessionHandler returns a Handler on db and a new viewer, deleted together
+// with its sessions when the test ends.
+func sessionHandler(t *testing.T, db *bun.DB) (*Handler, *models.User) {
+	t.Helper()
+	ks, err := config.NewJWTKeySet(&config.JWTKey{ID: "test", Alg: config.AlgHS256, Secret: []byte("test-secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{db: db, JWTKey: []byte("test-secret"), JWTKeys: ks, AccessTokenTTL: time.Minute, RefreshTokenTTL: time.Hour}
+
+	ctx := context.Background()
+	user := &models.User{Username: fmt.Sprintf("session-test-%d", time.Now().UnixNano()), Password: "-", Role: models.RoleViewer}
+	if _, err := db.NewInsert().Model(user).Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_, _ = db.NewDelete().Model((*models.RefreshToken)(nil)).Where("user_id = ?", user.ID).Exec(ctx)
+		_, _ = db.NewDelete().Model(user).WherePK().Exec(ctx)
+	})
+	return h, user
+}
+
+// refresh posts a refresh token to h.Refresh and returns the new pair, or
+// the HTTP status it was refused with.
+func refresh(t *testing.T, h *Handler, token string) (*tokenPair, int) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/rp/refresh", strings.NewReader(fmt.Sprintf(`{"refresh_token": %q}`, token)))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	if err := h.Refresh(echo.New().NewContext(req, rec)); err != nil {
+		he, ok := err.(*echo.HTTPError)
+		if !ok {
+			t.Fatal(err)
+		}
+		return nil, he.Code
+	}
+	pair := &tokenPair{}
+	if err := json.Unmarshal(rec.Body.Bytes(), pair); err != nil {
+		t.Fatal(err)
+	}
+	return pair, rec.Code
+}
+
+func accessRevoked(t *testing.T, h *Handler, token string) bool {
+	t.Helper()
+	claims, err := mw.ParseToken(h.JWTKeys, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := h.IsTokenRevoked(context.Background(), claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return revoked
+}
+
+func TestRefreshReuseRevokesSession(t *testing.T) {
+	h, user := sessionHandler(t, testDB(t))
+	first, err := h.issueTokens(context.Background(), h.db, user, "reuse-"+user.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, code := refresh(t, h, first.RefreshToken)
+	if code != http.StatusOK || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("first refresh: %d, %+v", code, second)
+	}
+	if accessRevoked(t, h, second.Token) {
+		t.Fatal("the rotated session is already revoked")
+	}
+
+	// Replaying the rotated token is refused and ends the session, so the
+	// token pair it was exchanged for stops working too.
+	if _, code := refresh(t, h, first.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("replayed refresh token: %d, want 401", code)
+	}
+	if _, code := refresh(t, h, second.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("refresh after reuse: %d, want 401", code)
+	}
+	if !accessRevoked(t, h, second.Token) {
+		t.Error("access token still valid after refresh token reuse")
+	}
+	if _, code := refresh(t, h, "not-a-token"); code != http.StatusUnauthorized {
+		t.Errorf("unknown refresh token: %d, want 401", code)
+	}
+}
+
+func TestSignoutRevokesJTI(t *testing.T) {
+	h, user := sessionHandler(t, testDB(t))
+	ctx := context.Background()
+	pair, err := h.issueTokens(ctx, h.db, user, "signout-"+user.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := mw.ParseToken(h.JWTKeys, pair.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_, _ = h.db.NewDelete().Model((*models.RevokedToken)(nil)).Where("jti = ?", claims.ID).Exec(ctx)
+	})
+	if accessRevoked(t, h, pair.Token) {
+		t.Fatal("a fresh access token is revoked")
+	}
+
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/rp/signout", nil), httptest.NewRecorder())
+	c.Set("claims", claims)
+	if err := h.Signout(c); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := h.db.NewSelect().Model((*models.RevokedToken)(nil)).Where("jti = ?", claims.ID).Count(ctx)
+	if err != nil || n != 1 {
+		t.Errorf("revoked_tokens rows for the jti = %d, %v; want 1", n, err)
+	}
+	if !accessRevoked(t, h, pair.Token) {
+		t.Error("access token still valid after signout")
+	}
+	if _, code := refresh(t, h, pair.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("refresh after signout: %d, want 401", code)
+	}
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// loginThrottle tracks failed sign-ins per key (client IP or username) in memory.
+// After free failures each further failure doubles a backoff delay; maxFails
+// failures lock the key out for lockout. Keys are forgotten once quiet for lockout.
+type loginThrottle struct {
+	mu       sync.Mutex
+	attempts map[string]*loginAttempts
+
+	free     int
+	base     time.Duration
+	maxFails int
+	lockout  time.Duration
+}
+
+type loginAttempts struct {
+	failures     int
+	last         time.Time
+	blockedUntil time.Time
+}
+
+func newLoginThrottle(free int, base time.Duration, maxFails int, lockout time.Duration) *loginThrottle {
+	return &loginThrottle{
+		attempts: map[string]*loginAttempts{},
+		free:     free,
+		base:     base,
+		maxFails: maxFails,
+		lockout:  lockout,
+	}
+}
+
+// retryAfter returns how long key must wait before its next attempt, or zero.
+func (t *loginThrottle) retryAfter(key string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	a, ok := t.attempts[key]
+	if !ok || !now.Before(a.blockedUntil) {
+		return 0
+	}
+	return a.blockedUntil.Sub(now)
+}
+
+// fail records a failed attempt for key and reports whether it triggered a lockout.
+func (t *loginThrottle) fail(key string, now time.Time) (lockedOut bool, failures int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sweep(now)
+
+	a, ok := t.attempts[key]
+	if !ok {
+		a = &loginAttempts{}
+		t.attempts[key] = a
+	}
+	a.failures++
+	a.last = now
+
+	switch {
+	case a.failures >= t.maxFails:
+		a.blockedUntil = now.Add(t.lockout)
+		lockedOut = a.failures == t.maxFails
+	case a.failures > t.free:
+		delay := t.base << (a.failures - t.free - 1)
+		if delay <= 0 || delay > t.lockout {
+			delay = t.lockout
+		}
+		a.blockedUntil = now.Add(delay)
+	}
+	return lockedOut, a.failures
+}
+
+// reset forgets every failure recorded for key.
+func (t *loginThrottle) reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.attempts, key)
+}
+
+// sweep drops keys that are no longer blocked and have been quiet for a lockout period.
+// The caller must hold t.mu.
+func (t *loginThrottle) sweep(now time.Time) {
+	for key, a := range t.attempts {
+		if now.After(a.blockedUntil) && now.Sub(a.last) > t.lockout {
+			delete(t.attempts, key)
+		}
+	}
+}
@@ -79,14 +79,38 @@ func (h *Handler) SaveTrainerText(c echo.Context) error {
 	}
 	defer c.Request().Body.Close()
 
-	_, err = h.db.NewUpdate().
+	ctx := c.Request().Context()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+	audit := auditActorFrom(c).begin(tx)
+
+	if err := audit.track(ctx, "trainers", "trainer = ?", tr); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	_, err = tx.NewUpdate().
 		TableExpr("trainers").
 		Set("info = ?", string(bdy)).
 		Where("trainer = ?", tr).
-		Exec(c.Request().Context())
+		Exec(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
+	if err := audit.record(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err = tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed = true
+
 	return c.NoContent(http.StatusOK)
 }
@@ -0,0 +1,481 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/uptrace/bun"
+	"golang.org/x/crypto/bcrypt"
+
+	mw "github.com/padraicbc/mikeapi/middleware"
+	"github.com/padraicbc/mikeapi/models"
+	"github.com/padraicbc/mikeapi/totp"
+)
+
+const (
+	mfaChallengeTTL   = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+type mfaChallenge struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+type signinTOTPRequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type totpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type disableTOTPRequest struct {
+	Password     string `json:"password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type rolePolicyRequest struct {
+	RequireTOTP bool `json:"requireTOTP"`
+}
+
+// roleRequiresTOTP reports whether admins require two-factor authentication for role.
+func roleRequiresTOTP(ctx context.Context, db bun.IDB, role string) (bool, error) {
+	var required bool
+	err := db.NewSelect().Model((*models.RolePolicy)(nil)).
+		Column("require_totp").
+		Where("role = ?", role).
+		Scan(ctx, &required)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return required, err
+}
+
+// newMFAChallenge signs the short-lived token a client exchanges, together
+// with a TOTP or recovery code, for real tokens at /rp/signin/2fa.
+func (h *Handler) newMFAChallenge(user *models.User) (*mfaChallenge, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	token, err := mw.Sign(h.JWTKeys, &mw.Claims{
+		Username: user.Username,
+		Purpose:  mw.PurposeMFA,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(mfaChallengeTTL)),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mfaChallenge{MFARequired: true, MFAToken: token}, nil
+}
+
+// newRecoveryCodes replaces the user's recovery codes and returns the new plain-text codes.
+func newRecoveryCodes(ctx context.Context, db bun.IDB, userID int) ([]string, error) {
+	if _, err := db.NewDelete().Model((*models.RecoveryCode)(nil)).
+		Where("user_id = ?", userID).
+		Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, recoveryCodeCount)
+	rows := make([]models.RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(enc.EncodeToString(b))
+		codes[i] = s[:4] + "-" + s[4:]
+		rows[i] = models.RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(codes[i])}
+	}
+
+	if _, err := db.NewInsert().Model(&rows).Exec(ctx); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	return hashToken(strings.ReplaceAll(strings.ToLower(strings.TrimSpace(code)), "-", ""))
+}
+
+// checkSecondFactor accepts a fresh TOTP code or an unused recovery code for
+// the user, consuming it so it cannot be replayed.
+func checkSecondFactor(ctx context.Context, db bun.IDB, user *models.User, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		res, err := db.NewUpdate().Model((*models.RecoveryCode)(nil)).
+			Set("used_at = now()").
+			Where("user_id = ?", user.ID).
+			Where("code_hash = ?", hashRecoveryCode(recoveryCode)).
+			Where("used_at IS NULL").
+			Exec(ctx)
+		if err != nil {
+			return false, err
+		}
+		n, _ := res.RowsAffected()
+		return n == 1, nil
+	}
+
+	if user.TOTPSecret == nil {
+		return false, nil
+	}
+	step, ok := totp.VerifyFresh(*user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return false, nil
+	}
+	// The step is checked again here in case a concurrent sign-in used it.
+	res, err := db.NewUpdate().Model(user).
+		Set("totp_last_step = ?", step).
+		WherePK().
+		Where("totp_last_step < ?", step).
+		Exec(ctx)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// currentUser loads the signed-in user behind a JWT. API keys have no account.
+func currentUser(ctx context.Context, db bun.IDB, c echo.Context) (*models.User, error) {
+	if _, ok := c.Get("claims").(*mw.Claims); !ok {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "account endpoints require a signed-in user")
+	}
+	username, _ := c.Get("username").(string)
+
+	user := &models.User{}
+	err := db.NewSelect().Model(user).Where("username = ?", username).Scan(ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, echo.NewHTTPError(http.StatusUnauthorized, "unauthorized")
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return user, nil
+}
+
+// SigninTOTP completes a two-step sign-in: it checks the challenge token from
+// Signin plus a TOTP or recovery code and returns access and refresh tokens.
+func (h *Handler) SigninTOTP(c echo.Context) error {
+	var req signinTOTPRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	claims, err := mw.ParseToken(h.JWTKeys, req.MFAToken)
+	if err != nil || claims.Purpose != mw.PurposeMFA {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid or expired mfa_token")
+	}
+
+	now := time.Now()
+	userKey := "user:" + strings.ToLower(claims.Username)
+	if wait := h.signinThrottle.retryAfter(userKey, now); wait > 0 {
+		return echo.NewHTTPError(http.StatusTooManyRequests, "too many sign-in attempts, try again later")
+	}
+
+	ctx := c.Request().Context()
+	user := &models.User{}
+	if err := h.db.NewSelect().Model(user).Where("username = ?", claims.Username).Scan(ctx); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errSigninFailed
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if user.Disabled || !user.TOTPEnabled {
+		return errSigninFailed
+	}
+
+	ok, err := checkSecondFactor(ctx, h.db, user, req.Code, req.RecoveryCode)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if !ok {
+		h.recordSigninFailure(c, user.Username, "ip:"+c.RealIP(), userKey, now)
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid two-factor code")
+	}
+	h.signinThrottle.reset(userKey)
+
+	sessionID, err := randomToken(16)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	pair, err := h.issueTokens(ctx, h.db, user, sessionID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, pair)
+}
+
+// EnrollTOTP starts two-factor enrollment by generating a new secret and its
+// otpauth:// provisioning URI for a QR code. 2FA is enabled by VerifyTOTP.
+func (h *Handler) EnrollTOTP(c echo.Context) error {
+	ctx := c.Request().Context()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+
+	user, err := currentUser(ctx, tx, c)
+	if err != nil {
+		return err
+	}
+	if user.TOTPEnabled {
+		return echo.NewHTTPError(http.StatusConflict, "two-factor authentication is already enabled")
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	audit := auditActorFrom(c).begin(tx)
+	if err := audit.trackSecret(ctx, "users", "id = ?", user.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	user.TOTPSecret = &secret
+	if _, err := tx.NewUpdate().Model(user).Column("totp_secret").WherePK().Exec(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := audit.record(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err = tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed = true
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"secret": secret,
+		"uri":    totp.ProvisioningURI(h.TOTPIssuer, user.Username, secret),
+	})
+}
+
+// VerifyTOTP confirms enrollment with a code from the authenticator app,
+// enables 2FA and returns one-time recovery codes.
+func (h *Handler) VerifyTOTP(c echo.Context) error {
+	var req totpCodeRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	ctx := c.Request().Context()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+
+	user, err := currentUser(ctx, tx, c)
+	if err != nil {
+		return err
+	}
+	if user.TOTPEnabled {
+		return echo.NewHTTPError(http.StatusConflict, "two-factor authentication is already enabled")
+	}
+	if user.TOTPSecret == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "start enrollment first")
+	}
+
+	audit := auditActorFrom(c).begin(tx)
+	if err := audit.trackSecret(ctx, "users", "id = ?", user.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	ok, err := checkSecondFactor(ctx, tx, user, req.Code, "")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid two-factor code")
+	}
+
+	user.TOTPEnabled = true
+	if _, err := tx.NewUpdate().Model(user).Column("totp_enabled").WherePK().Exec(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	codes, err := newRecoveryCodes(ctx, tx, user.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := audit.record(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err = tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed = true
+
+	return c.JSON(http.StatusOK, map[string][]string{"recovery_codes": codes})
+}
+
+// DisableTOTP turns two-factor authentication off after checking the password
+// and a current code. It is refused when the user's role requires 2FA.
+func (h *Handler) DisableTOTP(c echo.Context) error {
+	var req disableTOTPRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	ctx := c.Request().Context()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+
+	user, err := currentUser(ctx, tx, c)
+	if err != nil {
+		return err
+	}
+	if !user.TOTPEnabled {
+		return echo.NewHTTPError(http.StatusBadRequest, "two-factor authentication is not enabled")
+	}
+	required, err := roleRequiresTOTP(ctx, tx, user.Role)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if required {
+		return echo.NewHTTPError(http.StatusForbidden, "two-factor authentication is required for your role")
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "incorrect password")
+	}
+	audit := auditActorFrom(c).begin(tx)
+	if err := audit.trackSecret(ctx, "users", "id = ?", user.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	ok, err := checkSecondFactor(ctx, tx, user, req.Code, req.RecoveryCode)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid two-factor code")
+	}
+
+	if _, err := tx.NewUpdate().Model(user).
+		Set("totp_enabled = false, totp_secret = NULL, totp_last_step = 0").
+		WherePK().
+		Exec(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if _, err := tx.NewDelete().Model((*models.RecoveryCode)(nil)).
+		Where("user_id = ?", user.ID).
+		Exec(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := audit.record(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err = tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed = true
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ListRolePolicies returns the security policy for every role.
+func (h *Handler) ListRolePolicies(c echo.Context) error {
+	var stored []models.RolePolicy
+	if err := h.db.NewSelect().Model(&stored).Scan(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	byRole := map[string]models.RolePolicy{}
+	for _, p := range stored {
+		byRole[p.Role] = p
+	}
+	out := make([]models.RolePolicy, 0, 3)
+	for _, role := range []string{models.RoleViewer, models.RoleAnalyst, models.RoleAdmin} {
+		p, ok := byRole[role]
+		if !ok {
+			p = models.RolePolicy{Role: role}
+		}
+		out = append(out, p)
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// SetRolePolicy sets whether users with the :role role must use two-factor authentication.
+// Unenrolled users of that role are limited to viewer access until they enroll.
+func (h *Handler) SetRolePolicy(c echo.Context) error {
+	role := c.Param("role")
+	if !models.ValidRole(role) {
+		return echo.NewHTTPError(http.StatusBadRequest, "role must be viewer, analyst or admin")
+	}
+
+	var req rolePolicyRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	ctx := c.Request().Context()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+	audit := auditActorFrom(c).begin(tx)
+	if err := audit.track(ctx, "role_policies", "role = ?", role); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	policy := &models.RolePolicy{Role: role, RequireTOTP: req.RequireTOTP}
+	if _, err := tx.NewInsert().Model(policy).
+		On("CONFLICT (role) DO UPDATE SET require_totp = EXCLUDED.require_totp").
+		Exec(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := audit.record(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err = tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed = true
+
+	return c.JSON(http.StatusOK, policy)
+}
@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/uptrace/bun"
+
+	"github.com/padraicbc/mikeapi/models"
+)
+
+type createUserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+type resetPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+// userIDParam parses the :id path parameter.
+func userIDParam(c echo.Context) (int, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "invalid user id")
+	}
+	return id, nil
+}
+
+// revokeUserSessions revokes every outstanding refresh token belonging to the user,
+// which also invalidates their access tokens. A non-empty keepSession is left alone.
+func revokeUserSessions(ctx context.Context, db bun.IDB, userID int, keepSession string) error {
+	q := db.NewUpdate().Model((*models.RefreshToken)(nil)).
+		Set("revoked_at = now()").
+		Where("user_id = ?", userID).
+		Where("revoked_at IS NULL")
+	if keepSession != "" {
+		q = q.Where("session_id <> ?", keepSession)
+	}
+	_, err := q.Exec(ctx)
+	return err
+}
+
+// ListUsers returns every user ordered by username.
+func (h *Handler) ListUsers(c echo.Context) error {
+	var users []models.User
+	if err := h.db.NewSelect().Model(&users).OrderExpr("u.username ASC").Scan(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if users == nil {
+		users = []models.User{}
+	}
+	return c.JSON(http.StatusOK, users)
+}
+
+// CreateUser adds a user with the given password and role (viewer by default).
+func (h *Handler) CreateUser(c echo.Context) error {
+	var req createUserRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	req.Username = strings.TrimSpace(req.Username)
+	req.Role = strings.ToLower(strings.TrimSpace(req.Role))
+	if req.Role == "" {
+		req.Role = models.RoleViewer
+	}
+	if !models.ValidRole(req.Role) {
+		return echo.NewHTTPError(http.StatusBadRequest, "role must be viewer, analyst or admin")
+	}
+
+	hash, err := HashPasswordForUser(req.Username, req.Password, h.PasswordPolicy)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	user := &models.User{
+		Username: req.Username,
+		Password: hash,
+		Role:     req.Role,
+	}
+
+	ctx := c.Request().Context()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+	audit := auditActorFrom(c).begin(tx)
+
+	if _, err := tx.NewInsert().Model(user).Exec(ctx); err != nil {
+		if strings.Contains(strings.ToLower(err.Error()), "duplicate key value") {
+			return echo.NewHTTPError(http.StatusConflict, "user already exists")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	audit.trackNew("users", "id = ?", user.ID)
+
+	if err := audit.record(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err = tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed = true
+
+	return c.JSON(http.StatusCreated, user)
+}
+
+// DisableUser blocks a user from signing in and ends their sessions.
+func (h *Handler) DisableUser(c echo.Context) error {
+	return h.setUserDisabled(c, true)
+}
+
+// EnableUser lets a previously disabled user sign in again.
+func (h *Handler) EnableUser(c echo.Context) error {
+	return h.setUserDisabled(c, false)
+}
+
+func (h *Handler) setUserDisabled(c echo.Context, disabled bool) error {
+	id, err := userIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+
+	user, err := lockOtherUser(ctx, tx, c, id)
+	if err != nil {
+		return err
+	}
+	audit := auditActorFrom(c).begin(tx)
+	if err := audit.track(ctx, "users", "id = ?", user.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	user.Disabled = disabled
+	if _, err := tx.NewUpdate().Model(user).Column("disabled").WherePK().Exec(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if disabled {
+		if err := revokeUserSessions(ctx, tx, user.ID, ""); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	if err := audit.record(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err = tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed = true
+
+	return c.JSON(http.StatusOK, user)
+}
+
+// ResetUserPassword sets a new password for a user and ends their sessions.
+// When no password is supplied a random temporary one is generated and returned.
+func (h *Handler) ResetUserPassword(c echo.Context) error {
+	id, err := userIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	var req resetPasswordRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if req.Password == "" {
+		if req.Password, err = randomToken(18); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	ctx := c.Request().Context()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+
+	user := &models.User{}
+	if err := tx.NewSelect().Model(user).Where("id = ?", id).For("UPDATE").Scan(ctx); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "user not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	hash, err := HashPasswordForUser(user.Username, req.Password, h.PasswordPolicy)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	audit := auditActorFrom(c).begin(tx)
+	if err := audit.trackSecret(ctx, "users", "id = ?", user.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	user.Password = hash
+	if _, err := tx.NewUpdate().Model(user).Column("password").WherePK().Exec(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := revokeUserSessions(ctx, tx, user.ID, ""); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := audit.record(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err = tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed = true
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"username": user.Username,
+		"password": req.Password,
+	})
+}
+
+// DeleteUser removes a user and their refresh tokens.
+func (h *Handler) DeleteUser(c echo.Context) error {
+	id, err := userIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+
+	user, err := lockOtherUser(ctx, tx, c, id)
+	if err != nil {
+		return err
+	}
+	audit := auditActorFrom(c).begin(tx)
+	if err := audit.track(ctx, "users", "id = ?", user.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if _, err := tx.NewDelete().Model((*models.RefreshToken)(nil)).
+		Where("user_id = ?", user.ID).
+		Exec(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if _, err := tx.NewDelete().Model(user).WherePK().Exec(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := audit.record(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err = tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	committed = true
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// lockOtherUser loads a user for update, refusing to let admins act on their own account.
+func lockOtherUser(ctx context.Context, tx bun.Tx, c echo.Context, id int) (*models.User, error) {
+	user := &models.User{}
+	if err := tx.NewSelect().Model(user).Where("id = ?", id).For("UPDATE").Scan(ctx); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "user not found")
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	requester, _ := c.Get("username").(string)
+	if strings.EqualFold(requester, user.Username) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "cannot disable or delete your own account")
+	}
+	return user, nil
+}
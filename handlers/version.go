@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/uptrace/bun"
+
+	"github.com/padraicbc/mikeapi/models"
+)
+
+// errStale marks a versioned UPDATE that matched no row because the row has
+// been changed since the client read it.
+var errStale = errors.New("stale version")
+
+// versionParam reads the race version a client last saw.
+func (h *Handler) versionParam(c echo.Context) (*int, error) {
+	v := c.QueryParam("version")
+	if v == "" {
+		return nil, h.requireVersion("version param")
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid version param")
+	}
+	return &n, nil
+}
+
+// requireVersion rejects a save that does not say which version it was
+// based on with 428, unless AllowUnversionedSaves is set, when the save goes
+// ahead without the stale-write check.
+func (h *Handler) requireVersion(what string) error {
+	if h.AllowUnversionedSaves {
+		return nil
+	}
+	return echo.NewHTTPError(http.StatusPreconditionRequired, what+" is required; reload the race and save again")
+}
+
+// missedRow explains an UPDATE of the row of table where key = id: nil if
+// it matched, 404 if there is no such row and errStale if its version has
+// moved on.
+func missedRow(ctx context.Context, tx bun.Tx, res sql.Result, table, key string, id interface{}) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if n > 0 {
+		return nil
+	}
+	var exists bool
+	if err := tx.NewRaw(`SELECT EXISTS (SELECT 1 FROM ? WHERE ? = ?)`, bun.Ident(table), bun.Ident(key), id).
+		Scan(ctx, &exists); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if !exists {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("%s %s = %v not found", table, key, id))
+	}
+	return errStale
+}
+
+// resultsConflict answers a stale write with 409 and the race as currently
+// stored, in the Results payload shape. The caller must have rolled back.
+func (h *Handler) resultsConflict(ctx context.Context, raceID string) error {
+	var rows []resultsAnalysisRow
+	q := models.ResultsJoinSQL + `WHERE rc.race_id = ? ORDER BY LENGTH(r.placed), r.placed`
+	if err := h.db.NewRaw(q, raceID).Scan(ctx, &rows); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return conflictError(groupResultsByRace(rows))
+}
+
+// postRaceConflict is resultsConflict for the ResultsPostRace payload shape.
+func (h *Handler) postRaceConflict(ctx context.Context, raceID string) error {
+	var rows []postRaceRow
+	q := postRaceJoinSQL + `WHERE rc.race_id = ? ORDER BY r.id`
+	if err := h.db.NewRaw(q, raceID).Scan(ctx, &rows); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return conflictError(groupPostRaceByRace(rows))
+}
+
+func conflictError[T any](races []T) error {
+	var current interface{}
+	if len(races) > 0 {
+		current = races[0]
+	}
+	return echo.NewHTTPError(http.StatusConflict, map[string]interface{}{
+		"message": "race was changed by someone else; reload and reapply your edits",
+		"current": current,
+	})
+}
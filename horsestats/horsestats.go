@@ -0,0 +1,235 @@
+// Package horsestats rebuilds the aggregate columns on horses (last win,
+// last run weights and claims, highest winning weight and rating) from
+// results. Ingestion and amendments keep them current for the horses they
+// touch; cmd/horsestats and /rp/admin/horse-stats/recompute repair drift
+// after bulk loads or hand edits.
+package horsestats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// ErrInvalid marks errors in the Options, as opposed to database failures.
+var ErrInvalid = errors.New("horsestats")
+
+// Tracker is told about each horse before its row is updated, normally to
+// record an audit trail. A nil Tracker is allowed.
+type Tracker interface {
+	Track(ctx context.Context, table, where string, args ...interface{}) error
+}
+
+// Options choose the horses to recompute. HorseIDs and the From/To race
+// dates (inclusive, YYYY-MM-DD) narrow the set together; with none given
+// every horse is recomputed. A horse picked by date is still rebuilt from
+// all of its results.
+type Options struct {
+	HorseIDs []int
+	From, To string
+	// DryRun reports what would change without updating anything.
+	DryRun bool
+}
+
+// Report lists the horses whose columns changed, or would change.
+type Report struct {
+	DryRun  bool     `json:"dryRun"`
+	Checked int      `json:"checked"`
+	Changed []Change `json:"changed"`
+}
+
+// Change is one horse's updated columns.
+type Change struct {
+	HorseID int           `json:"horseID"`
+	Horse   string        `json:"horse"`
+	Columns []ColumnValue `json:"columns"`
+}
+
+// ColumnValue is a column's stored and recomputed value; nil is NULL.
+type ColumnValue struct {
+	Column string `json:"column"`
+	Old    *int   `json:"old"`
+	New    *int   `json:"new"`
+}
+
+// stats are the aggregate columns of a horse.
+type stats struct {
+	LastWinID        *int `bun:"last_win_id"`
+	HighestWinWeight *int `bun:"highest_win_weight"`
+	LastWinWeight    *int `bun:"last_win_weight"`
+	LastRunWeight    *int `bun:"last_run_weight"`
+	LastWinClaim     *int `bun:"last_win_claim"`
+	LastRunClaim     *int `bun:"last_run_claim"`
+	HighestWinOr     *int `bun:"highest_win_or"`
+}
+
+// columns are the stats columns in the order values returns them.
+var columns = []string{
+	"last_win_id", "highest_win_weight", "last_win_weight", "last_run_weight",
+	"last_win_claim", "last_run_claim", "highest_win_or",
+}
+
+func (s *stats) values() []*int {
+	return []*int{
+		s.LastWinID, s.HighestWinWeight, s.LastWinWeight, s.LastRunWeight,
+		s.LastWinClaim, s.LastRunClaim, s.HighestWinOr,
+	}
+}
+
+type horseStats struct {
+	HorseID int    `bun:"horse_id"`
+	Horse   string `bun:"horse"`
+	Old     stats  `bun:"embed:old_"`
+	New     stats  `bun:"embed:new_"`
+}
+
+// statsSQL pairs each scoped horse's stored columns with ones rebuilt from
+// its results, latest race first for the last-run and last-win values. A
+// winner is placed '1'. Horses without a win, or without results, get a NULL
+// last_win_id and zeros elsewhere, as new horses do.
+const statsSQL = `
+WITH scope AS (%s)
+SELECT h.horse_id, h.horse,
+	h.last_win_id AS old_last_win_id,
+	h.highest_win_weight AS old_highest_win_weight,
+	h.last_win_weight AS old_last_win_weight,
+	h.last_run_weight AS old_last_run_weight,
+	h.last_win_claim AS old_last_win_claim,
+	h.last_run_claim AS old_last_run_claim,
+	h.highest_win_or AS old_highest_win_or,
+	s.last_win_id AS new_last_win_id,
+	COALESCE(s.highest_win_weight, 0) AS new_highest_win_weight,
+	COALESCE(s.last_win_weight, 0) AS new_last_win_weight,
+	COALESCE(s.last_run_weight, 0) AS new_last_run_weight,
+	COALESCE(s.last_win_claim, 0) AS new_last_win_claim,
+	COALESCE(s.last_run_claim, 0) AS new_last_run_claim,
+	COALESCE(s.highest_win_or, 0) AS new_highest_win_or
+FROM horses h
+JOIN scope USING (horse_id)
+LEFT JOIN (
+	SELECT r.horse_id,
+		(array_agg(r.race_id ORDER BY rc.date DESC, rc.time DESC, r.race_id DESC) FILTER (WHERE r.placed = '1'))[1] AS last_win_id,
+		max(r.weight_carried) FILTER (WHERE r.placed = '1') AS highest_win_weight,
+		(array_agg(r.weight_carried ORDER BY rc.date DESC, rc.time DESC, r.race_id DESC) FILTER (WHERE r.placed = '1'))[1] AS last_win_weight,
+		(array_agg(r.weight_carried ORDER BY rc.date DESC, rc.time DESC, r.race_id DESC))[1] AS last_run_weight,
+		(array_agg(r.claim ORDER BY rc.date DESC, rc.time DESC, r.race_id DESC) FILTER (WHERE r.placed = '1'))[1] AS last_win_claim,
+		(array_agg(r.claim ORDER BY rc.date DESC, rc.time DESC, r.race_id DESC))[1] AS last_run_claim,
+		max(r.official_rat) FILTER (WHERE r.placed = '1') AS highest_win_or
+	FROM results r
+	JOIN races rc ON rc.race_id = r.race_id
+	WHERE r.horse_id IN (SELECT horse_id FROM scope)
+	GROUP BY r.horse_id
+) s ON s.horse_id = h.horse_id
+ORDER BY h.horse_id`
+
+// updateBatch caps the horses written by one UPDATE.
+const updateBatch = 500
+
+// Recompute rebuilds the aggregate columns of the horses opts selects and
+// updates those that differ, in db, which should be a transaction when track
+// records an audit trail.
+func Recompute(ctx context.Context, db bun.IDB, opts Options, track Tracker) (*Report, error) {
+	scope, args, err := scopeSQL(opts)
+	if err != nil {
+		return nil, err
+	}
+	var rows []horseStats
+	if err := db.NewRaw(fmt.Sprintf(statsSQL, scope), args...).Scan(ctx, &rows); err != nil {
+		return nil, err
+	}
+
+	report := &Report{DryRun: opts.DryRun, Checked: len(rows), Changed: []Change{}}
+	var changed []horseStats
+	for _, hs := range rows {
+		old, fresh := hs.Old.values(), hs.New.values()
+		var cols []ColumnValue
+		for i, col := range columns {
+			if !sameInt(old[i], fresh[i]) {
+				cols = append(cols, ColumnValue{Column: col, Old: old[i], New: fresh[i]})
+			}
+		}
+		if cols != nil {
+			report.Changed = append(report.Changed, Change{HorseID: hs.HorseID, Horse: hs.Horse, Columns: cols})
+			changed = append(changed, hs)
+		}
+	}
+	if opts.DryRun {
+		return report, nil
+	}
+
+	for start := 0; start < len(changed); start += updateBatch {
+		end := min(start+updateBatch, len(changed))
+		if err := update(ctx, db, changed[start:end], track); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// scopeSQL returns a query for the horse_ids opts selects.
+func scopeSQL(opts Options) (string, []interface{}, error) {
+	var where []string
+	var args []interface{}
+	if len(opts.HorseIDs) > 0 {
+		where = append(where, "horse_id IN (?)")
+		args = append(args, bun.In(opts.HorseIDs))
+	}
+	var dates []string
+	for _, f := range []struct{ op, val string }{{">=", opts.From}, {"<=", opts.To}} {
+		if f.val == "" {
+			continue
+		}
+		if _, err := time.Parse(time.DateOnly, f.val); err != nil {
+			return "", nil, fmt.Errorf("%w: bad date %q: want YYYY-MM-DD", ErrInvalid, f.val)
+		}
+		dates = append(dates, "rc.date "+f.op+" ?")
+		args = append(args, f.val)
+	}
+	if dates != nil {
+		where = append(where, `horse_id IN (
+			SELECT r.horse_id FROM results r JOIN races rc ON rc.race_id = r.race_id
+			WHERE `+strings.Join(dates, " AND ")+")")
+	}
+	if where == nil {
+		return "SELECT horse_id FROM horses", nil, nil
+	}
+	return "SELECT horse_id FROM horses WHERE " + strings.Join(where, " AND "), args, nil
+}
+
+// update writes the recomputed columns of rows.
+func update(ctx context.Context, db bun.IDB, rows []horseStats, track Tracker) error {
+	values := make([]string, len(rows))
+	var args []interface{}
+	for i, hs := range rows {
+		if track != nil {
+			if err := track.Track(ctx, "horses", "horse_id = ?", hs.HorseID); err != nil {
+				return err
+			}
+		}
+		values[i] = "(?::integer" + strings.Repeat(", ?::integer", len(columns)) + ")"
+		args = append(args, hs.HorseID)
+		for _, v := range hs.New.values() {
+			args = append(args, v)
+		}
+	}
+	set := make([]string, len(columns))
+	for i, col := range columns {
+		set[i] = col + " = v." + col
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"UPDATE horses h SET %s FROM (VALUES %s) AS v (horse_id, %s) WHERE h.horse_id = v.horse_id",
+		strings.Join(set, ", "), strings.Join(values, ", "), strings.Join(columns, ", "),
+	), args...)
+	return err
+}
+
+func sameInt(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
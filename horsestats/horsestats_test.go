@@ -0,0 +1,197 @@
+package horsestats
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/uptrace/bun"
+
+	"github.com/padraicbc/mikeapi/config"
+	bundb "github.com/padraicbc/mikeapi/db"
+)
+
+// testTx returns a transaction on the database at TEST_DATABASE_URL, migrated
+// to the current schema and rolled back when the test ends. The test is
+// skipped when the variable is not set.
+func testTx(t *testing.T) (context.Context, bun.Tx) {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	db, err := bundb.Open(ctx, &config.Config{DatabaseURL: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := bundb.MigrateUp(ctx, db, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = tx.Rollback() })
+	return ctx, tx
+}
+
+// insertID runs an INSERT ... RETURNING of a single id.
+func insertID(t *testing.T, ctx context.Context, tx bun.Tx, query string, args ...interface{}) int {
+	t.Helper()
+	var id int
+	if err := tx.NewRaw(query, args...).Scan(ctx, &id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+type trackedIDs []interface{}
+
+func (t *trackedIDs) Track(_ context.Context, table, where string, args ...interface{}) error {
+	*t = append(*t, args...)
+	return nil
+}
+
+func intp(n int) *int { return &n }
+
+func TestRecompute(t *testing.T) {
+	ctx, tx := testTx(t)
+
+	courseID := insertID(t, ctx, tx, `INSERT INTO courses (course, direction, is_aw, code)
+		VALUES ('Horsestats Test Park', 'L', false, 'GB') RETURNING course_id`)
+	race := func(date string) int {
+		return insertID(t, ctx, tx, `INSERT INTO races (course_id, date, time, url, distance, going)
+			VALUES (?, ?, '14:00', 'https://example.com', 8, 'Good') RETURNING race_id`, courseID, date)
+	}
+	// Every horse starts with stale columns.
+	horse := func(name string) int {
+		return insertID(t, ctx, tx, `INSERT INTO horses (horse, last_win_id, highest_win_weight, last_win_weight,
+			last_run_weight, last_win_claim, last_run_claim, highest_win_or)
+			VALUES (?, 1, 999, 999, 999, 999, 999, 999) RETURNING horse_id`, name)
+	}
+	result := func(horseID, raceID int, placed string, weight int, claim *int, or int) {
+		insertID(t, ctx, tx, `INSERT INTO results (horse_id, course_id, race_id, age, price, trainer, jockey, number,
+			placed, weight_carried, card_weight, claim, official_rat)
+			VALUES (?, ?, ?, 4, '5/1', 'T', 'J', 1, ?, ?, ?, ?, ?) RETURNING id`,
+			horseID, courseID, raceID, placed, weight, weight, claim, or)
+	}
+
+	win, later := race("2099-01-01"), race("2099-02-01")
+	winner := horse("Horsestats Winner")
+	placer := horse("Horsestats Placer")
+	unraced := horse("Horsestats Unraced")
+	// The winner won carrying 140 off 80 with a 3lb claim, then ran third
+	// carrying more off a higher rating: neither counts as a winning high.
+	result(winner, win, "1", 140, intp(3), 80)
+	result(winner, later, "3", 150, intp(5), 90)
+	// The placer never won and its claim is unknown.
+	result(placer, later, "2", 128, nil, 70)
+
+	ids := []int{winner, placer, unraced}
+	want := map[int]stats{
+		winner: {
+			LastWinID: &win, HighestWinWeight: intp(140), LastWinWeight: intp(140), LastRunWeight: intp(150),
+			LastWinClaim: intp(3), LastRunClaim: intp(5), HighestWinOr: intp(80),
+		},
+		placer: {
+			HighestWinWeight: intp(0), LastWinWeight: intp(0), LastRunWeight: intp(128),
+			LastWinClaim: intp(0), LastRunClaim: intp(0), HighestWinOr: intp(0),
+		},
+		unraced: {
+			HighestWinWeight: intp(0), LastWinWeight: intp(0), LastRunWeight: intp(0),
+			LastWinClaim: intp(0), LastRunClaim: intp(0), HighestWinOr: intp(0),
+		},
+	}
+	stored := func() map[int]stats {
+		var rows []struct {
+			HorseID int `bun:"horse_id"`
+			stats
+		}
+		if err := tx.NewSelect().Table("horses").
+			Column("horse_id", "last_win_id", "highest_win_weight", "last_win_weight", "last_run_weight",
+				"last_win_claim", "last_run_claim", "highest_win_or").
+			Where("horse_id IN (?)", bun.In(ids)).Scan(ctx, &rows); err != nil {
+			t.Fatal(err)
+		}
+		out := map[int]stats{}
+		for _, r := range rows {
+			out[r.HorseID] = r.stats
+		}
+		return out
+	}
+	before := stored()
+
+	// A dry run reports every change and writes nothing.
+	report, err := Recompute(ctx, tx, Options{HorseIDs: ids, DryRun: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.DryRun || report.Checked != 3 || len(report.Changed) != 3 {
+		t.Fatalf("dry run report = %+v", report)
+	}
+	for _, ch := range report.Changed {
+		if len(ch.Columns) != len(columns) {
+			t.Errorf("%s: %d columns changed, want all %d", ch.Horse, len(ch.Columns), len(columns))
+		}
+		w, b := want[ch.HorseID], before[ch.HorseID]
+		for i, cv := range ch.Columns {
+			if cv.Column != columns[i] || !sameInt(cv.New, w.values()[i]) || !sameInt(cv.Old, b.values()[i]) {
+				t.Errorf("%s %s: %v -> %v", ch.Horse, cv.Column, deref(cv.Old), deref(cv.New))
+			}
+		}
+	}
+	if got := stored(); !reflect.DeepEqual(got, before) {
+		t.Error("the dry run updated horses")
+	}
+
+	var tracked trackedIDs
+	report, err = Recompute(ctx, tx, Options{HorseIDs: ids}, &tracked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.DryRun || len(report.Changed) != 3 || len(tracked) != 3 {
+		t.Errorf("report = %+v, tracked %v", report, tracked)
+	}
+	got := stored()
+	for _, id := range ids {
+		gs, ws := got[id], want[id]
+		g, w := gs.values(), ws.values()
+		for i, col := range columns {
+			if !sameInt(g[i], w[i]) {
+				t.Errorf("horse %d %s = %v, want %v", id, col, deref(g[i]), deref(w[i]))
+			}
+		}
+	}
+
+	// Once current, nothing changes; a date range picks horses by their runs.
+	report, err = Recompute(ctx, tx, Options{HorseIDs: ids}, nil)
+	if err != nil || report.Checked != 3 || len(report.Changed) != 0 {
+		t.Errorf("second run = %+v, %v; want nothing changed", report, err)
+	}
+	report, err = Recompute(ctx, tx, Options{HorseIDs: ids, From: "2099-01-01", To: "2099-01-31"}, nil)
+	if err != nil || report.Checked != 1 {
+		t.Errorf("January 2099 checked %+v, %v; want only the winner", report, err)
+	}
+}
+
+func TestScopeSQLBadDate(t *testing.T) {
+	for _, opts := range []Options{{From: "2024-13-01"}, {To: "01/02/2024"}} {
+		if _, _, err := scopeSQL(opts); !errors.Is(err, ErrInvalid) {
+			t.Errorf("scopeSQL(%+v) = %v, want ErrInvalid", opts, err)
+		}
+	}
+	if q, args, err := scopeSQL(Options{}); err != nil || q != "SELECT horse_id FROM horses" || args != nil {
+		t.Errorf("scopeSQL with no options = %q, %v, %v", q, args, err)
+	}
+}
+
+func deref(v *int) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
@@ -0,0 +1,329 @@
+// Package ingest loads race cards and results pushed by the scraper or read
+// from saved Racing Post pages. Documents are checked against the JSON
+// schemas published under schema/ and written race by race, so one bad race
+// is reported without losing the rest of the day.
+package ingest
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/uptrace/bun"
+)
+
+func mustCompile(data []byte) *Schema {
+	s, err := CompileSchema(data)
+	if err != nil {
+		panic("ingest: bad embedded schema: " + err.Error())
+	}
+	return s
+}
+
+// Tracker is told about each row before it is written, normally to record an
+// audit trail. where must identify at most one row of table. A nil Tracker
+// is allowed.
+type Tracker interface {
+	Track(ctx context.Context, table, where string, args ...interface{}) error
+}
+
+// onceTracker passes each row on to a Tracker the first time it is seen, so
+// a horse running twice in one document is snapshotted before either change.
+type onceTracker struct {
+	track Tracker
+	seen  map[string]bool
+}
+
+func (t *onceTracker) Track(ctx context.Context, table, where string, args ...interface{}) error {
+	if t.track == nil {
+		return nil
+	}
+	key := fmt.Sprint(table, where, args)
+	if t.seen[key] {
+		return nil
+	}
+	t.seen[key] = true
+	return t.track.Track(ctx, table, where, args...)
+}
+
+// InvalidError rejects a whole document, as opposed to a single race.
+type InvalidError struct {
+	Errors []ValidationError
+}
+
+func (e *InvalidError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, ve := range e.Errors {
+		msgs[i] = ve.Error()
+	}
+	return "invalid document: " + strings.Join(msgs, "; ")
+}
+
+// Report says what happened to each race in a document, in document order.
+type Report struct {
+	Date     string       `json:"date"`
+	Accepted int          `json:"accepted"`
+	Rejected int          `json:"rejected"`
+	Races    []RaceReport `json:"races"`
+}
+
+// RaceReport is the outcome for one race.
+type RaceReport struct {
+	Index  int      `json:"index"`
+	RaceID *int     `json:"raceID,omitempty"`
+	Status string   `json:"status"` // accepted or rejected
+	Errors []string `json:"errors,omitempty"`
+}
+
+func (r *Report) accept(rr RaceReport) {
+	rr.Status = "accepted"
+	r.Accepted++
+	r.Races = append(r.Races, rr)
+}
+
+func (r *Report) reject(rr RaceReport, errs ...string) {
+	rr.Status = "rejected"
+	rr.Errors = errs
+	r.Rejected++
+	r.Races = append(r.Races, rr)
+}
+
+// RaceHeader is the part of a race shared by cards and results.
+type RaceHeader struct {
+	RaceID   int        `json:"raceID"`
+	Course   CardCourse `json:"course"`
+	Time     string     `json:"time"`
+	URL      string     `json:"url"`
+	Distance float64    `json:"distance"`
+	Class    *string    `json:"class"`
+	Going    *string    `json:"going"`
+}
+
+// CardCourse names a race's course. A course that is not known yet is
+// created, which needs its direction and code.
+type CardCourse struct {
+	CourseID  *int   `json:"courseID"`
+	Name      string `json:"name"`
+	Direction string `json:"direction"`
+	IsAW      bool   `json:"isAw"`
+	Code      string `json:"code"`
+}
+
+// race is one race of a document: a card or a set of results.
+type race interface {
+	header() *RaceHeader
+	// check catches what the schema cannot, such as a horse listed twice.
+	check() string
+	write(ctx context.Context, tx bun.Tx, date string, track Tracker) error
+}
+
+// document is the envelope shared by racecards and results documents.
+type document struct {
+	Date  string            `json:"date"`
+	Races []json.RawMessage `json:"races"`
+}
+
+// ingestRaces validates body against schema and writes each race under its
+// own savepoint in tx, so a race that fails validation or a database
+// constraint is rolled back and reported while the others are kept.
+func ingestRaces(ctx context.Context, tx bun.Tx, schema *Schema, body []byte, newRace func() race, track Tracker) (*Report, error) {
+	v, err := decodeDocument(body)
+	if err != nil {
+		return nil, &InvalidError{Errors: []ValidationError{{Message: "invalid JSON: " + err.Error()}}}
+	}
+	if errs := schema.Validate(v); len(errs) > 0 {
+		return nil, &InvalidError{Errors: errs}
+	}
+	var doc document
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, &InvalidError{Errors: []ValidationError{{Message: err.Error()}}}
+	}
+	decoded := v.(map[string]interface{})["races"].([]interface{})
+
+	track = &onceTracker{track: track, seen: map[string]bool{}}
+	report := &Report{Date: doc.Date, Races: []RaceReport{}}
+	seen := map[int]int{}
+	for i, raw := range doc.Races {
+		rr := RaceReport{Index: i}
+		if errs := schema.ValidateDef("race", decoded[i], fmt.Sprintf("/races/%d", i)); len(errs) > 0 {
+			report.reject(rr, errorStrings(errs)...)
+			continue
+		}
+		r := newRace()
+		if err := json.Unmarshal(raw, r); err != nil {
+			report.reject(rr, err.Error())
+			continue
+		}
+		h := r.header()
+		rr.RaceID = &h.RaceID
+		if first, dup := seen[h.RaceID]; dup {
+			report.reject(rr, fmt.Sprintf("raceID %d is also races[%d]", h.RaceID, first))
+			continue
+		}
+		seen[h.RaceID] = i
+		if msg := r.check(); msg != "" {
+			report.reject(rr, msg)
+			continue
+		}
+
+		raceErr, err := inSavepoint(ctx, tx, func() error {
+			return r.write(ctx, tx, doc.Date, track)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if raceErr != nil {
+			report.reject(rr, raceErr.Error())
+			continue
+		}
+		report.accept(rr)
+	}
+	return report, nil
+}
+
+// duplicateHorse reports the first horse listed twice in a race.
+func duplicateHorse(field string, horseIDs []int) string {
+	seen := map[int]int{}
+	for i, id := range horseIDs {
+		if first, dup := seen[id]; dup {
+			return fmt.Sprintf("%s[%d]: horseID %d is also %[1]s[%d]", field, i, id, first)
+		}
+		seen[id] = i
+	}
+	return ""
+}
+
+func errorStrings(errs []ValidationError) []string {
+	out := make([]string, len(errs))
+	for i, e := range errs {
+		out[i] = e.Error()
+	}
+	return out
+}
+
+// inSavepoint runs fn under a savepoint, rolling back to it if fn fails.
+// fn's error rejects one race; the returned err means the transaction itself
+// is unusable.
+func inSavepoint(ctx context.Context, tx bun.Tx, fn func() error) (raceErr, err error) {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT ingest_race"); err != nil {
+		return nil, err
+	}
+	if raceErr := fn(); raceErr != nil {
+		if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT ingest_race"); err != nil {
+			return nil, errors.Join(raceErr, err)
+		}
+		return raceErr, nil
+	}
+	_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT ingest_race")
+	return nil, err
+}
+
+// upsertRace writes the races row and returns its course ID. Races that have
+// already been analysed are refused.
+func upsertRace(ctx context.Context, tx bun.Tx, date string, h *RaceHeader, track Tracker) (int, error) {
+	courseID, err := resolveCourse(ctx, tx, &h.Course, track)
+	if err != nil {
+		return 0, err
+	}
+
+	var analysed bool
+	err = tx.NewRaw(`SELECT analysed FROM races WHERE race_id = ?`, h.RaceID).Scan(ctx, &analysed)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return 0, err
+	case analysed:
+		return 0, fmt.Errorf("race %d has already been analysed", h.RaceID)
+	}
+
+	if err := track.Track(ctx, "races", "race_id = ?", h.RaceID); err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO races AS rc (race_id, course_id, date, time, url, class, distance, going)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?)
+		ON CONFLICT (race_id) DO UPDATE SET
+			course_id = EXCLUDED.course_id, date = EXCLUDED.date, time = EXCLUDED.time,
+			url = EXCLUDED.url, class = EXCLUDED.class, distance = EXCLUDED.distance,
+			going = EXCLUDED.going, version = rc.version + 1
+		WHERE (rc.course_id, rc.date, rc.time, rc.url, rc.class, rc.distance, rc.going)
+			IS DISTINCT FROM
+			(EXCLUDED.course_id, EXCLUDED.date, EXCLUDED.time, EXCLUDED.url, EXCLUDED.class, EXCLUDED.distance, EXCLUDED.going)`,
+		h.RaceID, courseID, date, h.Time, h.URL, deref(h.Class), h.Distance, deref(h.Going),
+	)
+	return courseID, err
+}
+
+// upsertTrainers adds trainers not seen before, by name.
+func upsertTrainers(ctx context.Context, tx bun.Tx, names []string, track Tracker) error {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if err := track.Track(ctx, "trainers", "trainer = ?", name); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO trainers (trainer) VALUES (?) ON CONFLICT (trainer) DO NOTHING`, name,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// resolveCourse returns the course's ID, creating the course if it is new.
+// A given courseID must agree with the name if the course already exists.
+func resolveCourse(ctx context.Context, tx bun.Tx, cc *CardCourse, track Tracker) (int, error) {
+	var existing struct {
+		CourseID int    `bun:"course_id"`
+		Course   string `bun:"course"`
+	}
+	q := tx.NewSelect().Table("courses").Column("course_id", "course")
+	if cc.CourseID != nil {
+		q = q.Where("course_id = ?", *cc.CourseID)
+	} else {
+		q = q.Where("lower(course) = lower(?)", cc.Name)
+	}
+	err := q.Limit(1).Scan(ctx, &existing)
+	switch {
+	case err == nil:
+		if !strings.EqualFold(existing.Course, cc.Name) {
+			return 0, fmt.Errorf("courseID %d is %s, not %s", existing.CourseID, existing.Course, cc.Name)
+		}
+		return existing.CourseID, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return 0, err
+	}
+
+	if cc.Direction == "" || cc.Code == "" {
+		return 0, fmt.Errorf("course %s is new and needs direction and code", cc.Name)
+	}
+	if err := track.Track(ctx, "courses", "course = ?", cc.Name); err != nil {
+		return 0, err
+	}
+	var id int
+	err = tx.NewRaw(`
+		INSERT INTO courses (course_id, course, direction, is_aw, code)
+		VALUES (COALESCE(?, nextval(pg_get_serial_sequence('courses', 'course_id'))), ?, ?, ?, ?)
+		RETURNING course_id`,
+		cc.CourseID, cc.Name, cc.Direction, cc.IsAW, strings.ToUpper(cc.Code),
+	).Scan(ctx, &id)
+	if err != nil || cc.CourseID == nil {
+		return id, err
+	}
+	// Move the sequence past the scraper's ID so CreateCourse does not reuse it.
+	_, err = tx.ExecContext(ctx, `
+		SELECT setval(pg_get_serial_sequence('courses', 'course_id'), GREATEST((SELECT max(course_id) FROM courses), 1))`)
+	return id, err
+}
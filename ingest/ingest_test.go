@@ -0,0 +1,88 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/uptrace/bun"
+
+	"github.com/padraicbc/mikeapi/config"
+	bundb "github.com/padraicbc/mikeapi/db"
+)
+
+// testTx returns a transaction on the database at TEST_DATABASE_URL, migrated
+// to the current schema and rolled back when the test ends. The test is
+// skipped when the variable is not set.
+func testTx(t *testing.T) (context.Context, bun.Tx) {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	db, err := bundb.Open(ctx, &config.Config{DatabaseURL: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := bundb.MigrateUp(ctx, db, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = tx.Rollback() })
+	return ctx, tx
+}
+
+// TestRacecardsSavepoints ingests a day where one race breaks a database
+// constraint and one fails the schema, and checks only those two are lost.
+func TestRacecardsSavepoints(t *testing.T) {
+	ctx, tx := testTx(t)
+
+	race := func(id int, time string, distance int) string {
+		return fmt.Sprintf(`{
+			"raceID": %d,
+			"course": {"name": "Ingest Test Park", "direction": "L", "isAw": false, "code": "GB"},
+			"time": %q, "url": "https://example.com/%[1]d", "distance": %[3]d,
+			"runners": [{"horseID": 1, "horse": "Test Horse", "trainer": "Test Trainer"}]
+		}`, id, time, distance)
+	}
+	body := `{"date": "2099-06-01", "races": [` + strings.Join([]string{
+		race(990001, "13:30", 8),
+		race(990002, "13:30", 8), // same course, date and time: races_no_dupes
+		race(990003, "14:00", 0), // distance below the schema minimum
+		race(990004, "14:30", 8),
+	}, ",") + `]}`
+
+	report, err := Racecards(ctx, tx, []byte(body), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Accepted != 2 || report.Rejected != 2 {
+		t.Fatalf("accepted %d rejected %d, want 2 and 2: %+v", report.Accepted, report.Rejected, report.Races)
+	}
+	wantStatus := []string{"accepted", "rejected", "rejected", "accepted"}
+	for i, rr := range report.Races {
+		if rr.Index != i || rr.Status != wantStatus[i] {
+			t.Errorf("races[%d] = %+v, want %s", i, rr, wantStatus[i])
+		}
+	}
+	if errs := strings.Join(report.Races[1].Errors, "; "); !strings.Contains(errs, "races_no_dupes") {
+		t.Errorf("races[1] errors = %q, want the races_no_dupes violation", errs)
+	}
+
+	for table, want := range map[string]int{"races": 2, "pre_race": 2} {
+		n, err := tx.NewSelect().Table(table).Where("race_id IN (?)", bun.In([]int{990001, 990002, 990003, 990004})).Count(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("%s has %d of the races, want %d", table, n, want)
+		}
+	}
+}
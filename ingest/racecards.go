@@ -0,0 +1,84 @@
+package ingest
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+
+	"github.com/uptrace/bun"
+)
+
+//go:embed schema/racecards.json
+var racecardSchemaJSON []byte
+
+var racecardSchema = mustCompile(racecardSchemaJSON)
+
+// RacecardSchema returns the published JSON schema for Racecards documents.
+func RacecardSchema() []byte { return racecardSchemaJSON }
+
+// Racecard is one race of a racecards document.
+type Racecard struct {
+	RaceHeader
+	Runners json.RawMessage `json:"runners"`
+}
+
+type cardRunner struct {
+	HorseID int     `json:"horseID"`
+	Trainer *string `json:"trainer"`
+}
+
+func (r *Racecard) header() *RaceHeader { return &r.RaceHeader }
+
+func (r *Racecard) check() string {
+	var rs []cardRunner
+	if err := json.Unmarshal(r.Runners, &rs); err != nil {
+		return err.Error()
+	}
+	ids := make([]int, len(rs))
+	for i, run := range rs {
+		ids[i] = run.HorseID
+	}
+	return duplicateHorse("runners", ids)
+}
+
+func (r *Racecard) write(ctx context.Context, tx bun.Tx, date string, track Tracker) error {
+	courseID, err := upsertRace(ctx, tx, date, &r.RaceHeader, track)
+	if err != nil {
+		return err
+	}
+	var rs []cardRunner
+	if err := json.Unmarshal(r.Runners, &rs); err != nil {
+		return err
+	}
+	trainers := make([]string, len(rs))
+	for i, run := range rs {
+		trainers[i] = deref(run.Trainer)
+	}
+	if err := upsertTrainers(ctx, tx, trainers, track); err != nil {
+		return err
+	}
+
+	if err := track.Track(ctx, "pre_race", "race_id = ?", r.RaceID); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO pre_race AS pr (runners, course, course_id, date, time, race_id, direction, distance, class, url)
+		SELECT ?::jsonb, c.course, c.course_id, ?, ?, ?, c.direction, ?, ?, ?
+		FROM courses c WHERE c.course_id = ?
+		ON CONFLICT (race_id) DO UPDATE SET
+			runners = EXCLUDED.runners, course = EXCLUDED.course, course_id = EXCLUDED.course_id,
+			date = EXCLUDED.date, time = EXCLUDED.time, direction = EXCLUDED.direction,
+			distance = EXCLUDED.distance, class = EXCLUDED.class, url = EXCLUDED.url`,
+		string(r.Runners), date, r.Time, r.RaceID, r.Distance, deref(r.Class), r.URL, courseID,
+	)
+	return err
+}
+
+// Racecards upserts a day's cards: courses, races, trainers and pre_race
+// rows. Each race is written under its own savepoint in tx, so a race that
+// fails schema validation or a database constraint is rolled back and
+// reported while the others are kept. Races that have already been analysed
+// are not touched.
+func Racecards(ctx context.Context, tx bun.Tx, body []byte, track Tracker) (*Report, error) {
+	return ingestRaces(ctx, tx, racecardSchema, body, func() race { return &Racecard{} }, track)
+}
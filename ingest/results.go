@@ -0,0 +1,131 @@
+package ingest
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"strings"
+
+	"github.com/uptrace/bun"
+
+	"github.com/padraicbc/mikeapi/horsestats"
+	"github.com/padraicbc/mikeapi/models"
+)
+
+//go:embed schema/results.json
+var resultSchemaJSON []byte
+
+var resultSchema = mustCompile(resultSchemaJSON)
+
+// ResultSchema returns the published JSON schema for Results documents.
+func ResultSchema() []byte { return resultSchemaJSON }
+
+// RaceResults is one race of a results document.
+type RaceResults struct {
+	RaceHeader
+	Results []Runner `json:"results"`
+}
+
+// Runner is one finisher, or non-finisher, of a race. The analysis columns
+// of models.Result are left to the analysts.
+type Runner struct {
+	models.Result
+	Horse string `json:"horse"`
+}
+
+// resultColumns are the results columns ingestion writes. The rest belong to
+// the analysts and are kept when a race is ingested again.
+var resultColumns = []string{
+	"horse_id", "course_id", "race_id", "age", "price", "trainer", "jockey", "number",
+	"headgear", "placed", "pace", "official_rat", "win_dist", "dist_behind_winner",
+	"weight_carried", "card_weight", "claim", "rpr", "ts", "tfsf", "tfsf_minus_or",
+	"sec_t", "speed_per", "comment",
+}
+
+func (r *RaceResults) header() *RaceHeader { return &r.RaceHeader }
+
+func (r *RaceResults) check() string {
+	ids := make([]int, len(r.Results))
+	for i, run := range r.Results {
+		ids[i] = run.HorseID
+	}
+	return duplicateHorse("results", ids)
+}
+
+func (r *RaceResults) write(ctx context.Context, tx bun.Tx, date string, track Tracker) error {
+	courseID, err := upsertRace(ctx, tx, date, &r.RaceHeader, track)
+	if err != nil {
+		return err
+	}
+
+	trainers := make([]string, len(r.Results))
+	for i, run := range r.Results {
+		trainers[i] = run.Trainer
+	}
+	if err := upsertTrainers(ctx, tx, trainers, track); err != nil {
+		return err
+	}
+
+	rows := make([]models.Result, len(r.Results))
+	horseIDs := make([]int, len(r.Results))
+	for i, run := range r.Results {
+		if err := track.Track(ctx, "horses", "horse_id = ?", run.HorseID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO horses AS h (horse_id, horse) VALUES (?, ?)
+			ON CONFLICT (horse_id) DO UPDATE SET horse = EXCLUDED.horse
+			WHERE h.horse <> EXCLUDED.horse`,
+			run.HorseID, run.Horse,
+		); err != nil {
+			return fmt.Errorf("horse %d %s: %w", run.HorseID, run.Horse, err)
+		}
+		if err := track.Track(ctx, "results", "race_id = ? AND horse_id = ?", r.RaceID, run.HorseID); err != nil {
+			return err
+		}
+		rows[i] = run.Result
+		rows[i].RaceID = r.RaceID
+		rows[i].CourseID = courseID
+		horseIDs[i] = run.HorseID
+	}
+
+	set := make([]string, 0, len(resultColumns))
+	for _, c := range resultColumns[3:] {
+		set = append(set, c+" = EXCLUDED."+c)
+	}
+	if _, err := tx.NewInsert().
+		Model(&rows).
+		Column(resultColumns...).
+		On("CONFLICT (race_id, horse_id) DO UPDATE").
+		Set(strings.Join(set, ", ") + ", course_id = EXCLUDED.course_id, version = r.version + 1").
+		Where(fmt.Sprintf("(r.course_id, r.%s) IS DISTINCT FROM (EXCLUDED.course_id, EXCLUDED.%s)",
+			strings.Join(resultColumns[3:], ", r."), strings.Join(resultColumns[3:], ", EXCLUDED."))).
+		Returning("NULL").
+		Exec(ctx); err != nil {
+		return err
+	}
+
+	// Ratings saved from the pre-race screen carry over to the results.
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE results r SET mr_plus_or = im.mr_plus_or, tfr = im.tfr
+		FROM intermediary im
+		WHERE im.race_id = r.race_id AND im.horse_id = r.horse_id AND r.race_id = ?
+			AND (r.mr_plus_or, r.tfr) IS DISTINCT FROM (im.mr_plus_or, im.tfr)`,
+		r.RaceID,
+	); err != nil {
+		return err
+	}
+
+	_, err = horsestats.Recompute(ctx, tx, horsestats.Options{HorseIDs: horseIDs}, track)
+	return err
+}
+
+// Results upserts a day's results: courses, races, trainers, horses and
+// results rows, copying each runner's pre-race mr_plus_or and tfr from
+// intermediary and recomputing the horse aggregates (last win, last run
+// weights and claims, highest winning weight and rating) in the same
+// transaction. Races are written under their own savepoints as in Racecards,
+// and races that have already been analysed are not touched.
+func Results(ctx context.Context, tx bun.Tx, body []byte, track Tracker) (*Report, error) {
+	return ingestRaces(ctx, tx, resultSchema, body, func() race { return &RaceResults{} }, track)
+}
@@ -0,0 +1,385 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ValidationError is one schema violation. Path is a JSON pointer into the
+// validated document.
+type ValidationError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// Schema is a compiled JSON Schema. Only the keywords the published ingest
+// schemas use are understood: $ref to local $defs, type, enum, properties,
+// required, additionalProperties, items, minItems, maxItems, minLength,
+// maxLength, pattern, format "date", minimum and maximum. Anything else is
+// rejected when the schema is compiled rather than silently ignored.
+type Schema struct {
+	root *node
+	defs map[string]*node
+}
+
+type node struct {
+	ref        string
+	types      []string
+	enum       []interface{}
+	properties map[string]*node
+	required   []string
+	additional *bool
+	items      *node
+	minItems   *int
+	maxItems   *int
+	minLength  *int
+	maxLength  *int
+	pattern    *regexp.Regexp
+	format     string
+	minimum    *float64
+	maximum    *float64
+}
+
+// CompileSchema parses a JSON Schema document.
+func CompileSchema(data []byte) (*Schema, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	s := &Schema{defs: map[string]*node{}}
+	if defs, ok := raw["$defs"].(map[string]interface{}); ok {
+		for name, d := range defs {
+			m, ok := d.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("$defs/%s: not an object", name)
+			}
+			n, err := compileNode(m, "$defs/"+name)
+			if err != nil {
+				return nil, err
+			}
+			s.defs[name] = n
+		}
+	}
+	root, err := compileNode(raw, "")
+	if err != nil {
+		return nil, err
+	}
+	s.root = root
+	for name, n := range s.defs {
+		if err := s.checkRefs(n, "$defs/"+name); err != nil {
+			return nil, err
+		}
+	}
+	return s, s.checkRefs(root, "")
+}
+
+// metaKeywords are annotations that do not affect validation.
+var metaKeywords = map[string]bool{
+	"$schema": true, "$id": true, "$defs": true, "$comment": true,
+	"title": true, "description": true, "examples": true,
+}
+
+func compileNode(m map[string]interface{}, at string) (*node, error) {
+	n := &node{}
+	for key, v := range m {
+		var err error
+		switch key {
+		case "$ref":
+			ref, _ := v.(string)
+			name, ok := strings.CutPrefix(ref, "#/$defs/")
+			if !ok {
+				return nil, fmt.Errorf("%s: only #/$defs/ references are supported", at)
+			}
+			n.ref = name
+		case "type":
+			switch t := v.(type) {
+			case string:
+				n.types = []string{t}
+			case []interface{}:
+				for _, x := range t {
+					s, _ := x.(string)
+					n.types = append(n.types, s)
+				}
+			}
+		case "enum":
+			n.enum, _ = v.([]interface{})
+		case "properties":
+			props, _ := v.(map[string]interface{})
+			n.properties = map[string]*node{}
+			for name, p := range props {
+				pm, ok := p.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("%s/properties/%s: not an object", at, name)
+				}
+				if n.properties[name], err = compileNode(pm, at+"/properties/"+name); err != nil {
+					return nil, err
+				}
+			}
+		case "required":
+			list, _ := v.([]interface{})
+			for _, x := range list {
+				s, _ := x.(string)
+				n.required = append(n.required, s)
+			}
+		case "additionalProperties":
+			b, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("%s: additionalProperties must be a boolean", at)
+			}
+			n.additional = &b
+		case "items":
+			im, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s/items: not an object", at)
+			}
+			if n.items, err = compileNode(im, at+"/items"); err != nil {
+				return nil, err
+			}
+		case "minItems":
+			n.minItems, err = intKeyword(v, at, key)
+		case "maxItems":
+			n.maxItems, err = intKeyword(v, at, key)
+		case "minLength":
+			n.minLength, err = intKeyword(v, at, key)
+		case "maxLength":
+			n.maxLength, err = intKeyword(v, at, key)
+		case "pattern":
+			s, _ := v.(string)
+			n.pattern, err = regexp.Compile(s)
+		case "format":
+			n.format, _ = v.(string)
+			if n.format != "date" {
+				return nil, fmt.Errorf("%s: unsupported format %q", at, n.format)
+			}
+		case "minimum":
+			f, ok := v.(float64)
+			if !ok {
+				return nil, fmt.Errorf("%s: minimum must be a number", at)
+			}
+			n.minimum = &f
+		case "maximum":
+			f, ok := v.(float64)
+			if !ok {
+				return nil, fmt.Errorf("%s: maximum must be a number", at)
+			}
+			n.maximum = &f
+		default:
+			if !metaKeywords[key] {
+				return nil, fmt.Errorf("%s: unsupported keyword %q", at, key)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func intKeyword(v interface{}, at, key string) (*int, error) {
+	f, ok := v.(float64)
+	if !ok || f != math.Trunc(f) || f < 0 {
+		return nil, fmt.Errorf("%s: %s must be a non-negative integer", at, key)
+	}
+	i := int(f)
+	return &i, nil
+}
+
+func (s *Schema) checkRefs(n *node, at string) error {
+	if n.ref != "" {
+		if _, ok := s.defs[n.ref]; !ok {
+			return fmt.Errorf("%s: unknown reference #/$defs/%s", at, n.ref)
+		}
+	}
+	for name, p := range n.properties {
+		if err := s.checkRefs(p, at+"/properties/"+name); err != nil {
+			return err
+		}
+	}
+	if n.items != nil {
+		return s.checkRefs(n.items, at+"/items")
+	}
+	return nil
+}
+
+// Validate checks a document, decoded with json.Decoder.UseNumber, against
+// the root schema.
+func (s *Schema) Validate(v interface{}) []ValidationError {
+	var errs []ValidationError
+	s.validate(s.root, v, "", &errs)
+	return errs
+}
+
+// ValidateDef checks a document against one of the schema's $defs.
+func (s *Schema) ValidateDef(name string, v interface{}, path string) []ValidationError {
+	n, ok := s.defs[name]
+	if !ok {
+		return []ValidationError{{Path: path, Message: "unknown schema definition " + name}}
+	}
+	var errs []ValidationError
+	s.validate(n, v, path, &errs)
+	return errs
+}
+
+func (s *Schema) validate(n *node, v interface{}, path string, errs *[]ValidationError) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	if n.ref != "" {
+		s.validate(s.defs[n.ref], v, path, errs)
+	}
+	if len(n.types) > 0 && !hasType(n.types, v) {
+		fail("expected %s, got %s", strings.Join(n.types, " or "), typeOf(v))
+		return
+	}
+	if n.enum != nil && !inEnum(n.enum, v) {
+		fail("must be one of %s", enumList(n.enum))
+	}
+
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for _, name := range n.required {
+			if _, ok := x[name]; !ok {
+				*errs = append(*errs, ValidationError{Path: path, Message: fmt.Sprintf("%s is required", name)})
+			}
+		}
+		names := make([]string, 0, len(x))
+		for name := range x {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			p, ok := n.properties[name]
+			switch {
+			case ok:
+				s.validate(p, x[name], path+"/"+escapePointer(name), errs)
+			case n.additional != nil && !*n.additional:
+				*errs = append(*errs, ValidationError{Path: path, Message: fmt.Sprintf("unknown property %s", name)})
+			}
+		}
+	case []interface{}:
+		if n.minItems != nil && len(x) < *n.minItems {
+			fail("must have at least %d items", *n.minItems)
+		}
+		if n.maxItems != nil && len(x) > *n.maxItems {
+			fail("must have at most %d items", *n.maxItems)
+		}
+		if n.items != nil {
+			for i, item := range x {
+				s.validate(n.items, item, fmt.Sprintf("%s/%d", path, i), errs)
+			}
+		}
+	case string:
+		length := len([]rune(x))
+		if n.minLength != nil && length < *n.minLength {
+			fail("must be at least %d characters", *n.minLength)
+		}
+		if n.maxLength != nil && length > *n.maxLength {
+			fail("must be at most %d characters", *n.maxLength)
+		}
+		if n.pattern != nil && !n.pattern.MatchString(x) {
+			fail("must match %s", n.pattern)
+		}
+		if n.format == "date" {
+			if _, err := time.Parse(time.DateOnly, x); err != nil {
+				fail("must be a date (YYYY-MM-DD)")
+			}
+		}
+	case json.Number:
+		f, err := x.Float64()
+		if err != nil {
+			fail("invalid number")
+			return
+		}
+		if n.minimum != nil && f < *n.minimum {
+			fail("must be at least %v", *n.minimum)
+		}
+		if n.maximum != nil && f > *n.maximum {
+			fail("must be at most %v", *n.maximum)
+		}
+	}
+}
+
+func hasType(types []string, v interface{}) bool {
+	got := typeOf(v)
+	for _, t := range types {
+		if t == got || (t == "number" && got == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func typeOf(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := x.Int64(); err == nil {
+			return "integer"
+		}
+		if f, err := x.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func inEnum(enum []interface{}, v interface{}) bool {
+	want, _ := json.Marshal(v)
+	for _, e := range enum {
+		b, _ := json.Marshal(e)
+		if bytes.Equal(b, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func enumList(enum []interface{}) string {
+	parts := make([]string, len(enum))
+	for i, e := range enum {
+		b, _ := json.Marshal(e)
+		parts[i] = string(b)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func escapePointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+// decodeDocument decodes JSON keeping numbers as json.Number, as Validate expects.
+func decodeDocument(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after the JSON document")
+	}
+	return v, nil
+}
@@ -0,0 +1,139 @@
+package ingest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name, schema, doc string
+		want              []string // error substrings, in order; none means valid
+	}{
+		{"type ok", `{"type": "string"}`, `"x"`, nil},
+		{"type", `{"type": "string"}`, `1`, []string{"expected string, got integer"}},
+		{"type list", `{"type": ["integer", "null"]}`, `null`, nil},
+		{"type list mismatch", `{"type": ["integer", "null"]}`, `"1"`, []string{"expected integer or null, got string"}},
+		{"integer is a number", `{"type": "number"}`, `3`, nil},
+		{"fraction is not an integer", `{"type": "integer"}`, `2.5`, []string{"expected integer, got number"}},
+		{"integral float is an integer", `{"type": "integer"}`, `2.0`, nil},
+
+		{"enum ok", `{"enum": ["L", "R"]}`, `"L"`, nil},
+		{"enum", `{"enum": ["L", "R"]}`, `"X"`, []string{`must be one of "L", "R"`}},
+		{"enum numbers", `{"enum": [1, 2]}`, `2`, nil},
+
+		{"required", `{"type": "object", "required": ["a", "b"]}`, `{"a": 1}`, []string{"b is required"}},
+		{"properties", `{"properties": {"a": {"type": "integer"}}}`, `{"a": "x"}`, []string{"/a: expected integer"}},
+		{"additional allowed", `{"properties": {"a": {}}}`, `{"a": 1, "b": 2}`, nil},
+		{"additional refused", `{"properties": {"a": {}}, "additionalProperties": false}`, `{"a": 1, "b": 2}`, []string{"unknown property b"}},
+		{"pointer escaping", `{"properties": {"a/b": {"type": "string"}}}`, `{"a/b": 1}`, []string{"/a~1b: expected string"}},
+
+		{"items", `{"items": {"type": "integer"}}`, `[1, "x", 3]`, []string{"/1: expected integer"}},
+		{"minItems", `{"minItems": 2}`, `[1]`, []string{"at least 2 items"}},
+		{"maxItems", `{"maxItems": 1}`, `[1, 2]`, []string{"at most 1 items"}},
+
+		{"minLength counts runes", `{"minLength": 3}`, `"éé"`, []string{"at least 3 characters"}},
+		{"maxLength", `{"maxLength": 2}`, `"abc"`, []string{"at most 2 characters"}},
+		{"pattern ok", `{"pattern": "^[0-9]{2}:[0-9]{2}$"}`, `"13:30"`, nil},
+		{"pattern", `{"pattern": "^[0-9]{2}:[0-9]{2}$"}`, `"1:30"`, []string{"must match"}},
+		{"format date ok", `{"format": "date"}`, `"2024-02-29"`, nil},
+		{"format date", `{"format": "date"}`, `"2023-02-29"`, []string{"must be a date"}},
+
+		{"minimum", `{"minimum": 1}`, `0`, []string{"at least 1"}},
+		{"maximum", `{"maximum": 50}`, `50.5`, []string{"at most 50"}},
+		{"bounds ok", `{"minimum": 1, "maximum": 50}`, `50`, nil},
+
+		{"ref", `{"$defs": {"id": {"type": "integer", "minimum": 1}}, "properties": {"a": {"$ref": "#/$defs/id"}}}`,
+			`{"a": 0}`, []string{"/a: must be at least 1"}},
+		{"meta keywords ignored", `{"$schema": "x", "$id": "y", "title": "t", "description": "d", "$comment": "c", "examples": [1]}`,
+			`1`, nil},
+		{"several errors", `{"type": "object", "required": ["a"], "properties": {"b": {"maxLength": 1}}}`,
+			`{"b": "xy"}`, []string{"a is required", "/b: must be at most 1 characters"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := CompileSchema([]byte(tt.schema))
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, err := decodeDocument([]byte(tt.doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			errs := s.Validate(v)
+			if len(errs) != len(tt.want) {
+				t.Fatalf("got errors %v, want %d containing %q", errs, len(tt.want), tt.want)
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(errs[i].Error(), want) {
+					t.Errorf("error %d = %q, want it to contain %q", i, errs[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileSchemaErrors(t *testing.T) {
+	tests := []struct {
+		name, schema, want string
+	}{
+		{"unknown keyword", `{"oneOf": [{"type": "string"}]}`, `unsupported keyword "oneOf"`},
+		{"unknown nested keyword", `{"properties": {"a": {"const": 1}}}`, `properties/a: unsupported keyword "const"`},
+		{"unknown keyword in defs", `{"$defs": {"x": {"uniqueItems": true}}}`, `$defs/x: unsupported keyword "uniqueItems"`},
+		{"remote ref", `{"$ref": "https://example.com/schema"}`, "only #/$defs/ references"},
+		{"unknown ref", `{"items": {"$ref": "#/$defs/missing"}}`, "unknown reference #/$defs/missing"},
+		{"unknown format", `{"format": "email"}`, `unsupported format "email"`},
+		{"additionalProperties schema", `{"additionalProperties": {"type": "string"}}`, "additionalProperties must be a boolean"},
+		{"negative minItems", `{"minItems": -1}`, "minItems must be a non-negative integer"},
+		{"fractional maxLength", `{"maxLength": 1.5}`, "maxLength must be a non-negative integer"},
+		{"minimum string", `{"minimum": "1"}`, "minimum must be a number"},
+		{"bad pattern", `{"pattern": "("}`, "missing closing )"},
+		{"items not an object", `{"items": [{"type": "string"}]}`, "items: not an object"},
+		{"not JSON", `{`, "unexpected end of JSON input"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CompileSchema([]byte(tt.schema))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateDef(t *testing.T) {
+	s, err := CompileSchema(RacecardSchema())
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := decodeDocument([]byte(`{"horseID": 0, "horse": ""}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := s.ValidateDef("runner", v, "/races/2/runners/0")
+	if len(errs) != 2 || errs[0].Path != "/races/2/runners/0/horse" || errs[1].Path != "/races/2/runners/0/horseID" {
+		t.Errorf("got %v, want horse and horseID errors under /races/2/runners/0", errs)
+	}
+	if errs := s.ValidateDef("nope", v, ""); len(errs) != 1 || !strings.Contains(errs[0].Message, "unknown schema definition") {
+		t.Errorf("got %v for an unknown definition", errs)
+	}
+}
+
+func TestPublishedSchemasCompile(t *testing.T) {
+	for name, data := range map[string][]byte{"racecards": RacecardSchema(), "results": ResultSchema()} {
+		s, err := CompileSchema(data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if _, ok := s.defs["race"]; !ok {
+			t.Errorf("%s has no race definition", name)
+		}
+	}
+}
+
+func TestDecodeDocumentTrailingData(t *testing.T) {
+	if _, err := decodeDocument([]byte(`{} {}`)); err == nil {
+		t.Error("decodeDocument accepted two documents")
+	}
+}
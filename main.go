@@ -5,7 +5,6 @@ import (
 	"embed"
 	"io/fs"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
@@ -19,6 +18,8 @@ import (
 	"github.com/padraicbc/mikeapi/handlers"
 	applog "github.com/padraicbc/mikeapi/logger"
 	mw "github.com/padraicbc/mikeapi/middleware"
+	"github.com/padraicbc/mikeapi/models"
+	"github.com/padraicbc/mikeapi/notify"
 )
 
 //go:embed all:build/*
@@ -33,16 +34,39 @@ func main() {
 	defer func() { _ = logger.Sync() }()
 	zap.ReplaceGlobals(logger)
 
-	bdb := db.Setup(cfg)
+	notifier := notify.Setup(cfg)
+	if notifier == nil {
+		logger.Info("error reports disabled: set SMTP_ADDR or NOTIFY_FILE to send them")
+	}
+	// fatal mails a startup failure before exiting.
+	fatal := func(msg string, err error) {
+		notifier.Notify(notify.KindStartup, "%s: %v", msg, err)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if ferr := notifier.Flush(ctx); ferr != nil {
+			logger.Error("send error report", zap.Error(ferr))
+		}
+		logger.Fatal(msg, zap.Error(err))
+	}
+
+	bdb, err := db.Open(context.Background(), cfg)
+	if err != nil {
+		fatal("failed to connect to database", err)
+	}
 	defer bdb.Close()
 
-	if err := db.CreateTables(context.Background(), bdb); err != nil {
-		logger.Fatal("create tables failed", zap.Error(err))
+	// Schema changes are applied with cmd/dbmigrate, never at startup.
+	if err := db.CheckSchema(context.Background(), bdb); err != nil {
+		fatal("schema check failed", err)
 	}
 
-	h := handlers.New(bdb, cfg.JWTKey())
+	h := handlers.New(bdb, cfg, notifier)
 
 	e := echo.New()
+	// The server terminates TLS itself with no proxy in front, so the peer
+	// address is the client. X-Forwarded-For and X-Real-IP come from the
+	// client and would let it dodge the per-IP sign-in throttle.
+	e.IPExtractor = echo.ExtractIPDirect()
 	e.Use(echomw.RequestLoggerWithConfig(echomw.RequestLoggerConfig{
 		LogMethod: true,
 		LogURI:    true,
@@ -60,6 +84,7 @@ func main() {
 			switch {
 			case v.Status >= 500:
 				logger.Error("http request", fields...)
+				notifier.Notify(notify.KindHTTP, "%s %s %d: %v", v.Method, v.URI, v.Status, v.Error)
 			case v.Status >= 400:
 				logger.Warn("http request", fields...)
 			default:
@@ -78,30 +103,84 @@ func main() {
 
 	// Public
 	e.POST("/rp/signin", h.Signin)
+	e.POST("/rp/signin/2fa", h.SigninTOTP)
+	e.POST("/rp/refresh", h.Refresh)
+	e.GET("/.well-known/jwks.json", h.JWKS)
+
+	// Protected – require an X-API-Key header or a valid JWT in the Authorization header.
+	// Any signed-in user (or key with the read scope) may read; writes need the
+	// analyst role (or write scope) and admin routes are closed to API keys.
+	rp := e.Group("/rp",
+		mw.APIKey(h.LookupAPIKey),
+		mw.JWT(cfg.JWTKeys, h.IsTokenRevoked),
+		mw.RequireRole(models.RoleViewer),
+	)
+	rp.POST("/signout", h.Signout)
+	rp.POST("/account/password", h.ChangePassword)
+	rp.POST("/account/2fa/enroll", h.EnrollTOTP)
+	rp.POST("/account/2fa/verify", h.VerifyTOTP)
+	rp.POST("/account/2fa/disable", h.DisableTOTP)
+
+	analyst := mw.RequireRole(models.RoleAnalyst)
+	admin := mw.RequireRole(models.RoleAdmin)
 
-	// Protected – require valid JWT in Authorization header
-	rp := e.Group("/rp", mw.JWT(cfg.JWTKey()))
 	rp.GET("/dates", h.Dates)
 	rp.GET("/courses", h.Courses)
-	rp.POST("/courses", h.CreateCourse)
+	rp.POST("/courses", h.CreateCourse, admin)
 	rp.GET("/results", h.Results)
-	rp.POST("/analysis-results-update", h.ResultsAnalysis)
+	rp.POST("/analysis-results-update", h.ResultsAnalysis, analyst)
 	rp.GET("/amended", h.ResultsAmended)
-	rp.POST("/update-amended", h.UpdateAmended)
+	rp.POST("/update-amended", h.UpdateAmended, analyst)
 	rp.GET("/pre-race", h.GetPreRace)
-	rp.POST("/save-to-intermediary", h.SaveToIntermediary)
-	rp.POST("/update-pre-race", h.UpdatePreRace)
+	rp.POST("/save-to-intermediary", h.SaveToIntermediary, analyst)
+	rp.POST("/update-pre-race", h.UpdatePreRace, analyst)
 	rp.GET("/results-post-race", h.ResultsPostRace)
-	rp.POST("/save-to-res-post-race", h.SaveToResPostRace)
+	rp.POST("/save-to-res-post-race", h.SaveToResPostRace, analyst)
+	rp.GET("/revisions", h.ListRevisions)
+	rp.GET("/revisions/diff", h.DiffRevisions)
+	rp.POST("/revisions/:id/restore", h.RestoreRevision, analyst)
 	rp.GET("/form", h.GetForm)
+	rp.GET("/horses/:id", h.GetHorse)
 	rp.GET("/trainers", h.GetAllTrainers)
 	rp.GET("/trainer-notes", h.GetTrainerText)
-	rp.POST("/trainer-save", h.SaveTrainerText)
+	rp.POST("/trainer-save", h.SaveTrainerText, analyst)
+
+	// Ingest – scraper pushes. Kept out of rp so a key holding only the
+	// ingest scope is accepted; the schemas are published to any reader.
+	rp.GET("/ingest/schema/racecards", h.RacecardSchema)
+	rp.GET("/ingest/schema/results", h.ResultSchema)
+	ing := e.Group("/rp/ingest",
+		mw.APIKey(h.LookupAPIKey),
+		mw.JWT(cfg.JWTKeys, h.IsTokenRevoked),
+		mw.RequireScope(models.ScopeIngest),
+	)
+	ing.POST("/racecards", h.IngestRacecards)
+	ing.POST("/results", h.IngestResults)
+
+	// Admin – user and API key management, CSV import and export, repairs
+	adm := rp.Group("/admin", admin)
+	adm.POST("/password-hash", h.PasswordHash)
+	adm.GET("/audit", h.AuditLog)
+	adm.GET("/users", h.ListUsers)
+	adm.POST("/users", h.CreateUser)
+	adm.POST("/users/:id/disable", h.DisableUser)
+	adm.POST("/users/:id/enable", h.EnableUser)
+	adm.POST("/users/:id/password-reset", h.ResetUserPassword)
+	adm.DELETE("/users/:id", h.DeleteUser)
+	adm.GET("/role-policies", h.ListRolePolicies)
+	adm.PUT("/role-policies/:role", h.SetRolePolicy)
+	adm.GET("/api-keys", h.ListAPIKeys)
+	adm.POST("/api-keys", h.CreateAPIKey)
+	adm.DELETE("/api-keys/:id", h.RevokeAPIKey)
+	adm.GET("/csv", h.CSVTables)
+	adm.GET("/csv/:table", h.ExportCSV)
+	adm.POST("/csv/:table", h.ImportCSV)
+	adm.POST("/horse-stats/recompute", h.RecomputeHorseStats)
 
 	// Strip the "build/" prefix so URLs work correctly
 	subFS, err := fs.Sub(embeddedFiles, "build")
 	if err != nil {
-		logger.Fatal("open embedded build fs failed", zap.Error(err))
+		fatal("open embedded build fs failed", err)
 	}
 	// Serve static files correctly using Echo's WrapHandler
 	fileServer := http.FileServer(http.FS(subFS))
@@ -127,7 +206,7 @@ func main() {
 	if cfg.Debug {
 		logger.Info("starting server", zap.String("mode", "debug"), zap.String("addr", cfg.Port))
 		if err := e.Start(cfg.Port); err != nil {
-			logger.Fatal("server exited", zap.Error(err))
+			fatal("server exited", err)
 		}
 		return
 	}
@@ -148,7 +227,6 @@ func main() {
 	}
 
 	if err := s.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
-		logger.Error("tls server exited", zap.Error(err))
-		os.Exit(1)
+		fatal("tls server exited", err)
 	}
 }
@@ -1,23 +1,42 @@
 package middleware
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+
+	"github.com/padraicbc/mikeapi/config"
 )
 
 // Claims extends jwt.RegisteredClaims with application-specific fields.
+// RegisteredClaims.ID carries the token's jti.
 type Claims struct {
-	Username string `json:"username"`
-	UserHash string `json:"user_hash"`
+	Username  string `json:"username"`
+	UserHash  string `json:"user_hash"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid"`
+	// Purpose marks special-use tokens such as the sign-in 2FA challenge.
+	// Only tokens without a purpose grant API access.
+	Purpose string `json:"purpose,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// PurposeMFA marks the short-lived token that links the two sign-in steps
+// of a user with two-factor authentication enabled.
+const PurposeMFA = "mfa"
+
+// RevocationFunc reports whether an otherwise valid token has been revoked server-side.
+type RevocationFunc func(ctx context.Context, claims *Claims) (bool, error)
+
 // UserHashFromUsername returns a deterministic HMAC hash for the given username and key.
 func UserHashFromUsername(username string, key []byte) string {
 	normalized := strings.ToLower(strings.TrimSpace(username))
@@ -26,32 +45,98 @@ func UserHashFromUsername(username string, key []byte) string {
 	return hex.EncodeToString(mac.Sum(nil))
 }
 
+// Sign signs claims with the keyset's active key and sets the kid header.
+func Sign(keys *config.JWTKeySet, claims *Claims) (string, error) {
+	method := jwt.GetSigningMethod(keys.Active.Alg)
+	if method == nil {
+		return "", fmt.Errorf("unsupported signing algorithm %q", keys.Active.Alg)
+	}
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = keys.Active.ID
+	return token.SignedString(keys.Active.SigningKey())
+}
+
+// keyFunc resolves a token's kid header against the keyset and insists the
+// token's alg matches the key, so an RSA public key can never be used as an HMAC secret.
+func keyFunc(keys *config.JWTKeySet) jwt.Keyfunc {
+	return func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := keys.Lookup(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		if t.Method.Alg() != key.Alg {
+			return nil, fmt.Errorf("signing key %q does not accept %s", kid, t.Method.Alg())
+		}
+		return key.VerifyKey(), nil
+	}
+}
+
+var parser = jwt.NewParser(
+	jwt.WithValidMethods([]string{config.AlgHS256, config.AlgEdDSA, config.AlgRS256}),
+	jwt.WithExpirationRequired(),
+)
+
+// ParseToken verifies token against the keyset and returns its claims.
+// Only tokens carrying a known kid, the alg of that key and an expiry are accepted.
+func ParseToken(keys *config.JWTKeySet, token string) (*Claims, error) {
+	claims := &Claims{}
+	tkn, err := parser.ParseWithClaims(token, claims, keyFunc(keys))
+	if err != nil {
+		return nil, err
+	}
+	if !tkn.Valid {
+		return nil, jwt.ErrTokenSignatureInvalid
+	}
+	return claims, nil
+}
+
 // JWT returns an Echo middleware that validates the Authorization header token
-// using the provided signing key.
-func JWT(key []byte) echo.MiddlewareFunc {
+// with ParseToken and rejects tokens reported by revoked.
+// Requests already authenticated by APIKey pass straight through.
+func JWT(keys *config.JWTKeySet, revoked RevocationFunc) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
+			if _, ok := apiKeyFrom(c); ok {
+				return next(c)
+			}
+
 			token := c.Request().Header.Get("Authorization")
 			if token == "" {
 				return echo.NewHTTPError(http.StatusBadRequest, "missing authorization header")
 			}
 
-			claims := &Claims{}
-			tkn, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
-				return key, nil
-			})
+			claims, err := ParseToken(keys, token)
 			if err != nil {
-				if err == jwt.ErrSignatureInvalid {
-					return echo.NewHTTPError(http.StatusUnauthorized, "invalid token signature")
+				if errors.Is(err, jwt.ErrTokenMalformed) {
+					return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 				}
-				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+				// Expired, badly signed and unknown-kid tokens are all 401 so clients refresh.
+				return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
 			}
-			if !tkn.Valid {
+			// Special-purpose tokens never grant access, and tokens without a jti
+			// predate revocation support and cannot be revoked.
+			if claims.Purpose != "" || claims.ID == "" || claims.SessionID == "" {
 				return echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
 			}
 
+			if revoked != nil {
+				isRevoked, err := revoked(c.Request().Context(), claims)
+				if err != nil {
+					zap.L().Error("token revocation check failed", zap.Error(err))
+					return echo.NewHTTPError(http.StatusInternalServerError, "token revocation check failed")
+				}
+				if isRevoked {
+					return echo.NewHTTPError(http.StatusUnauthorized, "token revoked")
+				}
+			}
+
 			c.Set("username", claims.Username)
 			c.Set("user_hash", claims.UserHash)
+			c.Set("role", claims.Role)
+			c.Set("session_id", claims.SessionID)
+			c.Set("jti", claims.ID)
+			c.Set("claims", claims)
 			return next(c)
 		}
 	}
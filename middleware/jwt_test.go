@@ -0,0 +1,270 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+
+	"github.com/padraicbc/mikeapi/config"
+)
+
+// rsaKey is generated once; 2048-bit keys take a while.
+var rsaKey = sync.OnceValue(func() *rsa.PrivateKey {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return k
+})
+
+func hmacKey(kid, secret string) *config.JWTKey {
+	return &config.JWTKey{ID: kid, Alg: config.AlgHS256, Secret: []byte(secret)}
+}
+
+func keySet(t *testing.T, active *config.JWTKey, retired ...*config.JWTKey) *config.JWTKeySet {
+	t.Helper()
+	ks, err := config.NewJWTKeySet(active, retired...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+// accessClaims are valid access token claims expiring in an hour.
+func accessClaims() *Claims {
+	return &Claims{
+		Username:  "ann",
+		Role:      "analyst",
+		SessionID: "sid-1",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        "jti-1",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+}
+
+// signRaw signs claims with method and key, setting kid unless it is empty.
+func signRaw(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.Claims) string {
+	t.Helper()
+	tok := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		tok.Header["kid"] = kid
+	}
+	s, err := tok.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestParseTokenRejects(t *testing.T) {
+	pub := &rsaKey().PublicKey
+	rs := &config.JWTKey{ID: "rs1", Alg: config.AlgRS256, PrivateKey: rsaKey(), PublicKey: pub}
+	rsKeys := keySet(t, rs)
+	hsKeys := keySet(t, hmacKey("hs1", "secret-1"))
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	noExp := accessClaims()
+	noExp.ExpiresAt = nil
+	expired := accessClaims()
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+
+	tests := []struct {
+		name  string
+		keys  *config.JWTKeySet
+		token string
+		want  string
+	}{
+		// The classic confusion attack: HS256 keyed with the public key the
+		// verifier would use for RS256.
+		{"HS256 with the RSA public key as PEM", rsKeys,
+			signRaw(t, jwt.SigningMethodHS256, "rs1", pemBytes, accessClaims()), "does not accept HS256"},
+		{"HS256 with the RSA public key as DER", rsKeys,
+			signRaw(t, jwt.SigningMethodHS256, "rs1", der, accessClaims()), "does not accept HS256"},
+		{"RS256 under an HMAC kid", hsKeys,
+			signRaw(t, jwt.SigningMethodRS256, "hs1", rsaKey(), accessClaims()), "does not accept RS256"},
+		{"alg none", hsKeys,
+			signRaw(t, jwt.SigningMethodNone, "hs1", jwt.UnsafeAllowNoneSignatureType, accessClaims()), "signing method none is invalid"},
+		{"unknown kid", hsKeys,
+			signRaw(t, jwt.SigningMethodHS256, "hs2", []byte("secret-1"), accessClaims()), `unknown signing key "hs2"`},
+		{"missing kid", hsKeys,
+			signRaw(t, jwt.SigningMethodHS256, "", []byte("secret-1"), accessClaims()), `unknown signing key ""`},
+		{"wrong secret", hsKeys,
+			signRaw(t, jwt.SigningMethodHS256, "hs1", []byte("secret-2"), accessClaims()), "signature is invalid"},
+		{"missing exp", hsKeys,
+			signRaw(t, jwt.SigningMethodHS256, "hs1", []byte("secret-1"), noExp), "exp claim is required"},
+		{"expired", hsKeys,
+			signRaw(t, jwt.SigningMethodHS256, "hs1", []byte("secret-1"), expired), "token is expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := ParseToken(tt.keys, tt.token)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ParseToken = %+v, %v; want an error containing %q", claims, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTokenRotation(t *testing.T) {
+	old := hmacKey("2024-01", "old-secret")
+	cur := hmacKey("2024-07", "new-secret")
+
+	// Before the rotation: tokens carry the old kid.
+	oldToken, err := Sign(keySet(t, old), accessClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// During the rotation the old key is kept for verifying only.
+	rotating := keySet(t, cur, old)
+	newToken, err := Sign(rotating, accessClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tok := range map[string]string{"retired key": oldToken, "active key": newToken} {
+		if claims, err := ParseToken(rotating, tok); err != nil || claims.Username != "ann" {
+			t.Errorf("%s: ParseToken = %+v, %v", name, claims, err)
+		}
+	}
+	if _, err := jwt.NewParser().Parse(newToken, func(tok *jwt.Token) (interface{}, error) {
+		if tok.Header["kid"] != "2024-07" {
+			t.Errorf("new token kid = %v, want 2024-07", tok.Header["kid"])
+		}
+		return cur.Secret, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the old key is dropped its tokens stop verifying.
+	rotated := keySet(t, cur)
+	if _, err := ParseToken(rotated, oldToken); err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+		t.Errorf("rotated-out key: ParseToken error = %v, want unknown signing key", err)
+	}
+	if _, err := ParseToken(rotated, newToken); err != nil {
+		t.Errorf("active key after rotation: %v", err)
+	}
+}
+
+func TestNewJWTKeySetDuplicateKid(t *testing.T) {
+	if _, err := config.NewJWTKeySet(hmacKey("a", "x"), hmacKey("a", "y")); err == nil {
+		t.Error("NewJWTKeySet accepted a duplicate kid")
+	}
+}
+
+func TestParseTokenAsymmetric(t *testing.T) {
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed := &config.JWTKey{ID: "ed1", Alg: config.AlgEdDSA, PrivateKey: edPriv, PublicKey: edPub}
+	rs := &config.JWTKey{ID: "rs1", Alg: config.AlgRS256, PrivateKey: rsaKey(), PublicKey: &rsaKey().PublicKey}
+
+	for _, k := range []*config.JWTKey{ed, rs} {
+		t.Run(k.Alg, func(t *testing.T) {
+			tok, err := Sign(keySet(t, k), accessClaims())
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A verifier holding only the public key accepts it.
+			verifier := keySet(t, &config.JWTKey{ID: k.ID, Alg: k.Alg, PublicKey: k.PublicKey})
+			claims, err := ParseToken(verifier, tok)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Username != "ann" || claims.SessionID != "sid-1" || claims.ID != "jti-1" {
+				t.Errorf("claims = %+v", claims)
+			}
+		})
+	}
+
+	// Each key only verifies its own algorithm, even when the kid is swapped.
+	edToken, _ := Sign(keySet(t, ed), accessClaims())
+	mixed := keySet(t, &config.JWTKey{ID: "ed1", Alg: config.AlgRS256, PublicKey: &rsaKey().PublicKey})
+	if _, err := ParseToken(mixed, edToken); err == nil || !strings.Contains(err.Error(), "does not accept EdDSA") {
+		t.Errorf("EdDSA token under an RS256 key: %v", err)
+	}
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	wrong := keySet(t, &config.JWTKey{ID: "ed1", Alg: config.AlgEdDSA, PublicKey: other})
+	if _, err := ParseToken(wrong, edToken); err == nil {
+		t.Error("EdDSA token verified with another public key")
+	}
+}
+
+// TestJWTAccessGate checks which verified tokens the middleware lets through.
+func TestJWTAccessGate(t *testing.T) {
+	keys := keySet(t, hmacKey("hs1", "secret-1"))
+	token := func(edit func(*Claims)) string {
+		c := accessClaims()
+		edit(c)
+		tok, err := Sign(keys, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	valid := token(func(*Claims) {})
+	revokedJTI := func(_ context.Context, c *Claims) (bool, error) { return c.ID == "revoked", nil }
+	failing := func(context.Context, *Claims) (bool, error) { return false, errors.New("db down") }
+
+	tests := []struct {
+		name    string
+		header  string
+		revoked RevocationFunc
+		want    int
+	}{
+		{"access token", valid, revokedJTI, http.StatusOK},
+		{"no revocation check", valid, nil, http.StatusOK},
+		{"MFA challenge token", token(func(c *Claims) { c.Purpose = PurposeMFA }), revokedJTI, http.StatusUnauthorized},
+		{"any other purpose", token(func(c *Claims) { c.Purpose = "reset" }), nil, http.StatusUnauthorized},
+		{"no jti", token(func(c *Claims) { c.ID = "" }), nil, http.StatusUnauthorized},
+		{"no session", token(func(c *Claims) { c.SessionID = "" }), nil, http.StatusUnauthorized},
+		{"revoked jti", token(func(c *Claims) { c.ID = "revoked" }), revokedJTI, http.StatusUnauthorized},
+		{"revocation check fails", valid, failing, http.StatusInternalServerError},
+		{"missing header", "", nil, http.StatusBadRequest},
+		{"malformed", "not.a.jwt", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/rp/races", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+			err := JWT(keys, tt.revoked)(func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			})(c)
+
+			code := rec.Code
+			if he, ok := err.(*echo.HTTPError); ok {
+				code = he.Code
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if code != tt.want {
+				t.Errorf("status %d (%v), want %d", code, err, tt.want)
+			}
+			if tt.want == http.StatusOK && (c.Get("username") != "ann" || c.Get("session_id") != "sid-1" || c.Get("jti") != "jti-1") {
+				t.Errorf("context not set from the claims: username %v, session %v, jti %v", c.Get("username"), c.Get("session_id"), c.Get("jti"))
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/padraicbc/mikeapi/models"
+)
+
+// roleScopes maps a role to the API key scope that stands in for it.
+// Admin has no scope: API keys can never reach admin routes.
+var roleScopes = map[string]string{
+	models.RoleViewer:  models.ScopeRead,
+	models.RoleAnalyst: models.ScopeWrite,
+}
+
+// scopeRoles maps an API key scope to the minimum role a signed-in user needs instead.
+var scopeRoles = map[string]string{
+	models.ScopeRead:   models.RoleViewer,
+	models.ScopeWrite:  models.RoleAnalyst,
+	models.ScopeIngest: models.RoleAnalyst,
+}
+
+// RequireRole returns an Echo middleware that only lets through users whose
+// role is at least role, or API keys holding the matching scope. It must run
+// after JWT and APIKey, which set the role and key.
+func RequireRole(role string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if p, ok := apiKeyFrom(c); ok {
+				scope, mapped := roleScopes[role]
+				if !mapped || !p.HasScope(scope) {
+					return echo.NewHTTPError(http.StatusForbidden, "API key lacks required scope")
+				}
+				return next(c)
+			}
+
+			have, _ := c.Get("role").(string)
+			if !models.RoleAtLeast(have, role) {
+				return echo.NewHTTPError(http.StatusForbidden, role+" access required")
+			}
+			return next(c)
+		}
+	}
+}
+
+// RequireScope returns an Echo middleware that only lets through API keys
+// holding scope, or signed-in users with the equivalent role.
+func RequireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if p, ok := apiKeyFrom(c); ok {
+				if !p.HasScope(scope) {
+					return echo.NewHTTPError(http.StatusForbidden, "API key lacks "+scope+" scope")
+				}
+				return next(c)
+			}
+
+			have, _ := c.Get("role").(string)
+			role, mapped := scopeRoles[scope]
+			if !mapped || !models.RoleAtLeast(have, role) {
+				return echo.NewHTTPError(http.StatusForbidden, scope+" access required")
+			}
+			return next(c)
+		}
+	}
+}
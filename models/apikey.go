@@ -0,0 +1,41 @@
+package models
+
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// API key scopes. read and write mirror the viewer and analyst roles;
+// ingest allows the bulk ingestion endpoints.
+const (
+	ScopeRead   = "read"
+	ScopeWrite  = "write"
+	ScopeIngest = "ingest"
+)
+
+// APIKey is a long-lived credential for machine clients such as the scraper.
+// Only a SHA-256 hash of the key is stored; Prefix identifies it in lookups and listings.
+type APIKey struct {
+	bun.BaseModel `bun:"table:api_keys,alias:ak"`
+
+	ID         int        `bun:"id,pk,autoincrement" json:"id"`
+	Name       string     `bun:"name,notnull" json:"name"`
+	Prefix     string     `bun:"prefix,notnull,unique" json:"prefix"`
+	KeyHash    string     `bun:"key_hash,notnull" json:"-"`
+	Scopes     []string   `bun:"scopes,notnull,array" json:"scopes"`
+	CreatedBy  string     `bun:"created_by,notnull" json:"createdBy"`
+	CreatedAt  time.Time  `bun:"created_at,notnull,default:current_timestamp" json:"createdAt"`
+	ExpiresAt  *time.Time `bun:"expires_at" json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `bun:"last_used_at" json:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time `bun:"revoked_at" json:"revokedAt,omitempty"`
+}
+
+// ValidScope reports whether scope is one of the known API key scopes.
+func ValidScope(scope string) bool {
+	switch scope {
+	case ScopeRead, ScopeWrite, ScopeIngest:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// AuditLog records one row changed through the API: who changed it, through
+// which endpoint, and the row as JSON before and after. Before is null for
+// inserted rows. Password and key hashes and TOTP secrets are left out.
+type AuditLog struct {
+	bun.BaseModel `bun:"table:audit_log,alias:al"`
+
+	ID        int64           `bun:"id,pk,autoincrement" json:"id"`
+	Username  string          `bun:"username,notnull" json:"username"`
+	UserHash  string          `bun:"user_hash" json:"userHash,omitempty"`
+	Endpoint  string          `bun:"endpoint,notnull" json:"endpoint"`
+	TableName string          `bun:"table_name,notnull" json:"table"`
+	RaceID    *int            `bun:"race_id" json:"raceID,omitempty"`
+	ResultID  *int            `bun:"result_id" json:"resultID,omitempty"`
+	Before    json.RawMessage `bun:"before,type:jsonb" json:"before"`
+	After     json.RawMessage `bun:"after,type:jsonb" json:"after"`
+	CreatedAt time.Time       `bun:"created_at,notnull,default:current_timestamp" json:"createdAt"`
+}
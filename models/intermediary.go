@@ -11,4 +11,7 @@ type Intermediary struct {
 	RaceID   int     `bun:"race_id,notnull" json:"raceID"`
 	MrPlusOr *int    `bun:"mr_plus_or" json:"mrPlusOr,omitempty"`
 	Tfr      *string `bun:"tfr" json:"tfr,omitempty"`
+
+	Race  *Race  `bun:"rel:belongs-to,join:race_id=race_id" json:"-"`
+	Horse *Horse `bun:"rel:belongs-to,join:horse_id=horse_id" json:"-"`
 }
@@ -21,4 +21,6 @@ type PreRace struct {
 	Distance  float64         `bun:"distance,notnull" json:"distance"`
 	Class     string          `bun:"class,notnull" json:"class"`
 	URL       string          `bun:"url,notnull" json:"url"`
+
+	Race *Race `bun:"rel:belongs-to,join:race_id=race_id" json:"-"`
 }
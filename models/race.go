@@ -20,6 +20,8 @@ type Race struct {
 	PreDone     bool     `bun:"pre_done,notnull,default:false" json:"preDone"`
 	MainComment *string  `bun:"main_comment" json:"mainComment,omitempty"`
 	Amended     bool     `bun:"amended,notnull,default:false" json:"amended"`
+	Version     int      `bun:"version,notnull,default:1" json:"version"`
 
-	Course *Course `bun:"rel:belongs-to,join:course_id=course_id" json:"-"`
+	Course  *Course   `bun:"rel:belongs-to,join:course_id=course_id" json:"-"`
+	Results []*Result `bun:"rel:has-many,join:race_id=race_id" json:"-"`
 }
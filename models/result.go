@@ -38,4 +38,9 @@ type Result struct {
 	SpeedPer         *float64 `bun:"speed_per" json:"speedPer,omitempty"`
 	Comment          *string  `bun:"comment" json:"comment,omitempty"`
 	Analysed         bool     `bun:"analysed,notnull,default:false" json:"analysed"`
+	Version          int      `bun:"version,notnull,default:1" json:"version"`
+
+	Race   *Race   `bun:"rel:belongs-to,join:race_id=race_id" json:"-"`
+	Horse  *Horse  `bun:"rel:belongs-to,join:horse_id=horse_id" json:"-"`
+	Course *Course `bun:"rel:belongs-to,join:course_id=course_id" json:"-"`
 }
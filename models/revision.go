@@ -0,0 +1,22 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// Revision is a snapshot of a race row and all of its result rows, taken
+// just before an analysis save overwrote them. Snapshot holds
+// {"race": {...}, "results": [{...}, ...]} with the rows' column names as keys.
+type Revision struct {
+	bun.BaseModel `bun:"table:revisions,alias:rv"`
+
+	ID        int             `bun:"id,pk,autoincrement" json:"id"`
+	RaceID    int             `bun:"race_id,notnull" json:"raceID"`
+	Username  string          `bun:"username,notnull" json:"username"`
+	Endpoint  string          `bun:"endpoint,notnull" json:"endpoint"`
+	Snapshot  json.RawMessage `bun:"snapshot,notnull,type:jsonb" json:"snapshot,omitempty"`
+	CreatedAt time.Time       `bun:"created_at,notnull,default:current_timestamp" json:"createdAt"`
+}
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// RefreshToken is a hashed, single-use refresh token. Every token issued
+// from one sign-in shares a SessionID so the whole session can be revoked.
+type RefreshToken struct {
+	bun.BaseModel `bun:"table:refresh_tokens,alias:rt"`
+
+	ID        int        `bun:"id,pk,autoincrement" json:"id"`
+	UserID    int        `bun:"user_id,notnull" json:"userID"`
+	SessionID string     `bun:"session_id,notnull" json:"sessionID"`
+	TokenHash string     `bun:"token_hash,notnull,unique" json:"-"`
+	ExpiresAt time.Time  `bun:"expires_at,notnull" json:"expiresAt"`
+	CreatedAt time.Time  `bun:"created_at,notnull,default:current_timestamp" json:"createdAt"`
+	RevokedAt *time.Time `bun:"revoked_at" json:"revokedAt,omitempty"`
+}
+
+// RevokedToken records the jti of an access token revoked before it expired.
+type RevokedToken struct {
+	bun.BaseModel `bun:"table:revoked_tokens,alias:rvt"`
+
+	JTI       string    `bun:"jti,pk" json:"jti"`
+	ExpiresAt time.Time `bun:"expires_at,notnull" json:"expiresAt"`
+}
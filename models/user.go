@@ -1,6 +1,23 @@
 package models
 
-import "github.com/uptrace/bun"
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// User roles, from least to most privileged.
+const (
+	RoleViewer  = "viewer"
+	RoleAnalyst = "analyst"
+	RoleAdmin   = "admin"
+)
+
+var roleRanks = map[string]int{
+	RoleViewer:  1,
+	RoleAnalyst: 2,
+	RoleAdmin:   3,
+}
 
 // User is an API user with bcrypt-hashed password.
 type User struct {
@@ -9,4 +26,43 @@ type User struct {
 	ID       int    `bun:"id,pk,autoincrement" json:"id"`
 	Username string `bun:"username,notnull,unique" json:"username"`
 	Password string `bun:"password,notnull" json:"-"`
+	Role     string `bun:"role,notnull,default:'viewer'" json:"role"`
+	Disabled bool   `bun:"disabled,notnull,default:false" json:"disabled"`
+
+	// TOTP two-factor authentication. TOTPSecret is set at enrollment and
+	// TOTPEnabled once a code has been verified; TOTPLastStep blocks code replay.
+	TOTPSecret   *string `bun:"totp_secret" json:"-"`
+	TOTPEnabled  bool    `bun:"totp_enabled,notnull,default:false" json:"totpEnabled"`
+	TOTPLastStep int64   `bun:"totp_last_step,notnull,default:0" json:"-"`
+}
+
+// RecoveryCode is a hashed single-use code that stands in for a TOTP code.
+type RecoveryCode struct {
+	bun.BaseModel `bun:"table:recovery_codes,alias:rec"`
+
+	ID       int        `bun:"id,pk,autoincrement" json:"id"`
+	UserID   int        `bun:"user_id,notnull" json:"userID"`
+	CodeHash string     `bun:"code_hash,notnull" json:"-"`
+	UsedAt   *time.Time `bun:"used_at" json:"usedAt,omitempty"`
+}
+
+// RolePolicy holds per-role security requirements set by admins.
+type RolePolicy struct {
+	bun.BaseModel `bun:"table:role_policies,alias:rp"`
+
+	Role        string `bun:"role,pk" json:"role"`
+	RequireTOTP bool   `bun:"require_totp,notnull,default:false" json:"requireTOTP"`
+}
+
+// ValidRole reports whether role is one of the known user roles.
+func ValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// RoleAtLeast reports whether role grants every permission of min.
+// Unknown roles satisfy nothing.
+func RoleAtLeast(role, min string) bool {
+	have, ok := roleRanks[role]
+	return ok && have >= roleRanks[min]
 }
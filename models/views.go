@@ -0,0 +1,16 @@
+package models
+
+// ResultsJoinSQL selects results with their horse, race and course, as shown
+// on the results and analysis screens. Callers append WHERE and ORDER BY.
+const ResultsJoinSQL = `
+SELECT
+	r.id, r.placed, r.official_rat, r.weight_carried, h.horse,
+	r.mr_plus_or, r.mr2_plus_or, r.tfsf, r.sec_t, r.speed_per, r.comment, r.dist_behind_winner, r.version,
+	rc.date::text AS date, rc.time, rc.class, rc.distance, rc.going, rc.url,
+	rc.race_id, rc.mr, rc.mr2, rc.main_comment, rc.version AS race_version,
+	c.course, c.course_id, c.direction, c.is_aw
+FROM results r
+INNER JOIN courses c  ON r.course_id  = c.course_id
+INNER JOIN horses  h  ON r.horse_id   = h.horse_id
+INNER JOIN races   rc ON r.race_id    = rc.race_id
+`
@@ -0,0 +1,179 @@
+// Package notify mails digests of server errors to the report address.
+//
+// Errors are batched: the first one after a quiet spell opens a window of
+// Delay that gathers the rest of the burst, and digests go out at most once
+// per Interval, so an outage costs one email per Interval rather than one
+// per failed request. A nil *Notifier discards everything, so callers need
+// not check whether reporting is configured.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/padraicbc/mikeapi/config"
+)
+
+// Kinds of event, shown in each digest line.
+const (
+	KindHTTP    = "5xx"
+	KindRetry   = "retry"
+	KindStartup = "startup"
+)
+
+// maxEvents caps the events listed in one digest; the rest are only counted.
+const maxEvents = 100
+
+// sendTimeout bounds a digest sent in the background.
+const sendTimeout = 30 * time.Second
+
+// Event is one reported error.
+type Event struct {
+	Time time.Time
+	Kind string
+	Text string
+}
+
+// Notifier batches events into digests and sends them through a Transport.
+type Notifier struct {
+	transport Transport
+	from      string
+	to        []string
+	delay     time.Duration
+	interval  time.Duration
+	host      string
+
+	mu       sync.Mutex
+	events   []Event
+	dropped  int
+	timer    *time.Timer
+	lastSent time.Time
+}
+
+// New returns a Notifier that mails digests from from to to.
+func New(t Transport, from string, to []string, delay, interval time.Duration) *Notifier {
+	host, _ := os.Hostname()
+	return &Notifier{
+		transport: t,
+		from:      from,
+		to:        to,
+		delay:     delay,
+		interval:  interval,
+		host:      host,
+	}
+}
+
+// Setup builds the Notifier the config asks for: appending to NOTIFY_FILE if
+// set, else mailing through SMTP_ADDR. It returns nil when neither is set.
+// Reports go to the RP_REPORT_TO addresses from RP_REPORT_FROM, read as
+// mikerp reads them.
+func Setup(cfg *config.Config) *Notifier {
+	var t Transport
+	switch {
+	case cfg.NotifyFile != "":
+		t = &File{Path: cfg.NotifyFile}
+	case cfg.SMTPAddr != "":
+		t = &SMTP{Addr: cfg.SMTPAddr, Username: cfg.SMTPUser, Password: cfg.SMTPPass}
+	default:
+		return nil
+	}
+
+	rp := config.LoadRP()
+	var to []string
+	for _, addr := range strings.Split(rp.ReportTo, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			to = append(to, addr)
+		}
+	}
+	if len(to) == 0 || rp.ReportFrom == "" {
+		zap.L().Fatal("config: RP_REPORT_TO and RP_REPORT_FROM must be set to send error reports")
+	}
+	return New(t, rp.ReportFrom, to, cfg.NotifyDelay, cfg.NotifyInterval)
+}
+
+// Notify queues an event for the next digest and never blocks on sending.
+func (n *Notifier) Notify(kind, format string, args ...interface{}) {
+	if n == nil {
+		return
+	}
+	ev := Event{Time: time.Now(), Kind: kind, Text: fmt.Sprintf(format, args...)}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.events) < maxEvents {
+		n.events = append(n.events, ev)
+	} else {
+		n.dropped++
+	}
+	if n.timer == nil {
+		wait := n.delay
+		if next := time.Until(n.lastSent.Add(n.interval)); next > wait {
+			wait = next
+		}
+		n.timer = time.AfterFunc(wait, n.send)
+	}
+}
+
+func (n *Notifier) send() {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	if err := n.Flush(ctx); err != nil {
+		zap.L().Error("send error report", zap.Error(err))
+	}
+}
+
+// Flush sends any queued events now, regardless of the rate limit. Call it
+// before exiting so the last events are not lost.
+func (n *Notifier) Flush(ctx context.Context) error {
+	if n == nil {
+		return nil
+	}
+	n.mu.Lock()
+	if n.timer != nil {
+		n.timer.Stop()
+		n.timer = nil
+	}
+	events, dropped := n.events, n.dropped
+	n.events, n.dropped = nil, 0
+	if len(events) > 0 {
+		n.lastSent = time.Now()
+	}
+	n.mu.Unlock()
+
+	if len(events) == 0 {
+		return nil
+	}
+	return n.transport.Send(ctx, n.digest(events, dropped))
+}
+
+// digest renders queued events as one message, oldest first.
+func (n *Notifier) digest(events []Event, dropped int) *Message {
+	total := len(events) + dropped
+	noun := "errors"
+	if total == 1 {
+		noun = "error"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "mikeapi on %s reported %d %s:\n\n", n.host, total, noun)
+	for _, ev := range events {
+		fmt.Fprintf(&b, "%s  %-7s  %s\n", ev.Time.Format(time.DateTime), ev.Kind, ev.Text)
+	}
+	if dropped > 0 {
+		fmt.Fprintf(&b, "\n...and %d more not listed; see the server log.\n", dropped)
+	}
+
+	return &Message{
+		From:    n.from,
+		To:      n.to,
+		Subject: fmt.Sprintf("mikeapi on %s: %d %s", n.host, total, noun),
+		Body:    b.String(),
+		Date:    time.Now(),
+	}
+}
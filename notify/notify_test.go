@@ -0,0 +1,125 @@
+package notify
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fileNotifier returns a Notifier appending to a file in a temp dir, and a
+// func that reads the subjects of the messages written so far.
+func fileNotifier(t *testing.T, delay, interval time.Duration) (*Notifier, func() []string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "reports.eml")
+	n := New(&File{Path: path}, "errors@example.com", []string{"ops@example.com"}, delay, interval)
+	n.host = "testhost"
+	subjects := func() []string {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return regexp.MustCompile(`(?m)^Subject: (.*)\r$`).FindAllString(string(data), -1)
+	}
+	return n, subjects
+}
+
+// waitFor polls until cond holds or the deadline passes.
+func waitFor(t *testing.T, within time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(within)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBurstIsOneDigest(t *testing.T) {
+	n, subjects := fileNotifier(t, 50*time.Millisecond, time.Hour)
+	for i := 0; i < 5; i++ {
+		n.Notify(KindHTTP, "GET /rp/races %d: boom", i)
+	}
+	if got := subjects(); len(got) != 0 {
+		t.Fatalf("sent before the delay: %q", got)
+	}
+
+	waitFor(t, 2*time.Second, func() bool { return len(subjects()) > 0 })
+	time.Sleep(100 * time.Millisecond)
+	got := subjects()
+	if len(got) != 1 || !strings.Contains(got[0], "testhost: 5 errors") {
+		t.Errorf("subjects = %q, want one digest of 5 errors", got)
+	}
+}
+
+func TestIntervalBetweenDigests(t *testing.T) {
+	const interval = 400 * time.Millisecond
+	n, subjects := fileNotifier(t, 10*time.Millisecond, interval)
+
+	n.Notify(KindRetry, "first")
+	waitFor(t, 2*time.Second, func() bool { return len(subjects()) == 1 })
+	sent := time.Now()
+
+	n.Notify(KindRetry, "second")
+	n.Notify(KindRetry, "third")
+	time.Sleep(interval / 2)
+	if got := subjects(); len(got) != 1 {
+		t.Fatalf("second digest sent within the interval: %q", got)
+	}
+
+	waitFor(t, 2*time.Second, func() bool { return len(subjects()) == 2 })
+	if elapsed := time.Since(sent); elapsed < interval-50*time.Millisecond {
+		t.Errorf("second digest after %s, want at least %s", elapsed, interval)
+	}
+	if got := subjects()[1]; !strings.Contains(got, ": 2 errors") {
+		t.Errorf("second subject = %q, want 2 errors", got)
+	}
+}
+
+func TestOverflowIsCounted(t *testing.T) {
+	n, subjects := fileNotifier(t, time.Hour, time.Hour)
+	for i := 0; i < maxEvents+7; i++ {
+		n.Notify(KindHTTP, "error %d", i)
+	}
+	if err := n.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := subjects()
+	if len(got) != 1 || !strings.Contains(got[0], ": 107 errors") {
+		t.Fatalf("subjects = %q, want one digest of 107 errors", got)
+	}
+	data, err := os.ReadFile(n.transport.(*File).Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "...and 7 more not listed") {
+		t.Errorf("digest does not count the dropped events:\n%s", data)
+	}
+	if strings.Contains(string(data), "error 100\r\n") {
+		t.Error("digest lists more than maxEvents events")
+	}
+
+	// Flushing again has nothing to send.
+	if err := n.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := subjects(); len(got) != 1 {
+		t.Errorf("empty flush sent a digest: %q", got)
+	}
+}
+
+func TestNilNotifier(t *testing.T) {
+	var n *Notifier
+	n.Notify(KindStartup, "ignored")
+	if err := n.Flush(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
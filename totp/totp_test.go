@@ -0,0 +1,118 @@
+package totp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the RFC 6238 Appendix B SHA-1 key "12345678901234567890".
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestRFC6238Vectors checks the Appendix B SHA-1 test vectors, reduced to
+// their last six digits.
+func TestRFC6238Vectors(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string // 8 digits, as in the RFC
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tt.want[2:]; got != want {
+			t.Errorf("Code at %d = %s, want %s", tt.unix, got, want)
+		}
+	}
+}
+
+func TestVerifySkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := Step(now)
+	for offset, want := range map[int64]bool{-2: false, -1: true, 0: true, 1: true, 2: false} {
+		code, err := Code(rfcSecret, step+offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := Verify(rfcSecret, code, now)
+		if ok != want {
+			t.Errorf("code from step %+d: ok = %v, want %v", offset, ok, want)
+		}
+		if ok && got != step+offset {
+			t.Errorf("code from step %+d matched step %d, want %d", offset, got, step+offset)
+		}
+	}
+
+	code, _ := Code(rfcSecret, step)
+	if _, ok := Verify(strings.ToLower(rfcSecret), code[:3]+" "+code[3:], now); !ok {
+		t.Error("lower-case secret and spaced code not accepted")
+	}
+	for _, bad := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := Verify(rfcSecret, bad, now); ok {
+			t.Errorf("Verify accepted %q", bad)
+		}
+	}
+	if _, ok := Verify("not base32!", code, now); ok {
+		t.Error("Verify accepted an invalid secret")
+	}
+}
+
+func TestVerifyFreshRejectsReplay(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := Step(now)
+	code, _ := Code(rfcSecret, step)
+
+	got, ok := VerifyFresh(rfcSecret, code, now, 0)
+	if !ok || got != step {
+		t.Fatalf("first use: step %d, ok %v; want %d, true", got, ok, step)
+	}
+	if _, ok := VerifyFresh(rfcSecret, code, now, got); ok {
+		t.Error("the same code was accepted twice")
+	}
+
+	// An older code inside the skew window is also a replay once a newer
+	// step has been used.
+	prev, _ := Code(rfcSecret, step-1)
+	if _, ok := VerifyFresh(rfcSecret, prev, now, step); ok {
+		t.Error("a code older than the last used step was accepted")
+	}
+	next, _ := Code(rfcSecret, step+1)
+	if got, ok := VerifyFresh(rfcSecret, next, now, step); !ok || got != step+1 {
+		t.Errorf("next step: %d, %v; want %d, true", got, ok, step+1)
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := GenerateSecret()
+	if len(a) != 32 || a == b {
+		t.Errorf("secrets %q and %q: want distinct 32-character secrets", a, b)
+	}
+	if _, err := Code(a, 1); err != nil {
+		t.Errorf("generated secret does not decode: %v", err)
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	u, err := url.Parse(ProvisioningURI("mikeapi", "ann@example.com", rfcSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/mikeapi:ann@example.com" ||
+		q.Get("secret") != rfcSecret || q.Get("issuer") != "mikeapi" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("unexpected URI %s", u)
+	}
+}